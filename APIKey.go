@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyPrefix is used to tell api keys apart from session tokens
+const apiKeyPrefix = "wgui_"
+
+// scopes that can be granted to api keys, * grants all of them and resource:* grants all scopes of a resource
+var apiKeyScopes = []string{"*", "peers:read", "peers:write", "groups:read", "groups:write", "logs:read", "keys:read", "keys:write", "account:write", "audit:read", "webhooks:read", "webhooks:write", "profiles:read", "profiles:write"}
+
+type APIKey struct {
+	ID         primitive.ObjectID `json:"ID" bson:"_id"`
+	Name       string             `json:"Name" bson:"name"`
+	Hash       string             `json:"-" bson:"hash"`
+	OwnerID    string             `json:"OwnerID" bson:"ownerID"` // requests made with this key act as this peer
+	Scopes     []string           `json:"Scopes" bson:"scopes"`
+	Prefix     string             `json:"Prefix" bson:"prefix"`       // only peers and groups with names starting with this can be accessed
+	ExpiresAt  int64              `json:"ExpiresAt" bson:"expiresAt"` // 0 means the key never expires
+	CreatedAt  int64              `json:"CreatedAt" bson:"createdAt"`
+	LastUsedAt int64              `json:"LastUsedAt" bson:"lastUsedAt"`
+	RevokedAt  int64              `json:"RevokedAt" bson:"revokedAt"`
+}
+
+// HasScope checks if key was granted scope
+func (key *APIKey) HasScope(scope string) bool {
+	resource, _, _ := strings.Cut(scope, ":")
+	return slices.Contains(key.Scopes, "*") || slices.Contains(key.Scopes, resource+":*") || slices.Contains(key.Scopes, scope)
+}
+
+// validScope checks if scope is a known scope or a wildcard of a known resource
+func validScope(scope string) bool {
+	if resource, ok := strings.CutSuffix(scope, ":*"); ok {
+		return slices.ContainsFunc(apiKeyScopes, func(s string) bool { return strings.HasPrefix(s, resource+":") })
+	}
+	return slices.Contains(apiKeyScopes, scope)
+}
+
+// keyAllowsName checks if the api key used for the request, if any, can access peers and groups named name
+func keyAllowsName(ctx echo.Context, name string) bool {
+	apiKey, ok := ctx.Get("apiKey").(*APIKey)
+	return !ok || strings.HasPrefix(name, apiKey.Prefix)
+}
+
+// hashAPIKey returns the hash that is stored instead of the key itself
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// authenticateAPIKey returns the key and the peer it belongs to
+func authenticateAPIKey(key string) (*APIKey, *Peer, error) {
+	apiKey, err := store.GetAPIKeyByHash(hashAPIKey(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().UnixMilli()
+	if apiKey.RevokedAt != 0 {
+		return nil, nil, errRevokedToken
+	}
+	if apiKey.ExpiresAt != 0 && apiKey.ExpiresAt < now {
+		return nil, nil, errExpiredToken
+	}
+	peer, err := store.GetPeer(apiKey.OwnerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// record usage at most once a minute
+	if now-apiKey.LastUsedAt > time.Minute.Milliseconds() {
+		err = store.UpdateAPIKey(apiKey.ID, map[string]interface{}{"lastUsedAt": now})
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", peer.Name))
+		}
+	}
+
+	return apiKey, peer, nil
+}
+
+func GetAPIKeys(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	var keys []*APIKey
+	var err error
+	if hasPermission(peer, PermAllKeys) {
+		keys, err = store.GetAPIKeys()
+	} else {
+		keys, err = store.GetAPIKeysByOwnerID(peer.ID)
+	}
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+
+	return ctx.JSON(200, keys)
+}
+
+func PostAPIKeys(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// get key info from request body
+	var data struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		Prefix    string   `json:"prefix"`
+		ExpiresAt int64    `json:"expiresAt"`
+	}
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if len(data.Scopes) == 0 {
+		return ctx.String(400, "at least one scope is required")
+	}
+	for _, scope := range data.Scopes {
+		if !validScope(scope) {
+			return ctx.String(400, "unknown scope "+scope)
+		}
+	}
+
+	// keys can not have more rights than the key used to create them
+	if apiKey, ok := ctx.Get("apiKey").(*APIKey); ok {
+		for _, scope := range data.Scopes {
+			if !apiKey.HasScope(scope) {
+				return ctx.NoContent(403)
+			}
+		}
+		if !strings.HasPrefix(data.Prefix, apiKey.Prefix) {
+			return ctx.NoContent(403)
+		}
+	}
+
+	// generate key
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return ctx.String(500, err.Error())
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	apiKey := APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      strings.TrimSpace(data.Name),
+		Hash:      hashAPIKey(key),
+		OwnerID:   peer.ID,
+		Scopes:    data.Scopes,
+		Prefix:    data.Prefix,
+		ExpiresAt: data.ExpiresAt,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	err = store.InsertAPIKey(&apiKey)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("API key "+apiKey.Name+" created with scopes "+strings.Join(apiKey.Scopes, ", "), slog.String("peer", peer.Name))
+	audit(ctx, "apiKey.create", "apiKey", apiKey.ID.Hex(), apiKey.Name, auditChanges(nil, map[string]interface{}{
+		"scopes": apiKey.Scopes, "prefix": apiKey.Prefix, "expiresAt": apiKey.ExpiresAt,
+	}))
+
+	// the key is only shown once
+	return ctx.JSON(201, map[string]interface{}{"id": apiKey.ID.Hex(), "key": key})
+}
+
+func DeleteAPIKey(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if key exists
+	apiKey, err := store.GetAPIKey(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	// check write rights
+	if !hasPermission(peer, PermAllKeys) && apiKey.OwnerID != peer.ID {
+		return ctx.NoContent(403)
+	}
+
+	err = store.UpdateAPIKey(apiKey.ID, map[string]interface{}{"revokedAt": time.Now().UnixMilli()})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("API key "+apiKey.Name+" revoked", slog.String("peer", peer.Name))
+	audit(ctx, "apiKey.revoke", "apiKey", apiKey.ID.Hex(), apiKey.Name, nil)
+
+	return ctx.NoContent(200)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records a single administrative action, unlike logs it never expires
+type AuditEntry struct {
+	ID         primitive.ObjectID     `json:"ID" bson:"_id"`
+	Time       int64                  `json:"Time" bson:"time"`
+	ActorID    string                 `json:"ActorID" bson:"actorID"`
+	ActorName  string                 `json:"ActorName" bson:"actorName"`
+	APIKeyID   string                 `json:"APIKeyID,omitempty" bson:"apiKeyID,omitempty"` // set when the action was made with an api key
+	SourceIP   string                 `json:"SourceIP" bson:"sourceIP"`
+	Action     string                 `json:"Action" bson:"action"`
+	TargetType string                 `json:"TargetType" bson:"targetType"`
+	TargetID   string                 `json:"TargetID" bson:"targetID"`
+	TargetName string                 `json:"TargetName" bson:"targetName"`
+	Changes    map[string]AuditChange `json:"Changes,omitempty" bson:"changes,omitempty"`
+}
+
+type AuditChange struct {
+	Before interface{} `json:"Before" bson:"before"`
+	After  interface{} `json:"After" bson:"after"`
+}
+
+// AuditFilter selects audit entries, empty fields match everything
+type AuditFilter struct {
+	ActorID  string
+	Action   string
+	TargetID string
+	From     int64 // milliseconds, inclusive
+	To       int64 // milliseconds, exclusive
+	Skip     int64
+	Limit    int64
+}
+
+// audit records an action made by the peer of the request, failures are logged and do not stop the action
+func audit(ctx echo.Context, action string, targetType string, targetID string, targetName string, changes map[string]AuditChange) {
+	entry := AuditEntry{
+		ID:         primitive.NewObjectID(),
+		Time:       time.Now().UnixMilli(),
+		SourceIP:   remoteIP(ctx).String(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		TargetName: targetName,
+		Changes:    changes,
+	}
+	if peer, ok := ctx.Get("peer").(*Peer); ok {
+		entry.ActorID = peer.ID
+		entry.ActorName = peer.Name
+	}
+	if apiKey, ok := ctx.Get("apiKey").(*APIKey); ok {
+		entry.APIKeyID = apiKey.ID.Hex()
+	}
+
+	bus.Publish(Audited{Entry: entry})
+}
+
+// auditChanges pairs every field in set with its value in before
+func auditChanges(before map[string]interface{}, set map[string]interface{}) map[string]AuditChange {
+	changes := make(map[string]AuditChange, len(set))
+	for k, v := range set {
+		changes[k] = AuditChange{Before: before[k], After: v}
+	}
+	return changes
+}
+
+func GetAudit(ctx echo.Context) error {
+	filter := AuditFilter{
+		ActorID:  ctx.QueryParam("actor"),
+		Action:   ctx.QueryParam("action"),
+		TargetID: ctx.QueryParam("target"),
+		Limit:    50,
+	}
+
+	// parse numeric filters
+	var err error
+	if v := ctx.QueryParam("from"); v != "" {
+		if filter.From, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ctx.String(400, "invalid from")
+		}
+	}
+	if v := ctx.QueryParam("to"); v != "" {
+		if filter.To, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ctx.String(400, "invalid to")
+		}
+	}
+	if v := ctx.QueryParam("limit"); v != "" {
+		if filter.Limit, err = strconv.ParseInt(v, 10, 64); err != nil || filter.Limit < 1 || filter.Limit > 500 {
+			return ctx.String(400, "limit must be between 1 and 500")
+		}
+	}
+	if v := ctx.QueryParam("page"); v != "" {
+		page, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || page < 1 {
+			return ctx.String(400, "invalid page")
+		}
+		filter.Skip = (page - 1) * filter.Limit
+	}
+
+	entries, total, err := store.GetAudit(filter)
+	if err != nil {
+		logger.Error(err.Error())
+		return ctx.String(500, err.Error())
+	}
+
+	return ctx.JSON(200, map[string]interface{}{"total": total, "entries": entries})
+}
@@ -0,0 +1,1134 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	peersBucket      = []byte("peers")
+	groupsBucket     = []byte("groups")
+	logsBucket       = []byte("logs")
+	tokensBucket     = []byte("resumeTokens")
+	keysBucket       = []byte("apiKeys")
+	auditBucket      = []byte("audit")
+	usageBucket      = []byte("usage")
+	periodsBucket    = []byte("periods")
+	webhooksBucket   = []byte("webhooks")
+	deliveriesBucket = []byte("webhookDeliveries")
+	profilesBucket   = []byte("profiles")
+
+	// indexes, their values are keys of documents
+	addressesBucket    = []byte("peerAddresses")
+	usageGroupsBucket  = []byte("usageByGroup")
+	usageServersBucket = []byte("usageByServer")
+)
+
+// BoltStorage keeps everything in a single file and is meant for single server deployments
+type BoltStorage struct {
+	db       *bbolt.DB
+	watchers map[*boltWatcher]struct{}
+	closed   chan struct{} // stops removing expired logs
+	mu       sync.Mutex
+}
+
+// boltWatcher queues changes for one WatchPeers call so writers never block on slow readers
+type boltWatcher struct {
+	changes []*PeerChange
+	signal  chan struct{}
+	mu      sync.Mutex
+}
+
+func NewBoltStorage(filePath string) (*BoltStorage, error) {
+	db, err := bbolt.Open(filePath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	// create buckets, indexes are built from existing documents when they are created
+	err = db.Update(func(tx *bbolt.Tx) error {
+		indexAddresses, indexUsage := tx.Bucket(addressesBucket) == nil, tx.Bucket(usageServersBucket) == nil
+		for _, name := range [][]byte{peersBucket, groupsBucket, logsBucket, tokensBucket, keysBucket, auditBucket, usageBucket, periodsBucket, webhooksBucket, deliveriesBucket, profilesBucket,
+			addressesBucket, usageGroupsBucket, usageServersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if indexAddresses {
+			if err := buildAddressIndex(tx); err != nil {
+				return err
+			}
+		}
+		if indexUsage {
+			return rekeyUsage(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStorage{db: db, watchers: make(map[*boltWatcher]struct{}), closed: make(chan struct{})}
+
+	// remove expired logs every minute
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			// the database may be closed while logs are removed
+			if err := s.deleteExpiredLogs(); err != nil && !errors.Is(err, bbolt.ErrDatabaseNotOpen) {
+				logger.Error(err.Error())
+			}
+			select {
+			case <-ticker.C:
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// buildAddressIndex adds addresses of every peer to the address index
+func buildAddressIndex(tx *bbolt.Tx) error {
+	index := tx.Bucket(addressesBucket)
+	return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+		addresses, err := peerAddresses(v)
+		if err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			if err = index.Put([]byte(address), k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rekeyUsage moves usage stored under bucket ids by databases of older versions to keys by peer and indexes them
+func rekeyUsage(tx *bbolt.Tx) error {
+	var buckets []*UsageBucket
+	err := tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+		var bucket UsageBucket
+		if err := bson.Unmarshal(v, &bucket); err != nil {
+			return err
+		}
+		buckets = append(buckets, &bucket)
+		return nil
+	})
+	if err != nil || len(buckets) == 0 {
+		return err
+	}
+	if err = tx.DeleteBucket(usageBucket); err != nil {
+		return err
+	}
+	if _, err = tx.CreateBucket(usageBucket); err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err = putUsage(tx, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify queues a change for every active watcher
+func (s *BoltStorage) notify(change *PeerChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		w.mu.Lock()
+		w.changes = append(w.changes, change)
+		w.mu.Unlock()
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// findDocument returns the first document in bucket for which match returns true
+func findDocument(b *bbolt.Bucket, match func(k []byte, m bson.M) bool) ([]byte, error) {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var m bson.M
+		if err := bson.Unmarshal(v, &m); err != nil {
+			return nil, err
+		}
+		if match(k, m) {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// isDuplicate checks if a document other than the one stored under key already uses value for field
+func isDuplicate(b *bbolt.Bucket, key []byte, field string, value interface{}) (bool, error) {
+	v, err := findDocument(b, func(k []byte, m bson.M) bool { return !bytes.Equal(k, key) && m[field] == value })
+	return v != nil, err
+}
+
+// peerAddresses returns the addresses of the peer stored in v
+func peerAddresses(v []byte) ([]string, error) {
+	var m bson.M
+	if err := bson.Unmarshal(v, &m); err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, field := range []string{"allowedIPs", "allowedIPsV6"} {
+		if address, _ := m[field].(string); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// reindexAddresses replaces addresses of the peer stored under key in the address index, before is the document it replaced
+func reindexAddresses(tx *bbolt.Tx, key []byte, before []byte) error {
+	index := tx.Bucket(addressesBucket)
+	if before != nil {
+		addresses, err := peerAddresses(before)
+		if err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			if err = index.Delete([]byte(address)); err != nil {
+				return err
+			}
+		}
+	}
+	v := tx.Bucket(peersBucket).Get(key)
+	if v == nil {
+		return nil
+	}
+	addresses, err := peerAddresses(v)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if err = index.Put([]byte(address), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBucketOverlap returns ErrOverlappingPrefix if addresses or routes of peer overlap those of other peers in b
+func checkBucketOverlap(b *bbolt.Bucket, peer *Peer) error {
+	var others []*Peer
+	err := b.ForEach(func(k, v []byte) error {
+		var o Peer
+		if err := bson.Unmarshal(v, &o); err != nil {
+			return err
+		}
+		others = append(others, &o)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return checkPeerOverlap(peer, others)
+}
+
+// toInt64 converts numbers decoded from bson to int64
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// applyUpdate changes document stored under key and returns the updated fields in change stream format
+func applyUpdate(b *bbolt.Bucket, key []byte, set map[string]interface{}, inc map[string]int64, ssi *ServerSpecificInfo, unique []string) (map[string]interface{}, error) {
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	var m bson.M
+	if err := bson.Unmarshal(v, &m); err != nil {
+		return nil, err
+	}
+
+	updatedFields := make(map[string]interface{})
+	for k, value := range set {
+		m[k] = value
+		updatedFields[k] = value
+	}
+	for k, value := range inc {
+		m[k] = toInt64(m[k]) + value
+		updatedFields[k] = m[k]
+	}
+	if ssi != nil {
+		ssis, _ := m["serverSpecificInfo"].(primitive.A)
+		i := 0
+		for ; i < len(ssis); i++ {
+			if entry, ok := ssis[i].(primitive.M); ok && entry["address"] == ssi.Address {
+				break
+			}
+		}
+		if i == len(ssis) {
+			ssis = append(ssis, ssi)
+		} else {
+			ssis[i] = ssi
+		}
+		m["serverSpecificInfo"] = ssis
+		updatedFields[fmt.Sprintf("serverSpecificInfo.%d", i)] = ssi
+	}
+
+	// enforce unique fields
+	for _, field := range unique {
+		if _, ok := set[field]; !ok {
+			continue
+		}
+		duplicate, err := isDuplicate(b, key, field, m[field])
+		if err != nil {
+			return nil, err
+		}
+		if duplicate {
+			return nil, ErrDuplicateKey
+		}
+	}
+
+	v, err := bson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Put(key, v); err != nil {
+		return nil, err
+	}
+
+	// round trip updated fields so they have the same types as mongodb change events
+	v, err = bson.Marshal(updatedFields)
+	if err != nil {
+		return nil, err
+	}
+	updatedFields = nil
+	return updatedFields, bson.Unmarshal(v, &updatedFields)
+}
+
+func (s *BoltStorage) GetPeers() ([]*Peer, error) {
+	return findAll(s.db, peersBucket, func(p *Peer) bool { return true })
+}
+
+func (s *BoltStorage) GetPeer(id string) (*Peer, error) {
+	return findOne[Peer](s.db, peersBucket, []byte(id))
+}
+
+func (s *BoltStorage) GetPeerByAddress(address string) (*Peer, error) {
+	var peer Peer
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		key := tx.Bucket(addressesBucket).Get([]byte(address))
+		if key == nil {
+			return ErrNotFound
+		}
+		v := tx.Bucket(peersBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, &peer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+func (s *BoltStorage) InsertPeer(peer *Peer) error {
+	v, err := bson.Marshal(peer)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(peersBucket)
+		if b.Get([]byte(peer.ID)) != nil {
+			return ErrDuplicateKey
+		}
+		unique := map[string]interface{}{"name": peer.Name, "allowedIPs": peer.AllowedIPs}
+		if peer.AllowedIPsV6 != "" {
+			unique["allowedIPsV6"] = peer.AllowedIPsV6
+		}
+		for field, value := range unique {
+			duplicate, err := isDuplicate(b, []byte(peer.ID), field, value)
+			if err != nil {
+				return err
+			}
+			if duplicate {
+				return ErrDuplicateKey
+			}
+		}
+		if err := checkBucketOverlap(b, peer); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(peer.ID), v); err != nil {
+			return err
+		}
+		return reindexAddresses(tx, []byte(peer.ID), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	// watchers get their own copy of the peer
+	var fullDocument Peer
+	if err = bson.Unmarshal(v, &fullDocument); err != nil {
+		return err
+	}
+	s.notify(&PeerChange{OperationType: "insert", ID: peer.ID, FullDocument: &fullDocument})
+	return nil
+}
+
+func (s *BoltStorage) UpdatePeers(updates []PeerUpdate) error {
+	var changes []*PeerChange
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(peersBucket)
+		for _, u := range updates {
+			// values of bolt are only valid until the document is replaced
+			var before []byte
+			if changesAddresses(u.Set) {
+				before = bytes.Clone(b.Get([]byte(u.ID)))
+			}
+			updatedFields, err := applyUpdate(b, []byte(u.ID), u.Set, withVersion(u.Inc), u.SSI, []string{"name", "allowedIPs", "allowedIPsV6"})
+			if err != nil {
+				return err
+			}
+			if before != nil {
+				if err = reindexAddresses(tx, []byte(u.ID), before); err != nil {
+					return err
+				}
+			}
+
+			// check new addresses and routes against other peers, returning an error rolls back the transaction
+			if v := b.Get([]byte(u.ID)); v != nil && changesAddresses(u.Set) {
+				var peer Peer
+				if err = bson.Unmarshal(v, &peer); err != nil {
+					return err
+				}
+				if err = checkBucketOverlap(b, &peer); err != nil {
+					return err
+				}
+			}
+			if len(updatedFields) > 0 {
+				changes = append(changes, &PeerChange{OperationType: "update", ID: u.ID, UpdatedFields: updatedFields})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		s.notify(change)
+	}
+	return nil
+}
+
+func (s *BoltStorage) DeletePeer(id string) error {
+	deleted := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(peersBucket)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		deleted = true
+		before := bytes.Clone(v)
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return reindexAddresses(tx, []byte(id), before)
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		s.notify(&PeerChange{OperationType: "delete", ID: id})
+	}
+	return nil
+}
+
+func (s *BoltStorage) ResetServerSpecificInfo() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(peersBucket)
+		var keys [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if _, err := applyUpdate(b, k, map[string]interface{}{"serverSpecificInfo": []ServerSpecificInfo{}}, withVersion(nil), nil, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findAll returns documents in bucket for which match returns true
+func findAll[T any](db *bbolt.DB, bucket []byte, match func(*T) bool) ([]*T, error) {
+	result := []*T{}
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var doc T
+			if err := bson.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			if match(&doc) {
+				result = append(result, &doc)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+// findOne returns the document stored under key in bucket
+func findOne[T any](db *bbolt.DB, bucket []byte, key []byte) (*T, error) {
+	var doc T
+	err := db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, &doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// insertOne stores doc under key in bucket if no other document uses the same key or values of unique fields
+func insertOne(db *bbolt.DB, bucket []byte, key []byte, doc interface{}, unique map[string]interface{}) error {
+	v, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get(key) != nil {
+			return ErrDuplicateKey
+		}
+		for field, value := range unique {
+			duplicate, err := isDuplicate(b, key, field, value)
+			if err != nil {
+				return err
+			}
+			if duplicate {
+				return ErrDuplicateKey
+			}
+		}
+		return b.Put(key, v)
+	})
+}
+
+// updateOne applies set to the document stored under key in bucket
+func updateOne(db *bbolt.DB, bucket []byte, key []byte, set map[string]interface{}) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		_, err := applyUpdate(tx.Bucket(bucket), key, set, nil, nil, nil)
+		return err
+	})
+}
+
+func (s *BoltStorage) GetGroups() ([]*Group, error) {
+	return findAll(s.db, groupsBucket, func(g *Group) bool { return true })
+}
+
+func (s *BoltStorage) GetGroupsByOwnerID(ownerID string) ([]*Group, error) {
+	return findAll(s.db, groupsBucket, func(g *Group) bool { return g.OwnerID == ownerID })
+}
+
+func (s *BoltStorage) GetGroup(id primitive.ObjectID) (*Group, error) {
+	return findOne[Group](s.db, groupsBucket, id[:])
+}
+
+func (s *BoltStorage) InsertGroup(group *Group) error {
+	return insertOne(s.db, groupsBucket, group.ID[:], group, map[string]interface{}{"name": group.Name})
+}
+
+func (s *BoltStorage) UpdateGroups(updates []GroupUpdate) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(groupsBucket)
+		for _, u := range updates {
+			if _, err := applyUpdate(b, u.ID[:], u.Set, u.Inc, nil, []string{"name"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateGroupPeerIDs replaces the peer ids of a group with the result of fn
+func (s *BoltStorage) updateGroupPeerIDs(groupID primitive.ObjectID, fn func(peerIDs []string) []string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(groupsBucket)
+		v := b.Get(groupID[:])
+		if v == nil {
+			return nil
+		}
+		var group Group
+		if err := bson.Unmarshal(v, &group); err != nil {
+			return err
+		}
+		_, err := applyUpdate(b, groupID[:], map[string]interface{}{"peerIDs": fn(group.PeerIDs)}, nil, nil, nil)
+		return err
+	})
+}
+
+func (s *BoltStorage) AddPeerToGroup(groupID primitive.ObjectID, peerID string) error {
+	return s.updateGroupPeerIDs(groupID, func(peerIDs []string) []string {
+		return append(peerIDs, peerID)
+	})
+}
+
+func (s *BoltStorage) RemovePeerFromGroup(groupID primitive.ObjectID, peerID string) error {
+	return s.updateGroupPeerIDs(groupID, func(peerIDs []string) []string {
+		result := []string{}
+		for _, id := range peerIDs {
+			if id != peerID {
+				result = append(result, id)
+			}
+		}
+		return result
+	})
+}
+
+func (s *BoltStorage) DeleteGroup(id primitive.ObjectID) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(groupsBucket).Delete(id[:])
+	})
+}
+
+func (s *BoltStorage) InsertLog(l *Log) error {
+	v, err := bson.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(logsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// keys are ordered by insertion
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, v)
+	})
+}
+
+func (s *BoltStorage) GetLogs() ([]Log, error) {
+	var logs []Log
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(logsBucket).ForEach(func(k, v []byte) error {
+			var l Log
+			if err := bson.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			logs = append(logs, l)
+			return nil
+		})
+	})
+	return logs, err
+}
+
+func (s *BoltStorage) deleteExpiredLogs() error {
+	now := time.Now()
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(logsBucket)
+		var keys [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var l Log
+			if err := bson.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			if l.ExpireAt.Before(now) {
+				keys = append(keys, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) GetAPIKeys() ([]*APIKey, error) {
+	return findAll(s.db, keysBucket, func(k *APIKey) bool { return true })
+}
+
+func (s *BoltStorage) GetAPIKeysByOwnerID(ownerID string) ([]*APIKey, error) {
+	return findAll(s.db, keysBucket, func(k *APIKey) bool { return k.OwnerID == ownerID })
+}
+
+func (s *BoltStorage) GetAPIKey(id primitive.ObjectID) (*APIKey, error) {
+	return findOne[APIKey](s.db, keysBucket, id[:])
+}
+
+func (s *BoltStorage) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	keys, err := findAll(s.db, keysBucket, func(k *APIKey) bool { return k.Hash == hash })
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	return keys[0], nil
+}
+
+func (s *BoltStorage) InsertAPIKey(key *APIKey) error {
+	return insertOne(s.db, keysBucket, key.ID[:], key, map[string]interface{}{"hash": key.Hash})
+}
+
+func (s *BoltStorage) UpdateAPIKey(id primitive.ObjectID, set map[string]interface{}) error {
+	return updateOne(s.db, keysBucket, id[:], set)
+}
+
+func (s *BoltStorage) InsertAudit(entry *AuditEntry) error {
+	v, err := bson.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// keys are ordered by insertion
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, v)
+	})
+}
+
+func (s *BoltStorage) GetAudit(filter AuditFilter) ([]AuditEntry, int64, error) {
+	entries := []AuditEntry{}
+	var total int64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		// walk backwards to return newest entries first
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var entry AuditEntry
+			if err := bson.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if (filter.ActorID != "" && entry.ActorID != filter.ActorID) ||
+				(filter.Action != "" && entry.Action != filter.Action) ||
+				(filter.TargetID != "" && entry.TargetID != filter.TargetID) ||
+				(filter.From != 0 && entry.Time < filter.From) ||
+				(filter.To != 0 && entry.Time >= filter.To) {
+				continue
+			}
+			if total >= filter.Skip && int64(len(entries)) < filter.Limit {
+				entries = append(entries, entry)
+			}
+			total++
+		}
+		return nil
+	})
+	return entries, total, err
+}
+
+// usageKey returns the key of a usage bucket in an index of target, keys of a target and step are ordered by time.
+// Parts are separated by zero bytes because peer ids can contain slashes.
+func usageKey(target string, step string, t int64, rest ...string) []byte {
+	key := append([]byte(target), 0)
+	key = append(key, step...)
+	key = append(key, 0)
+	key = binary.BigEndian.AppendUint64(key, uint64(t))
+	for _, part := range rest {
+		key = append(key, 0)
+		key = append(key, part...)
+	}
+	return key
+}
+
+// usageKeys returns the keys of bucket in usage by peer, group and server
+func usageKeys(bucket *UsageBucket) (byPeer []byte, byGroup []byte, byServer []byte) {
+	group := bucket.GroupID.Hex()
+	byPeer = usageKey(bucket.PeerID, bucket.Step, bucket.Time, bucket.Server, group)
+	byGroup = usageKey(group, bucket.Step, bucket.Time, bucket.Server, bucket.PeerID)
+	byServer = usageKey(bucket.Server, bucket.Step, bucket.Time, bucket.PeerID, group)
+	return
+}
+
+// seekUsage calls fn with every key and value in b of target with step that starts in [from, to)
+func seekUsage(b *bbolt.Bucket, target string, step string, from int64, to int64, fn func(k, v []byte) error) error {
+	prefix := usageKey(target, step, 0)
+	prefix = prefix[:len(prefix)-8]
+	c := b.Cursor()
+	for k, v := c.Seek(usageKey(target, step, max(from, 0))); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if int64(binary.BigEndian.Uint64(k[len(prefix):])) >= to {
+			break
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putUsage stores bucket by peer and adds it to the indexes by group and server
+func putUsage(tx *bbolt.Tx, bucket *UsageBucket) error {
+	v, err := bson.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	byPeer, byGroup, byServer := usageKeys(bucket)
+	if err = tx.Bucket(usageBucket).Put(byPeer, v); err != nil {
+		return err
+	}
+	if err = tx.Bucket(usageGroupsBucket).Put(byGroup, byPeer); err != nil {
+		return err
+	}
+	return tx.Bucket(usageServersBucket).Put(byServer, byPeer)
+}
+
+// deleteUsage removes bucket and its index entries
+func deleteUsage(tx *bbolt.Tx, bucket *UsageBucket) error {
+	byPeer, byGroup, byServer := usageKeys(bucket)
+	if err := tx.Bucket(usageBucket).Delete(byPeer); err != nil {
+		return err
+	}
+	if err := tx.Bucket(usageGroupsBucket).Delete(byGroup); err != nil {
+		return err
+	}
+	return tx.Bucket(usageServersBucket).Delete(byServer)
+}
+
+// addUsage adds traffic of buckets to buckets with the same ID or stores them if they do not exist
+func addUsage(tx *bbolt.Tx, buckets []*UsageBucket) error {
+	b := tx.Bucket(usageBucket)
+	for _, bucket := range buckets {
+		sum := *bucket
+		byPeer, _, _ := usageKeys(bucket)
+		if v := b.Get(byPeer); v != nil {
+			var existing UsageBucket
+			if err := bson.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			sum.TX += existing.TX
+			sum.RX += existing.RX
+		}
+		if err := putUsage(tx, &sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStorage) AddUsage(buckets []*UsageBucket) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return addUsage(tx, buckets)
+	})
+}
+
+func (s *BoltStorage) GetUsage(filter UsageFilter) ([]*UsageBucket, error) {
+	result := []*UsageBucket{}
+	match := func(bucket *UsageBucket) bool {
+		return bucket.Time >= filter.From && bucket.Time < filter.To &&
+			(filter.PeerID == "" || bucket.PeerID == filter.PeerID) &&
+			(filter.GroupID.IsZero() || bucket.GroupID == filter.GroupID) &&
+			(filter.Server == "" || bucket.Server == filter.Server)
+	}
+	collect := func(v []byte) error {
+		var bucket UsageBucket
+		if err := bson.Unmarshal(v, &bucket); err != nil {
+			return err
+		}
+		if match(&bucket) {
+			result = append(result, &bucket)
+		}
+		return nil
+	}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+
+		// read the index of the most specific target, the usage of everything is only read by admins
+		var index *bbolt.Bucket
+		var target string
+		switch {
+		case filter.PeerID != "":
+			target = filter.PeerID
+		case !filter.GroupID.IsZero():
+			index, target = tx.Bucket(usageGroupsBucket), filter.GroupID.Hex()
+		case filter.Server != "":
+			index, target = tx.Bucket(usageServersBucket), filter.Server
+		default:
+			return b.ForEach(func(k, v []byte) error { return collect(v) })
+		}
+		for step := range usageSteps {
+			var err error
+			if index == nil {
+				err = seekUsage(b, target, step, filter.From, filter.To, func(k, v []byte) error { return collect(v) })
+			} else {
+				err = seekUsage(index, target, step, filter.From, filter.To, func(k, v []byte) error { return collect(b.Get(v)) })
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b *UsageBucket) int { return cmp.Compare(a.Time, b.Time) })
+	return result, nil
+}
+
+// findUsage returns buckets of server with step that start before before
+func findUsage(tx *bbolt.Tx, server string, step string, before int64) ([]*UsageBucket, error) {
+	var result []*UsageBucket
+	b := tx.Bucket(usageBucket)
+	err := seekUsage(tx.Bucket(usageServersBucket), server, step, 0, before, func(k, v []byte) error {
+		var bucket UsageBucket
+		if err := bson.Unmarshal(b.Get(v), &bucket); err != nil {
+			return err
+		}
+		result = append(result, &bucket)
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStorage) RollupUsage(server string, from string, to string, before int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		buckets, err := findUsage(tx, server, from, before)
+		if err != nil {
+			return err
+		}
+		for _, bucket := range buckets {
+			if err = deleteUsage(tx, bucket); err != nil {
+				return err
+			}
+		}
+		// buckets of step to may already hold sums of an earlier rollup that ended inside them
+		return addUsage(tx, rollupBuckets(buckets, to))
+	})
+}
+
+func (s *BoltStorage) DeleteUsage(server string, step string, before int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		buckets, err := findUsage(tx, server, step, before)
+		if err != nil {
+			return err
+		}
+		for _, bucket := range buckets {
+			if err = deleteUsage(tx, bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) ArchivePeriod(archive *PeriodArchive) error {
+	v, err := bson.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(periodsBucket).Put([]byte(archive.ID), v)
+	})
+}
+
+func (s *BoltStorage) GetPeriodArchives(targetID string) ([]*PeriodArchive, error) {
+	result, err := findAll(s.db, periodsBucket, func(a *PeriodArchive) bool { return a.TargetID == targetID })
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b *PeriodArchive) int { return cmp.Compare(b.Start, a.Start) })
+	return result, nil
+}
+
+func (s *BoltStorage) GetWebhooks() ([]*Webhook, error) {
+	return findAll(s.db, webhooksBucket, func(w *Webhook) bool { return true })
+}
+
+func (s *BoltStorage) GetWebhook(id primitive.ObjectID) (*Webhook, error) {
+	return findOne[Webhook](s.db, webhooksBucket, id[:])
+}
+
+func (s *BoltStorage) InsertWebhook(webhook *Webhook) error {
+	return insertOne(s.db, webhooksBucket, webhook.ID[:], webhook, nil)
+}
+
+func (s *BoltStorage) UpdateWebhook(id primitive.ObjectID, set map[string]interface{}) error {
+	return updateOne(s.db, webhooksBucket, id[:], set)
+}
+
+func (s *BoltStorage) DeleteWebhook(id primitive.ObjectID) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(webhooksBucket).Delete(id[:]); err != nil {
+			return err
+		}
+		return deleteDeliveries(tx.Bucket(deliveriesBucket), func(d *WebhookDelivery) bool { return d.WebhookID == id })
+	})
+}
+
+// deleteDeliveries deletes deliveries in b for which match returns true
+func deleteDeliveries(b *bbolt.Bucket, match func(*WebhookDelivery) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var d WebhookDelivery
+		if err := bson.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		if match(&d) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStorage) GetProfiles() ([]*ConfigProfile, error) {
+	result, err := findAll(s.db, profilesBucket, func(p *ConfigProfile) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b *ConfigProfile) int { return cmp.Compare(a.Name, b.Name) })
+	return result, nil
+}
+
+func (s *BoltStorage) GetProfile(id primitive.ObjectID) (*ConfigProfile, error) {
+	return findOne[ConfigProfile](s.db, profilesBucket, id[:])
+}
+
+func (s *BoltStorage) InsertProfile(profile *ConfigProfile) error {
+	return insertOne(s.db, profilesBucket, profile.ID[:], profile, nil)
+}
+
+func (s *BoltStorage) UpdateProfile(id primitive.ObjectID, set map[string]interface{}) error {
+	return updateOne(s.db, profilesBucket, id[:], set)
+}
+
+func (s *BoltStorage) DeleteProfile(id primitive.ObjectID) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(profilesBucket).Delete(id[:])
+	})
+}
+
+func (s *BoltStorage) InsertDelivery(delivery *WebhookDelivery) error {
+	return insertOne(s.db, deliveriesBucket, delivery.ID[:], delivery, nil)
+}
+
+func (s *BoltStorage) UpdateDelivery(id primitive.ObjectID, set map[string]interface{}) error {
+	return updateOne(s.db, deliveriesBucket, id[:], set)
+}
+
+func (s *BoltStorage) GetDelivery(id primitive.ObjectID) (*WebhookDelivery, error) {
+	return findOne[WebhookDelivery](s.db, deliveriesBucket, id[:])
+}
+
+func (s *BoltStorage) GetDeliveries(webhookID primitive.ObjectID) ([]*WebhookDelivery, error) {
+	result, err := findAll(s.db, deliveriesBucket, func(d *WebhookDelivery) bool { return d.WebhookID == webhookID })
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b *WebhookDelivery) int { return cmp.Compare(b.CreatedAt, a.CreatedAt) })
+	return result[:min(len(result), 100)], nil
+}
+
+func (s *BoltStorage) GetPendingDeliveries(server string, before int64) ([]*WebhookDelivery, error) {
+	result, err := findAll(s.db, deliveriesBucket, func(d *WebhookDelivery) bool {
+		return d.Server == server && d.Status == deliveryPending && d.NextAttemptAt <= before
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b *WebhookDelivery) int { return cmp.Compare(a.NextAttemptAt, b.NextAttemptAt) })
+	return result, nil
+}
+
+func (s *BoltStorage) DeleteDeliveries(before int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return deleteDeliveries(tx.Bucket(deliveriesBucket), func(d *WebhookDelivery) bool { return d.CreatedAt < before })
+	})
+}
+
+// WatchPeers only receives changes made by this process while it is watching, resumeToken and startAt are ignored
+// because every change is made locally and peers are loaded from the file on startup
+func (s *BoltStorage) WatchPeers(ctx context.Context, resumeToken []byte, startAt time.Time, fn func(*PeerChange)) error {
+	w := &boltWatcher{signal: make(chan struct{}, 1)}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+
+	var changes []*PeerChange
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.signal:
+			w.mu.Lock()
+			changes, w.changes = w.changes, nil
+			w.mu.Unlock()
+			for _, change := range changes {
+				fn(change)
+			}
+		}
+	}
+}
+
+func (s *BoltStorage) GetResumeToken(server string) ([]byte, error) {
+	var token []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		token = bytes.Clone(tx.Bucket(tokensBucket).Get([]byte(server)))
+		return nil
+	})
+	return token, err
+}
+
+func (s *BoltStorage) SetResumeToken(server string, token []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(server), token)
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	close(s.closed)
+	return s.db.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// openBoltStorage opens a bolt database at path that is closed after the test
+func openBoltStorage(t *testing.T, path string) *BoltStorage {
+	s, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltAddressIndex(t *testing.T) {
+	s := openBoltStorage(t, filepath.Join(t.TempDir(), "wgui.db"))
+
+	// peer ids are public keys and can contain slashes
+	p := &Peer{ID: "a/b+c=", Name: "peer", AllowedIPs: "10.0.0.2/32", AllowedIPsV6: "fd00::2/128"}
+	if err := s.InsertPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"10.0.0.2/32", "fd00::2/128"} {
+		if found, err := s.GetPeerByAddress(address); err != nil || found.ID != p.ID {
+			t.Errorf("GetPeerByAddress(%q) = %v, %v, want %s", address, found, err, p.ID)
+		}
+	}
+
+	// changed and cleared addresses leave the index
+	err := s.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"allowedIPs": "10.0.0.3/32", "allowedIPsV6": ""}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"10.0.0.2/32", "fd00::2/128"} {
+		if _, err = s.GetPeerByAddress(address); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetPeerByAddress(%q) of an old address returned %v, want ErrNotFound", address, err)
+		}
+	}
+	if found, err := s.GetPeerByAddress("10.0.0.3/32"); err != nil || found.ID != p.ID {
+		t.Errorf("GetPeerByAddress of the new address = %v, %v, want %s", found, err, p.ID)
+	}
+
+	if err = s.DeletePeer(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetPeerByAddress("10.0.0.3/32"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPeerByAddress of a deleted peer returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltUsage(t *testing.T) {
+	s := openBoltStorage(t, filepath.Join(t.TempDir(), "wgui.db"))
+
+	group := primitive.NewObjectID()
+	minute := func(peerID string, server string, t int64) *UsageBucket {
+		return &UsageBucket{ID: usageBucketID(usageMinute, server, peerID, group, t), PeerID: peerID, GroupID: group, Server: server, Step: usageMinute, Time: t, TX: 1, RX: 2}
+	}
+	hour := usageSteps[usageHour].Milliseconds()
+	m := usageSteps[usageMinute].Milliseconds()
+	err := s.AddUsage([]*UsageBucket{
+		minute("a/b", "s1", hour), minute("a/b", "s1", hour+m), minute("a/b", "s2", hour),
+		minute("a/bc", "s1", hour), minute("a/b", "s1", 3*hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter UsageFilter
+		want   int
+	}{
+		{"peer", UsageFilter{PeerID: "a/b", From: 0, To: 4 * hour}, 4},
+		{"peer in range", UsageFilter{PeerID: "a/b", From: hour + m, To: 3 * hour}, 1},
+		{"peer of server", UsageFilter{PeerID: "a/b", Server: "s2", From: 0, To: 4 * hour}, 1},
+		{"group", UsageFilter{GroupID: group, From: 0, To: 2 * hour}, 4},
+		{"server", UsageFilter{Server: "s1", From: 0, To: 4 * hour}, 4},
+		{"everything", UsageFilter{From: 0, To: 4 * hour}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, err := s.GetUsage(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buckets) != tt.want {
+				t.Errorf("GetUsage(%+v) returned %d buckets, want %d", tt.filter, len(buckets), tt.want)
+			}
+		})
+	}
+
+	// rolled up minutes of a server are summed into hours and leave every index
+	if err = s.RollupUsage("s1", usageMinute, usageHour, 2*hour); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := s.GetUsage(UsageFilter{Server: "s1", From: 0, To: 4 * hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 || buckets[0].Step != usageHour || buckets[0].Time != hour {
+		t.Fatalf("after rollup got %+v, want 2 hours and a minute", buckets)
+	}
+	if buckets, err = s.GetUsage(UsageFilter{GroupID: group, From: 0, To: 4 * hour}); err != nil || len(buckets) != 4 {
+		t.Errorf("after rollup group has %d buckets, %v, want 4", len(buckets), err)
+	}
+
+	if err = s.DeleteUsage("s1", usageHour, 2*hour); err != nil {
+		t.Fatal(err)
+	}
+	if buckets, err = s.GetUsage(UsageFilter{From: 0, To: 4 * hour}); err != nil || len(buckets) != 2 {
+		t.Errorf("after delete got %d buckets, %v, want 2", len(buckets), err)
+	}
+}
+
+func TestBoltUsageRekeyed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wgui.db")
+
+	// older versions stored usage under bucket ids and had no indexes
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &UsageBucket{PeerID: "peer", Server: "s1", Step: usageMinute, Time: 60000, TX: 1}
+	bucket.ID = usageBucketID(bucket.Step, bucket.Server, bucket.PeerID, bucket.GroupID, bucket.Time)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket(usageBucket)
+		if err != nil {
+			return err
+		}
+		v, err := bson.Marshal(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(bucket.ID), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s := openBoltStorage(t, path)
+	for _, filter := range []UsageFilter{{PeerID: "peer", To: 120000}, {Server: "s1", To: 120000}, {To: 120000}} {
+		buckets, err := s.GetUsage(filter)
+		if err != nil || len(buckets) != 1 || buckets[0].ID != bucket.ID {
+			t.Errorf("GetUsage(%+v) = %+v, %v, want the stored bucket", filter, buckets, err)
+		}
+	}
+}
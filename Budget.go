@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget limits what a reseller and everyone below it can hand out, usage and peer-days are counted over existing peers
+type Budget struct {
+	MaxPeers      int64 `json:"MaxPeers" bson:"maxPeers"`
+	TotalBytes    int64 `json:"TotalBytes" bson:"totalBytes"`
+	TotalPeerDays int64 `json:"TotalPeerDays" bson:"totalPeerDays"`
+}
+
+func (b Budget) Add(o Budget) Budget {
+	return Budget{MaxPeers: b.MaxPeers + o.MaxPeers, TotalBytes: b.TotalBytes + o.TotalBytes, TotalPeerDays: b.TotalPeerDays + o.TotalPeerDays}
+}
+
+func (b Budget) Sub(o Budget) Budget {
+	return Budget{MaxPeers: b.MaxPeers - o.MaxPeers, TotalBytes: b.TotalBytes - o.TotalBytes, TotalPeerDays: b.TotalPeerDays - o.TotalPeerDays}
+}
+
+// Covers checks if b has room for o, parts of o that free up budget always fit
+func (b Budget) Covers(o Budget) bool {
+	return (o.MaxPeers <= 0 || o.MaxPeers <= b.MaxPeers) &&
+		(o.TotalBytes <= 0 || o.TotalBytes <= b.TotalBytes) &&
+		(o.TotalPeerDays <= 0 || o.TotalPeerDays <= b.TotalPeerDays)
+}
+
+var budgetMu sync.Mutex // held while checking a budget and applying the change it allowed
+
+// peerCost returns what a peer with allowedUsage that expires at expiresAt takes from the budget of its owner
+func peerCost(allowedUsage int64, expiresAt int64) Budget {
+	day := (time.Hour * 24).Milliseconds()
+	var days int64
+	if now := time.Now().UnixMilli(); expiresAt > now {
+		days = (expiresAt - now + day - 1) / day
+	}
+	// negative usage stored before it was rejected must not free budget
+	return Budget{MaxPeers: 1, TotalBytes: max(allowedUsage, 0), TotalPeerDays: days}
+}
+
+// peersByOwner groups peers of local map by owner, peers.mu must be held
+func peersByOwner() map[string][]*Peer {
+	result := make(map[string][]*Peer)
+	for _, p := range peers.peers {
+		result[p.OwnerID] = append(result[p.OwnerID], p)
+	}
+	return result
+}
+
+// budgetUsed returns what the peers below id take, sub-resellers with a budget take their whole budget, peers.mu must be held
+func budgetUsed(id string, owned map[string][]*Peer, visited map[string]bool) Budget {
+	var used Budget
+	visited[id] = true
+	for _, p := range owned[id] {
+		if visited[p.ID] {
+			continue
+		}
+		used = used.Add(peerCost(p.AllowedUsage, p.ExpiresAt))
+		if p.Budget != nil {
+			used = used.Add(*p.Budget)
+		} else {
+			used = used.Add(budgetUsed(p.ID, owned, visited))
+		}
+	}
+	return used
+}
+
+// budgetHolder returns the closest reseller at or above id that has a budget, nil means there is no limit, peers.mu must be held
+func budgetHolder(id string) *Peer {
+	visited := make(map[string]bool)
+	for id != "" && !visited[id] {
+		visited[id] = true
+		p, ok := peers.peers[id]
+		if !ok || hasPermission(p, PermUnlimited) {
+			return nil
+		}
+		if p.Budget != nil {
+			return p
+		}
+		id = p.OwnerID
+	}
+	return nil
+}
+
+// checkBudget returns ErrBudgetExceeded if adding deltas, keyed by the owner of the changed peers, exceeds any budget
+func checkBudget(deltas map[string]Budget) error {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	// sum changes that land on the same budget
+	holders := make(map[string]*Peer)
+	sums := make(map[string]Budget)
+	for ownerID, delta := range deltas {
+		if h := budgetHolder(ownerID); h != nil {
+			holders[h.ID] = h
+			sums[h.ID] = sums[h.ID].Add(delta)
+		}
+	}
+
+	owned := peersByOwner()
+	for id, h := range holders {
+		remaining := h.Budget.Sub(budgetUsed(id, owned, make(map[string]bool)))
+		if !remaining.Covers(sums[id]) {
+			return fmt.Errorf("%w, not enough left for %s", ErrBudgetExceeded, h.Name)
+		}
+	}
+	return nil
+}
+
+type BudgetReport struct {
+	PeerID    string  `json:"PeerID"`
+	Name      string  `json:"Name"`
+	OwnerID   string  `json:"OwnerID"`
+	Budget    *Budget `json:"Budget"` // nil means the reseller takes from the budget of its owner
+	Used      Budget  `json:"Used"`
+	Remaining *Budget `json:"Remaining"`
+}
+
+// isBelow checks if p is owned by id directly or through other resellers, peers.mu must be held
+func isBelow(p *Peer, id string) bool {
+	visited := make(map[string]bool)
+	for p != nil && !visited[p.ID] {
+		visited[p.ID] = true
+		if p.OwnerID == id {
+			return true
+		}
+		p = peers.peers[p.OwnerID]
+	}
+	return false
+}
+
+func GetBudgets(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	owned := peersByOwner()
+	reports := []BudgetReport{}
+	for _, p := range peers.peers {
+		if !hasPermission(p, PermCreatePeer) || hasPermission(p, PermUnlimited) || !keyAllowsName(ctx, p.Name) {
+			continue
+		}
+		// resellers can see themselves and everyone below them
+		if !hasPermission(peer, PermAllPeers) && p.ID != peer.ID && !isBelow(p, peer.ID) {
+			continue
+		}
+		report := BudgetReport{PeerID: p.ID, Name: p.Name, OwnerID: p.OwnerID, Budget: p.Budget, Used: budgetUsed(p.ID, owned, make(map[string]bool))}
+		if p.Budget != nil {
+			remaining := p.Budget.Sub(report.Used)
+			report.Remaining = &remaining
+		}
+		reports = append(reports, report)
+	}
+
+	return ctx.JSON(200, reports)
+}
+
+func PutBudget(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	// resellers can give budget to resellers they own but not to themselves
+	if !canAccessPeer(peer, p) || (p.ID == peer.ID && !hasPermission(peer, PermUnlimited)) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+	if !hasPermission(p, PermCreatePeer) || hasPermission(p, PermUnlimited) {
+		return ctx.String(400, "only peers that can create peers and are not unlimited can have a budget")
+	}
+
+	var budget Budget
+	err = json.NewDecoder(ctx.Request().Body).Decode(&budget)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if budget.MaxPeers < 0 || budget.TotalBytes < 0 || budget.TotalPeerDays < 0 {
+		return ctx.String(400, "budget can not be negative")
+	}
+
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+
+	// the new budget must cover what is already handed out and fit in the budget of the owner
+	peers.mu.RLock()
+	used := budgetUsed(p.ID, peersByOwner(), make(map[string]bool))
+	previous := used
+	if p.Budget != nil {
+		previous = *p.Budget
+	}
+	peers.mu.RUnlock()
+	if !budget.Covers(used) {
+		return ctx.String(400, "budget is lower than what is already used")
+	}
+	err = checkBudget(map[string]Budget{p.OwnerID: budget.Sub(previous)})
+	if err != nil {
+		return ctx.String(403, err.Error())
+	}
+
+	return setBudget(ctx, peer, p, &budget)
+}
+
+func DeleteBudget(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, p) || (p.ID == peer.ID && !hasPermission(peer, PermUnlimited)) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+	if p.Budget == nil {
+		return ctx.NoContent(200)
+	}
+
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+
+	// without a budget the reseller takes what it uses from its owner instead
+	peers.mu.RLock()
+	used := budgetUsed(p.ID, peersByOwner(), make(map[string]bool))
+	peers.mu.RUnlock()
+	err = checkBudget(map[string]Budget{p.OwnerID: used.Sub(*p.Budget)})
+	if err != nil {
+		return ctx.String(403, err.Error())
+	}
+
+	return setBudget(ctx, peer, p, nil)
+}
+
+// setBudget saves budget of p to database and local map
+func setBudget(ctx echo.Context, peer *Peer, p *Peer, budget *Budget) error {
+	err := store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"budget": budget}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	audit(ctx, "peer.budget", "peer", p.ID, p.Name, map[string]AuditChange{"budget": {Before: p.Budget, After: budget}})
+
+	peers.mu.Lock()
+	p.Budget = budget
+	peers.mu.Unlock()
+
+	logger.Info("Budget changed by "+peer.Name, slog.String("peer", p.Name))
+
+	return ctx.NoContent(200)
+}
+
+// decodeBudget converts a budget from change streams and updated fields
+func decodeBudget(v interface{}) (*Budget, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var budget Budget
+	if err = bson.Unmarshal(b, &budget); err != nil {
+		return nil, err
+	}
+	return &budget, nil
+}
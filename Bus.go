@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a state change published on the bus, events are copies so subscribers can read them without holding peers.mu
+type Event interface {
+	EventName() string
+}
+
+// PeerCreated is published when a peer is created here or by another server, Remote is set for the latter
+type PeerCreated struct {
+	Peer   Peer
+	Remote bool
+}
+
+// PeerUpdated is published when changes of any server are applied to a peer, Fields are the bson names of changed fields
+type PeerUpdated struct {
+	Peer   Peer
+	Fields []string
+}
+
+// PeerDeleted is published when a peer is deleted here or by another server, Remote is set for the latter
+type PeerDeleted struct {
+	Peer   Peer
+	Remote bool
+}
+
+// PeerDisabled is published by every server that disables a peer on its device
+type PeerDisabled struct {
+	Peer    Peer
+	Expired bool // disabled because it expired rather than because it used its allowed usage
+}
+
+// PeerEnabled is published by every server that enables a peer on its device
+type PeerEnabled struct {
+	Peer Peer
+}
+
+// PeerUsage is the traffic of a peer through this server since the last tick
+type PeerUsage struct {
+	ID      string             `json:"ID"`
+	Name    string             `json:"Name"`
+	OwnerID string             `json:"OwnerID"`
+	GroupID primitive.ObjectID `json:"GroupID"`
+	TX      int64              `json:"TX"`
+	RX      int64              `json:"RX"`
+}
+
+// UsageTick is published by the peers loop every second with peers that had traffic
+type UsageTick struct {
+	Time  time.Time
+	Usage []PeerUsage
+}
+
+// GroupExceeded is published by the groups loop when it disables a group
+type GroupExceeded struct {
+	Group   Group
+	Expired bool // disabled because it expired rather than because it used its allowed usage
+}
+
+// GroupEnabled is published by the groups loop when it enables a group again
+type GroupEnabled struct {
+	Group Group
+}
+
+// Audited is published for every change made through the api
+type Audited struct {
+	Entry AuditEntry
+}
+
+// PeerWarned is published when a peer crosses a usage or expiry warning threshold
+type PeerWarned struct {
+	Notification Notification
+}
+
+func (PeerCreated) EventName() string   { return eventPeerCreated }
+func (PeerUpdated) EventName() string   { return "peer.updated" }
+func (PeerDeleted) EventName() string   { return eventPeerDeleted }
+func (PeerDisabled) EventName() string  { return eventPeerDisabled }
+func (PeerEnabled) EventName() string   { return eventPeerEnabled }
+func (UsageTick) EventName() string     { return "usage.tick" }
+func (GroupExceeded) EventName() string { return "group.exceeded" }
+func (GroupEnabled) EventName() string  { return eventGroupEnabled }
+func (Audited) EventName() string       { return "audit" }
+func (PeerWarned) EventName() string    { return "peer.warned" }
+
+// Bus delivers events to subscribers in the order they were published. Publishing never blocks,
+// events are queued and delivered one at a time on the bus's own goroutine so subscribers must not block for long.
+type Bus struct {
+	subscribers map[int]func(Event)
+	next        int
+	queue       []Event
+	signal      chan struct{}
+	mu          sync.Mutex
+}
+
+var bus = NewBus() // used by handlers and loops to publish state changes
+
+func NewBus() *Bus {
+	b := &Bus{subscribers: make(map[int]func(Event)), signal: make(chan struct{}, 1)}
+	go b.run()
+	return b
+}
+
+// Publish queues e for every subscriber
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	b.queue = append(b.queue, e)
+	b.mu.Unlock()
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+}
+
+// SubscribeAll calls fn with every event published after it returns until unsubscribe is called
+func (b *Bus) SubscribeAll(fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	}
+}
+
+// Subscribe calls fn with every event of type T published on b
+func Subscribe[T Event](b *Bus, fn func(T)) (unsubscribe func()) {
+	return b.SubscribeAll(func(e Event) {
+		if t, ok := e.(T); ok {
+			fn(t)
+		}
+	})
+}
+
+func (b *Bus) run() {
+	for range b.signal {
+		for {
+			b.mu.Lock()
+			if len(b.queue) == 0 {
+				b.mu.Unlock()
+				break
+			}
+			e := b.queue[0]
+			b.queue[0] = nil
+			b.queue = b.queue[1:]
+			subscribers := make([]func(Event), 0, len(b.subscribers))
+			for _, fn := range b.subscribers {
+				subscribers = append(subscribers, fn)
+			}
+			b.mu.Unlock()
+
+			for _, fn := range subscribers {
+				deliverEvent(fn, e)
+			}
+		}
+	}
+}
+
+// deliverEvent calls fn with e, a subscriber that panics does not stop the bus
+func deliverEvent(fn func(Event), e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(fmt.Sprintf("subscriber of %s panicked: %v", e.EventName(), r))
+		}
+	}()
+	fn(e)
+}
+
+// subscribe connects side effects of state changes to the bus
+func subscribe() {
+	// logging
+	Subscribe(bus, func(e PeerCreated) { logger.Info("Peer Created", slog.String("peer", e.Peer.Name)) })
+	Subscribe(bus, func(e PeerDeleted) { logger.Info("Peer removed", slog.String("peer", e.Peer.Name)) })
+	Subscribe(bus, func(e PeerDisabled) { logger.Info("Peer Disabled", slog.String("peer", e.Peer.Name)) })
+	Subscribe(bus, func(e PeerEnabled) { logger.Info("Peer Enabled", slog.String("peer", e.Peer.Name)) })
+	Subscribe(bus, func(e GroupExceeded) { logger.Info("Group Disabled", slog.String("group", e.Group.Name)) })
+	Subscribe(bus, func(e GroupEnabled) { logger.Info("Group Enabled", slog.String("group", e.Group.Name)) })
+
+	// audit trail
+	Subscribe(bus, func(e Audited) {
+		if err := store.InsertAudit(&e.Entry); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Entry.ActorName))
+		}
+	})
+
+	// usage history, writing to database must not hold up the bus so a worker flushes and ticks are skipped while it is busy
+	flushes := make(chan time.Time, 1)
+	go func() {
+		for t := range flushes {
+			flushUsage(t)
+		}
+	}()
+	Subscribe(bus, func(e UsageTick) {
+		for _, u := range e.Usage {
+			recordUsage(u, e.Time)
+		}
+		select {
+		case flushes <- e.Time:
+		default:
+		}
+	})
+
+	// wireguard device, errors are only logged and the reconciler fixes peers, allowed ips and preshared keys later
+	Subscribe(bus, func(e PeerCreated) {
+		if err := addToDevice(&e.Peer); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+		}
+	})
+	Subscribe(bus, func(e PeerUpdated) {
+		for _, field := range e.Fields {
+			var err error
+			switch field {
+			case "allowedIPs", "allowedIPsV6", "routes":
+				err = configureAllowedIPs(&e.Peer)
+			case "preferredEndpoint":
+				err = setDeviceEndpoint(&e.Peer)
+			}
+			if err != nil {
+				logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+			}
+		}
+	})
+	Subscribe(bus, func(e PeerDeleted) {
+		if err := removeFromDevice(e.Peer.PublicKey); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+		}
+	})
+	Subscribe(bus, func(e PeerDisabled) {
+		if err := setDeviceDisabled(&e.Peer, true); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+		}
+	})
+	Subscribe(bus, func(e PeerEnabled) {
+		if err := setDeviceDisabled(&e.Peer, false); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+		}
+	})
+
+	// traffic control on the device
+	Subscribe(bus, func(e PeerCreated) { shapeLocalPeer(e.Peer.ID) })
+	Subscribe(bus, func(e PeerUpdated) {
+		for _, field := range e.Fields {
+			if field == "rateLimit" || field == "allowedIPsV6" || field == "routes" {
+				shapeLocalPeer(e.Peer.ID)
+				return
+			}
+		}
+	})
+	Subscribe(bus, func(e PeerDeleted) {
+		if shaper == nil {
+			return
+		}
+		if err := shaper.Remove(e.Peer.ID); err != nil {
+			logger.Error(err.Error(), slog.String("peer", e.Peer.Name))
+		}
+	})
+
+	// notifications, every server disables peers so only the main server tells about it
+	Subscribe(bus, func(e PeerDisabled) {
+		if !config.IsMainServer {
+			return
+		}
+		message := fmt.Sprintf("%s has used its allowed usage of %s and was disabled", e.Peer.Name, formatBytes(e.Peer.AllowedUsage))
+		if e.Expired {
+			message = fmt.Sprintf("%s has expired and was disabled", e.Peer.Name)
+		}
+		notify(&Notification{Event: eventPeerDisabled, PeerID: e.Peer.ID, PeerName: e.Peer.Name, OwnerID: e.Peer.OwnerID, Message: message, Time: time.Now().UnixMilli()})
+	})
+	Subscribe(bus, func(e PeerEnabled) {
+		if !config.IsMainServer {
+			return
+		}
+		notify(&Notification{Event: eventPeerEnabled, PeerID: e.Peer.ID, PeerName: e.Peer.Name, OwnerID: e.Peer.OwnerID, Message: e.Peer.Name + " was enabled", Time: time.Now().UnixMilli()})
+	})
+	// warnings are only checked on the main server
+	Subscribe(bus, func(e PeerWarned) { notify(&e.Notification) })
+
+	// webhooks, only the server that made the change sends them
+	Subscribe(bus, func(e PeerCreated) {
+		if !e.Remote {
+			publishEvent(&WebhookEvent{Event: eventPeerCreated, Peer: webhookPeer(&e.Peer)})
+		}
+	})
+	Subscribe(bus, func(e PeerDeleted) {
+		if !e.Remote {
+			publishEvent(&WebhookEvent{Event: eventPeerDeleted, Peer: webhookPeer(&e.Peer)})
+		}
+	})
+	Subscribe(bus, func(e GroupExceeded) {
+		if e.Expired {
+			publishEvent(&WebhookEvent{Event: eventGroupExpired, Message: e.Group.Name + " has expired and was disabled", Group: webhookGroup(&e.Group)})
+		} else {
+			publishEvent(&WebhookEvent{Event: eventGroupQuotaExhausted, Message: e.Group.Name + " has used its allowed usage of " + formatBytes(e.Group.AllowedUsage) + " and was disabled", Group: webhookGroup(&e.Group)})
+		}
+	})
+	Subscribe(bus, func(e GroupEnabled) {
+		publishEvent(&WebhookEvent{Event: eventGroupEnabled, Message: e.Group.Name + " was enabled", Group: webhookGroup(&e.Group)})
+	})
+}
+
+// shapeLocalPeer applies the rate of the peer with id in local map, if it still exists
+func shapeLocalPeer(id string) {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+	p, ok := peers.peers[id]
+	if !ok {
+		return
+	}
+	if err := setRate(p); err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+)
+
+// ClientSettings are the settings of a client config that do not come from the peer itself
+type ClientSettings struct {
+	Endpoint            string
+	DNS                 []string
+	MTU                 int
+	PersistentKeepalive int
+	AllowedIPs          []string // traffic the client sends through the tunnel
+	Endpoints           []string // endpoints the client may choose from
+}
+
+// fullTunnelIPs sends all traffic of p through the tunnel
+func fullTunnelIPs(p *Peer) []string {
+	if p.AllowedIPsV6 != "" {
+		return []string{"0.0.0.0/0", "::/0"}
+	}
+	return []string{"0.0.0.0/0"}
+}
+
+// splitTunnelIPs sends only traffic for tunnel addresses and routed sites other than the own ones of p through the tunnel,
+// peers.mu must not be held
+func splitTunnelIPs(p *Peer) []string {
+	prefixes := tunnelPrefixes()
+	for _, r := range allRoutes() {
+		if !slices.Contains(p.Routes, r) && !slices.Contains(prefixes, r) {
+			prefixes = append(prefixes, r)
+		}
+	}
+	return prefixes
+}
+
+// clientSettings returns the default settings of configs of p, every setting comes from the most specific profile of p that has it.
+// Without one site peers use a split tunnel so their own network stays local. peers.mu must not be held.
+func clientSettings(p *Peer) (ClientSettings, error) {
+	profiles, err := peerProfiles(p)
+	if err != nil {
+		return ClientSettings{}, err
+	}
+
+	var s ClientSettings
+	for _, profile := range profiles {
+		if len(s.DNS) == 0 {
+			s.DNS = profile.DNS
+		}
+		if s.MTU == 0 {
+			s.MTU = profile.MTU
+		}
+		if s.PersistentKeepalive == 0 {
+			s.PersistentKeepalive = profile.Keepalive
+		}
+		if len(s.Endpoints) == 0 {
+			s.Endpoints = profile.Endpoints
+		}
+		// allowed ips and tunnel are one setting, a profile with either overrides less specific ones
+		if s.AllowedIPs == nil {
+			if len(profile.AllowedIPs) > 0 {
+				s.AllowedIPs = profile.AllowedIPs
+			} else if profile.Tunnel == "full" {
+				s.AllowedIPs = fullTunnelIPs(p)
+			} else if profile.Tunnel == "split" {
+				s.AllowedIPs = splitTunnelIPs(p)
+			}
+		}
+	}
+
+	// global settings come last
+	if len(s.DNS) == 0 {
+		s.DNS = config.ClientDNS
+		if s.DNS == nil {
+			s.DNS = []string{"1.1.1.1", "8.8.8.8"}
+		}
+	}
+	if s.MTU == 0 {
+		s.MTU = config.ClientMTU
+	}
+	if s.PersistentKeepalive == 0 {
+		s.PersistentKeepalive = config.ClientKeepalive
+	}
+	if len(s.Endpoints) == 0 {
+		s.Endpoints = config.Endpoints
+		if len(s.Endpoints) == 0 {
+			s.Endpoints = []string{fmt.Sprintf("%s:%d", config.PublicAddress, device.ListenPort)}
+		}
+	}
+	s.Endpoint = s.Endpoints[0]
+	if s.AllowedIPs == nil {
+		s.AllowedIPs = fullTunnelIPs(p)
+		if len(p.Routes) > 0 {
+			s.AllowedIPs = splitTunnelIPs(p)
+		}
+	}
+	return s, nil
+}
+
+// renderClientConfig returns the wg-quick config of p with settings s
+func renderClientConfig(p *Peer, s ClientSettings) (string, error) {
+	return renderWGQuick(newClientConfig(p, s))
+}
+
+// parseClientSettings overrides defaults with endpoint, dns, mtu, keepalive, tunnel and allowedIPs query parameters
+func parseClientSettings(ctx echo.Context, p *Peer, s ClientSettings) (ClientSettings, error) {
+	if v := ctx.QueryParam("endpoint"); v != "" {
+		if !slices.Contains(s.Endpoints, v) && !slices.Contains(config.Endpoints, v) {
+			return s, fmt.Errorf("endpoint must be one of %s", strings.Join(s.Endpoints, ", "))
+		}
+		s.Endpoint = v
+	}
+	if v, ok := ctx.QueryParams()["dns"]; ok {
+		dns, err := parseDNS(splitList(v[0]))
+		if err != nil {
+			return s, err
+		}
+		s.DNS = dns
+	}
+	if v := ctx.QueryParam("mtu"); v != "" {
+		mtu, err := strconv.Atoi(v)
+		if err != nil || mtu == 0 || !validMTU(mtu) {
+			return s, fmt.Errorf("mtu must be between 576 and 9000")
+		}
+		s.MTU = mtu
+	}
+	if v := ctx.QueryParam("keepalive"); v != "" {
+		keepalive, err := strconv.Atoi(v)
+		if err != nil || !validKeepalive(keepalive) {
+			return s, fmt.Errorf("keepalive must be between 0 and 65535 seconds")
+		}
+		s.PersistentKeepalive = keepalive
+	}
+	switch ctx.QueryParam("tunnel") {
+	case "":
+	case "full":
+		s.AllowedIPs = fullTunnelIPs(p)
+	case "split":
+		s.AllowedIPs = splitTunnelIPs(p)
+	default:
+		return s, fmt.Errorf("tunnel must be full or split")
+	}
+	if v := ctx.QueryParam("allowedIPs"); v != "" {
+		allowedIPs, err := parseAllowedIPs(splitList(v))
+		if err != nil {
+			return s, err
+		}
+		s.AllowedIPs = allowedIPs
+	}
+	return s, nil
+}
+
+// splitList splits a comma separated query parameter and drops empty entries
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func GetPeerConfig(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	peers.mu.RLock()
+	p, ok := peers.peers[id]
+	var snapshot Peer
+	if ok {
+		snapshot = *p
+	}
+	peers.mu.RUnlock()
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, &snapshot) || !keyAllowsName(ctx, snapshot.Name) {
+		return ctx.NoContent(403)
+	}
+
+	settings, err := clientSettings(&snapshot)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", snapshot.Name))
+		return ctx.String(500, err.Error())
+	}
+	settings, err = parseClientSettings(ctx, &snapshot, settings)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	c := newClientConfig(&snapshot, settings)
+
+	format := ctx.QueryParam("format")
+	if format == "qr" {
+		// apps only scan wg-quick configs
+		conf, err := renderWGQuick(c)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", snapshot.Name))
+			return ctx.String(500, err.Error())
+		}
+		size := 512
+		if v := ctx.QueryParam("size"); v != "" {
+			if size, err = strconv.Atoi(v); err != nil || size < 128 || size > 2048 {
+				return ctx.String(400, "size must be between 128 and 2048 pixels")
+			}
+		}
+		png, err := qrcode.Encode(conf, qrcode.Medium, size)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", snapshot.Name))
+			return ctx.String(500, err.Error())
+		}
+		return ctx.Blob(200, "image/png", png)
+	}
+
+	if format == "" {
+		format = "conf"
+	}
+	f, ok := configFormats[format]
+	if !ok {
+		return ctx.String(400, "format must be conf, wg-quick, mikrotik, openwrt, networkmanager, json or qr")
+	}
+	conf, err := f.render(c)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", snapshot.Name))
+		return ctx.String(500, err.Error())
+	}
+	ctx.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", snapshot.Name+f.extension))
+	return ctx.Blob(200, f.contentType, []byte(conf))
+}
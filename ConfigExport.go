@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"text/template"
+)
+
+// ClientConfig is what a client needs to connect to this server, the json format exports it as is
+type ClientConfig struct {
+	Name      string          `json:"Name"`
+	Interface ClientInterface `json:"Interface"`
+	Peer      ClientPeer      `json:"Peer"`
+}
+
+// ClientInterface is the tunnel interface of the client
+type ClientInterface struct {
+	PrivateKey string   `json:"PrivateKey"`
+	Addresses  []string `json:"Addresses"`
+	DNS        []string `json:"DNS"`
+	MTU        int      `json:"MTU"` // 0 leaves the mtu to the client
+}
+
+// ClientPeer is this server as a peer of the client
+type ClientPeer struct {
+	PublicKey           string   `json:"PublicKey"`
+	Endpoint            string   `json:"Endpoint"`
+	AllowedIPs          []string `json:"AllowedIPs"`
+	PersistentKeepalive int      `json:"PersistentKeepalive"` // seconds between keepalives, 0 means off
+}
+
+// newClientConfig returns the config of p with settings s
+func newClientConfig(p *Peer, s ClientSettings) *ClientConfig {
+	addresses := []string{p.AllowedIPs}
+	if p.AllowedIPsV6 != "" {
+		addresses = append(addresses, p.AllowedIPsV6)
+	}
+	return &ClientConfig{
+		Name: p.Name,
+		Interface: ClientInterface{
+			PrivateKey: p.PrivateKey,
+			Addresses:  addresses,
+			DNS:        append([]string{}, s.DNS...),
+			MTU:        s.MTU,
+		},
+		Peer: ClientPeer{
+			PublicKey:           device.PublicKey.String(),
+			Endpoint:            s.Endpoint,
+			AllowedIPs:          append([]string{}, s.AllowedIPs...),
+			PersistentKeepalive: s.PersistentKeepalive,
+		},
+	}
+}
+
+// configFormat is a format client configs can be exported in
+type configFormat struct {
+	contentType string
+	extension   string // of the downloaded file
+	render      func(c *ClientConfig) (string, error)
+}
+
+// configFormats are the formats of the config export by the name of the format parameter
+var configFormats = map[string]configFormat{
+	"conf":           {"text/plain; charset=utf-8", ".conf", renderWGQuick},
+	"wg-quick":       {"text/plain; charset=utf-8", ".conf", renderWGQuick},
+	"mikrotik":       {"text/plain; charset=utf-8", ".rsc", renderMikroTik},
+	"openwrt":        {"text/plain; charset=utf-8", ".uci", renderOpenWrt},
+	"networkmanager": {"text/plain; charset=utf-8", ".nmconnection", renderNetworkManager},
+	"json":           {"application/json", ".json", renderJSON},
+}
+
+// wgQuickTemplate renders wg-quick configs, keys are written like the peer page always did
+var wgQuickTemplate = template.Must(template.New("wg-quick").Funcs(template.FuncMap{"join": strings.Join}).Parse(`[Interface]
+PrivateKey={{.Interface.PrivateKey}}
+Address={{join .Interface.Addresses ","}}
+{{if .Interface.DNS}}DNS={{join .Interface.DNS ","}}
+{{end}}{{if .Interface.MTU}}MTU={{.Interface.MTU}}
+{{end}}[Peer]
+PublicKey={{.Peer.PublicKey}}
+AllowedIPs={{join .Peer.AllowedIPs ","}}
+Endpoint={{.Peer.Endpoint}}
+{{if .Peer.PersistentKeepalive}}PersistentKeepalive={{.Peer.PersistentKeepalive}}
+{{end}}`))
+
+func renderWGQuick(c *ClientConfig) (string, error) {
+	var sb strings.Builder
+	err := wgQuickTemplate.Execute(&sb, c)
+	return sb.String(), err
+}
+
+func renderJSON(c *ClientConfig) (string, error) {
+	b, err := json.MarshalIndent(c, "", "  ")
+	return string(b) + "\n", err
+}
+
+// clientInterfaceName returns a name for the tunnel interface of routers made of characters every format allows,
+// short enough for linux interface names
+func clientInterfaceName(name string) string {
+	var sb strings.Builder
+	sb.WriteString("wg_")
+	for _, r := range strings.ToLower(name) {
+		if sb.Len() == 15 {
+			break
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// splitByFamily splits addresses or prefixes into ipv4 and ipv6 ones
+func splitByFamily(list []string) ([]string, []string) {
+	var v4, v6 []string
+	for _, s := range list {
+		if strings.Contains(s, ":") {
+			v6 = append(v6, s)
+		} else {
+			v4 = append(v4, s)
+		}
+	}
+	return v4, v6
+}
+
+// routerOSQuote quotes s as a string of routeros scripts
+func routerOSQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(s) + `"`
+}
+
+// renderMikroTik renders a routeros 7 script that adds the interface, its addresses and routes for allowed ips.
+// Default routes are left to the admin because the endpoint has to stay reachable outside the tunnel.
+func renderMikroTik(c *ClientConfig) (string, error) {
+	host, port, err := net.SplitHostPort(c.Peer.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	name := clientInterfaceName(c.Name)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "/interface wireguard add name=%s private-key=%s comment=%s", name, routerOSQuote(c.Interface.PrivateKey), routerOSQuote(c.Name))
+	if c.Interface.MTU > 0 {
+		fmt.Fprintf(&sb, " mtu=%d", c.Interface.MTU)
+	}
+	fmt.Fprintf(&sb, "\n/interface wireguard peers add interface=%s public-key=%s endpoint-address=%s endpoint-port=%s allowed-address=%s",
+		name, routerOSQuote(c.Peer.PublicKey), host, port, strings.Join(c.Peer.AllowedIPs, ","))
+	if c.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&sb, " persistent-keepalive=%ds", c.Peer.PersistentKeepalive)
+	}
+	sb.WriteString("\n")
+
+	v4, v6 := splitByFamily(c.Interface.Addresses)
+	for _, address := range v4 {
+		fmt.Fprintf(&sb, "/ip address add address=%s interface=%s\n", address, name)
+	}
+	for _, address := range v6 {
+		fmt.Fprintf(&sb, "/ipv6 address add address=%s interface=%s advertise=no\n", address, name)
+	}
+
+	for _, s := range c.Peer.AllowedIPs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return "", err
+		}
+		if prefix.Bits() == 0 {
+			fmt.Fprintf(&sb, "# route %s through %s once %s is reachable outside the tunnel\n", prefix, name, host)
+		} else if prefix.Addr().Is4() {
+			fmt.Fprintf(&sb, "/ip route add dst-address=%s gateway=%s\n", prefix, name)
+		} else {
+			fmt.Fprintf(&sb, "/ipv6 route add dst-address=%s gateway=%s\n", prefix, name)
+		}
+	}
+
+	if len(c.Interface.DNS) > 0 {
+		fmt.Fprintf(&sb, "/ip dns set servers=%s\n", strings.Join(c.Interface.DNS, ","))
+	}
+	return sb.String(), nil
+}
+
+// uciQuote quotes s as a value of uci config files
+func uciQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// renderOpenWrt renders the interface and peer sections of /etc/config/network
+func renderOpenWrt(c *ClientConfig) (string, error) {
+	host, port, err := net.SplitHostPort(c.Peer.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	name := clientInterfaceName(c.Name)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "config interface %s\n", uciQuote(name))
+	sb.WriteString("\toption proto 'wireguard'\n")
+	fmt.Fprintf(&sb, "\toption private_key %s\n", uciQuote(c.Interface.PrivateKey))
+	for _, address := range c.Interface.Addresses {
+		fmt.Fprintf(&sb, "\tlist addresses %s\n", uciQuote(address))
+	}
+	for _, dns := range c.Interface.DNS {
+		fmt.Fprintf(&sb, "\tlist dns %s\n", uciQuote(dns))
+	}
+	if c.Interface.MTU > 0 {
+		fmt.Fprintf(&sb, "\toption mtu '%d'\n", c.Interface.MTU)
+	}
+
+	fmt.Fprintf(&sb, "\nconfig wireguard_%s\n", name)
+	fmt.Fprintf(&sb, "\toption description %s\n", uciQuote(c.Name))
+	fmt.Fprintf(&sb, "\toption public_key %s\n", uciQuote(c.Peer.PublicKey))
+	fmt.Fprintf(&sb, "\toption endpoint_host %s\n", uciQuote(host))
+	fmt.Fprintf(&sb, "\toption endpoint_port %s\n", uciQuote(port))
+	if c.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&sb, "\toption persistent_keepalive '%d'\n", c.Peer.PersistentKeepalive)
+	}
+	sb.WriteString("\toption route_allowed_ips '1'\n")
+	for _, allowedIP := range c.Peer.AllowedIPs {
+		fmt.Fprintf(&sb, "\tlist allowed_ips %s\n", uciQuote(allowedIP))
+	}
+	return sb.String(), nil
+}
+
+// renderNetworkManager renders a keyfile for /etc/NetworkManager/system-connections, it must only be readable by root
+func renderNetworkManager(c *ClientConfig) (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[connection]\nid=%s\ntype=wireguard\ninterface-name=%s\n", c.Name, clientInterfaceName(c.Name))
+
+	fmt.Fprintf(&sb, "\n[wireguard]\nprivate-key=%s\n", c.Interface.PrivateKey)
+	if c.Interface.MTU > 0 {
+		fmt.Fprintf(&sb, "mtu=%d\n", c.Interface.MTU)
+	}
+
+	fmt.Fprintf(&sb, "\n[wireguard-peer.%s]\nendpoint=%s\n", c.Peer.PublicKey, c.Peer.Endpoint)
+	if c.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&sb, "persistent-keepalive=%d\n", c.Peer.PersistentKeepalive)
+	}
+	fmt.Fprintf(&sb, "allowed-ips=%s;\n", strings.Join(c.Peer.AllowedIPs, ";"))
+
+	// addresses and dns servers are set per address family
+	addressesV4, addressesV6 := splitByFamily(c.Interface.Addresses)
+	dnsV4, dnsV6 := splitByFamily(c.Interface.DNS)
+	for _, family := range []struct {
+		section   string
+		addresses []string
+		dns       []string
+	}{{"ipv4", addressesV4, dnsV4}, {"ipv6", addressesV6, dnsV6}} {
+		fmt.Fprintf(&sb, "\n[%s]\n", family.section)
+		if len(family.addresses) == 0 {
+			sb.WriteString("method=disabled\n")
+			continue
+		}
+		for i, address := range family.addresses {
+			fmt.Fprintf(&sb, "address%d=%s\n", i+1, address)
+		}
+		if len(family.dns) > 0 {
+			fmt.Fprintf(&sb, "dns=%s;\n", strings.Join(family.dns, ";"))
+		}
+		sb.WriteString("method=manual\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+)
+
+var interfaceIndex int // index of the wireguard interface when counters were last read, it changes when the interface is recreated
+
+// counterDelta returns how much a kernel byte counter grew since baseline.
+// A counter below its baseline was reset by an interface recreation or a peer re-add and has counted from zero since then.
+func counterDelta(counter int64, baseline int64) int64 {
+	if counter < baseline {
+		return counter
+	}
+	return counter - baseline
+}
+
+// currentInterfaceIndex returns the index of the wireguard interface, zero if it does not exist
+var currentInterfaceIndex = func() int {
+	i, err := net.InterfaceByName(config.InterfaceName)
+	if err != nil {
+		return 0
+	}
+	return i.Index
+}
+
+// restoreCounterBaselines continues counting from the counters saved by this server before a restart,
+// saved counters of a recreated interface are ignored because its counters started from zero
+func restoreCounterBaselines() {
+	interfaceIndex = currentInterfaceIndex()
+	for _, p := range peers.peers {
+		ssi := p.FindSSIByAddress(config.PublicAddress)
+		if ssi == nil || ssi.InterfaceIndex != interfaceIndex {
+			continue
+		}
+		peers.mu.Lock()
+		p.TempTX = ssi.BaselineTX
+		p.TempRX = ssi.BaselineRX
+		peers.mu.Unlock()
+	}
+}
+
+// checkInterfaceReset forgets counter baselines of every peer if the interface was recreated since the last check
+func checkInterfaceReset() {
+	index := currentInterfaceIndex()
+	if index == interfaceIndex {
+		return
+	}
+	interfaceIndex = index
+	peers.mu.Lock()
+	for _, p := range peers.peers {
+		p.TempTX = 0
+		p.TempRX = 0
+	}
+	peers.mu.Unlock()
+	logger.Warn("Interface was recreated, counting usage from zero")
+}
+
+// resetCounterBaseline forgets the counter baseline of a peer that was added to device again
+func resetCounterBaseline(publicKey string) {
+	peers.mu.Lock()
+	if p, ok := peers.peers[publicKey]; ok {
+		p.TempTX = 0
+		p.TempRX = 0
+	}
+	peers.mu.Unlock()
+}
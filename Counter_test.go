@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// stubInterfaceIndex makes currentInterfaceIndex return the value index points to for the rest of the test
+func stubInterfaceIndex(t *testing.T, index *int) {
+	original := currentInterfaceIndex
+	currentInterfaceIndex = func() int { return *index }
+	t.Cleanup(func() { currentInterfaceIndex = original })
+}
+
+// setPeers replaces the local map with ps for the rest of the test
+func setPeers(t *testing.T, ps ...*Peer) {
+	original := peers.peers
+	peers.peers = make(map[string]*Peer)
+	for _, p := range ps {
+		peers.peers[p.ID] = p
+	}
+	t.Cleanup(func() { peers.peers = original })
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		counter  int64
+		baseline int64
+		want     int64
+	}{
+		{"no baseline", 100, 0, 100},
+		{"grown", 150, 100, 50},
+		{"unchanged", 100, 100, 0},
+		{"reset", 30, 100, 30},
+		{"reset to zero", 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterDelta(tt.counter, tt.baseline); got != tt.want {
+				t.Errorf("counterDelta(%d, %d) = %d, want %d", tt.counter, tt.baseline, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreCounterBaselines(t *testing.T) {
+	config.PublicAddress = "192.0.2.1"
+	t.Cleanup(func() { config.PublicAddress = "" })
+
+	tests := []struct {
+		name   string
+		ssi    []*ServerSpecificInfo
+		wantTX int64
+		wantRX int64
+	}{
+		{"same interface", []*ServerSpecificInfo{{Address: "192.0.2.1", BaselineTX: 10, BaselineRX: 20, InterfaceIndex: 7}}, 10, 20},
+		{"recreated interface", []*ServerSpecificInfo{{Address: "192.0.2.1", BaselineTX: 10, BaselineRX: 20, InterfaceIndex: 6}}, 0, 0},
+		{"other server", []*ServerSpecificInfo{{Address: "192.0.2.2", BaselineTX: 10, BaselineRX: 20, InterfaceIndex: 7}}, 0, 0},
+		{"never seen", nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := 7
+			stubInterfaceIndex(t, &index)
+			p := &Peer{ID: "peer", ServerSpecificInfo: tt.ssi}
+			setPeers(t, p)
+
+			restoreCounterBaselines()
+
+			if p.TempTX != tt.wantTX || p.TempRX != tt.wantRX {
+				t.Errorf("baselines = %d/%d, want %d/%d", p.TempTX, p.TempRX, tt.wantTX, tt.wantRX)
+			}
+			if interfaceIndex != 7 {
+				t.Errorf("interfaceIndex = %d, want 7", interfaceIndex)
+			}
+		})
+	}
+}
+
+func TestCheckInterfaceReset(t *testing.T) {
+	original := logger
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	t.Cleanup(func() { logger = original })
+
+	tests := []struct {
+		name      string
+		lastIndex int
+		index     int
+		wantTX    int64
+		wantRX    int64
+	}{
+		{"same interface", 7, 7, 10, 20},
+		{"recreated interface", 7, 8, 0, 0},
+		{"removed interface", 7, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interfaceIndex = tt.lastIndex
+			stubInterfaceIndex(t, &tt.index)
+			p := &Peer{ID: "peer", TempTX: 10, TempRX: 20}
+			setPeers(t, p)
+
+			checkInterfaceReset()
+
+			if p.TempTX != tt.wantTX || p.TempRX != tt.wantRX {
+				t.Errorf("baselines = %d/%d, want %d/%d", p.TempTX, p.TempRX, tt.wantTX, tt.wantRX)
+			}
+			if interfaceIndex != tt.index {
+				t.Errorf("interfaceIndex = %d, want %d", interfaceIndex, tt.index)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// addToDevice adds p to device, disabled peers get a random preshared key so they can not connect
+func addToDevice(p *Peer) error {
+	pk, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	allowedIPs, err := p.AllowedIPNets()
+	if err != nil {
+		return err
+	}
+	peerConfig := wgtypes.PeerConfig{PublicKey: pk, ReplaceAllowedIPs: true, AllowedIPs: allowedIPs}
+	if p.PreferredEndpoint != "" {
+		if peerConfig.Endpoint, err = net.ResolveUDPAddr("udp", p.PreferredEndpoint); err != nil {
+			return err
+		}
+	}
+	if p.Disabled {
+		presharedKey, err := wgtypes.GenerateKey()
+		if err != nil {
+			return err
+		}
+		peerConfig.PresharedKey = &presharedKey
+	}
+	return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{peerConfig}})
+}
+
+// removeFromDevice removes the peer with publicKey from device
+func removeFromDevice(publicKey string) error {
+	pk, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return err
+	}
+	return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, Remove: true}}})
+}
+
+// setDeviceEndpoint sets the endpoint of p on device to its preferred endpoint, an empty one is left to the handshakes
+func setDeviceEndpoint(p *Peer) error {
+	pk, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	var endpoint *net.UDPAddr
+	if p.PreferredEndpoint != "" {
+		if endpoint, err = net.ResolveUDPAddr("udp", p.PreferredEndpoint); err != nil {
+			return err
+		}
+	}
+	return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, UpdateOnly: true, Endpoint: endpoint}}})
+}
+
+// setDeviceDisabled invalidates p on device with a random preshared key or removes the key to enable it again
+func setDeviceDisabled(p *Peer, disabled bool) error {
+	pk, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	presharedKey := wgtypes.Key{}
+	if disabled {
+		if presharedKey, err = wgtypes.GenerateKey(); err != nil {
+			return err
+		}
+	}
+	return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, UpdateOnly: true, PresharedKey: &presharedKey}}})
+}
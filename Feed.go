@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// feedEvent is an event as sent to live feeds
+type feedEvent struct {
+	name string
+	data interface{}
+}
+
+// feedData returns what viewer may see of e, allows checks names against the api key of the request
+func feedData(viewer *Peer, allows func(name string) bool, canAudit bool, e Event) (interface{}, bool) {
+	canSee := func(p *Peer) bool { return canAccessPeer(viewer, p) && allows(p.Name) }
+	canSeeGroup := func(g *Group) bool { return canAccessGroup(viewer, g) && allows(g.Name) }
+
+	switch e := e.(type) {
+	case PeerCreated:
+		return map[string]interface{}{"Peer": webhookPeer(&e.Peer)}, canSee(&e.Peer)
+	case PeerUpdated:
+		return map[string]interface{}{"Peer": webhookPeer(&e.Peer), "Fields": e.Fields}, canSee(&e.Peer)
+	case PeerDeleted:
+		return map[string]interface{}{"Peer": webhookPeer(&e.Peer)}, canSee(&e.Peer)
+	case PeerDisabled:
+		return map[string]interface{}{"Peer": webhookPeer(&e.Peer), "Expired": e.Expired}, canSee(&e.Peer)
+	case PeerEnabled:
+		return map[string]interface{}{"Peer": webhookPeer(&e.Peer)}, canSee(&e.Peer)
+	case UsageTick:
+		var usage []PeerUsage
+		for _, u := range e.Usage {
+			if canSee(&Peer{ID: u.ID, Name: u.Name, OwnerID: u.OwnerID}) {
+				usage = append(usage, u)
+			}
+		}
+		return map[string]interface{}{"Time": e.Time.UnixMilli(), "Server": config.PublicAddress, "Usage": usage}, len(usage) > 0
+	case GroupExceeded:
+		return map[string]interface{}{"Group": webhookGroup(&e.Group), "Expired": e.Expired}, canSeeGroup(&e.Group)
+	case GroupEnabled:
+		return map[string]interface{}{"Group": webhookGroup(&e.Group)}, canSeeGroup(&e.Group)
+	case Audited:
+		return e.Entry, canAudit
+	}
+	return nil, false
+}
+
+// GetEvents streams events the peer of the request can see as server-sent events until the client disconnects
+func GetEvents(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decide what the request can see before the handler's context is shared with the bus
+	prefix := ""
+	canAudit := hasPermission(peer, PermViewAudit)
+	if apiKey, ok := ctx.Get("apiKey").(*APIKey); ok {
+		prefix = apiKey.Prefix
+		canAudit = canAudit && apiKey.HasScope("audit:read")
+	}
+	allows := func(name string) bool { return strings.HasPrefix(name, prefix) }
+
+	// slow clients miss events instead of holding up the bus
+	events := make(chan feedEvent, 256)
+	unsubscribe := bus.SubscribeAll(func(e Event) {
+		data, ok := feedData(peer, allows, canAudit, e)
+		if !ok {
+			return
+		}
+		select {
+		case events <- feedEvent{name: e.EventName(), data: data}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	res := ctx.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.WriteHeader(200)
+	res.Flush()
+
+	// comments keep proxies from closing idle streams
+	ping := time.NewTicker(time.Second * 30)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case ev := <-events:
+			data, err := json.Marshal(ev.data)
+			if err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			if _, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.name, data); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ping.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -11,5 +11,9 @@ type Group struct {
 	TotalRX      int64              `json:"TotalRX" bson:"totalRX"`
 	ExpiresAt    int64              `json:"ExpiresAt" bson:"expiresAt"`
 	Disabled     bool               `json:"Disabled" bson:"disabled"`
+	OverQuota    string             `json:"OverQuota" bson:"overQuota"` // over quota policy of peers in the group
+	RateLimit    Rate               `json:"RateLimit" bson:"rateLimit"` // rate limit of every peer in the group
 	OwnerID      string             `json:"OwnerID" bson:"ownerID"`
+	Period       *QuotaPeriod       `json:"Period" bson:"period"`       // renews allowed usage of the group and its peers every period
+	ProfileID    primitive.ObjectID `json:"ProfileID" bson:"profileID"` // config profile of peers in the group, zero means none
 }
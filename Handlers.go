@@ -1,38 +1,35 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"net/url"
 	"slices"
 	"strings"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/protobuf/proto"
 )
 
 func GetPeers(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.Background(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	pbPeers := make([]*PBPeer, 0, len(peers.peers))
 
-	if peer.Role == "admin" {
+	if hasPermission(peer, PermAllPeers) {
 		// return all peers
 		peers.mu.RLock()
 		defer peers.mu.RUnlock()
 		for _, p := range peers.peers {
+			if !keyAllowsName(ctx, p.Name) {
+				continue
+			}
 			pbPeers = append(pbPeers, &PBPeer{
 				ID:           p.ID,
 				Name:         p.Name,
@@ -45,12 +42,11 @@ func GetPeers(ctx echo.Context) error {
 			})
 		}
 	} else {
-		// return only neighbours if user is not admin
-		neighboursPrefix := strings.Split(peer.Name, "-")[0]
+		// return only owned peers
 		peers.mu.RLock()
 		defer peers.mu.RUnlock()
 		for _, p := range peers.peers {
-			if strings.HasPrefix(p.Name, neighboursPrefix+"-") {
+			if canAccessPeer(peer, p) && keyAllowsName(ctx, p.Name) {
 				pbPeers = append(pbPeers, &PBPeer{
 					ID:                 p.ID,
 					Name:               p.Name,
@@ -74,45 +70,27 @@ func GetPeers(ctx echo.Context) error {
 }
 
 func GetGroups(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-	groups := []*Group{}
-	if peer.Role == "admin" {
-		cursor, err := groupsCollection.Find(context.TODO(), bson.M{})
+	peer := ctx.Get("peer").(*Peer)
+	var groups []*Group
+	var err error
+	if hasPermission(peer, PermAllGroups) {
+		groups, err = store.GetGroups()
 		if err != nil {
 			return ctx.String(500, err.Error())
 		}
-		if err = cursor.All(context.TODO(), &groups); err != nil {
-			return ctx.String(500, err.Error())
-		}
 	} else {
-		cursor, err := groupsCollection.Find(context.TODO(), bson.M{"ownerID": peer.ID})
+		groups, err = store.GetGroupsByOwnerID(peer.ID)
 		if err != nil {
 			return ctx.String(500, err.Error())
 		}
-		if err = cursor.All(context.TODO(), &groups); err != nil {
-			return ctx.String(500, err.Error())
-		}
 	}
+	groups = slices.DeleteFunc(groups, func(g *Group) bool { return !keyAllowsName(ctx, g.Name) })
 
 	return ctx.JSON(200, groups)
 }
 
 func GetPeer(ctx echo.Context) error {
-	var peer Peer = Peer{}
-	bypass := ctx.Get("bypass").(bool)
-
-	if !bypass {
-		err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-		if err != nil {
-			return ctx.String(500, err.Error())
-		}
-	}
-
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
+	peer := ctx.Get("peer").(*Peer)
 
 	// decode uri
 	id, err := url.QueryUnescape(ctx.Param("id"))
@@ -126,13 +104,9 @@ func GetPeer(ctx echo.Context) error {
 		return ctx.NoContent(404)
 	}
 
-	if !bypass {
-		// check if the requested peer is a neighbour of the user
-		if peer.Role != "admin" {
-			if !strings.HasPrefix(p.Name, neighboursPrefix+"-") {
-				return ctx.NoContent(403)
-			}
-		}
+	// check if the requested peer is owned by the user
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
 	}
 
 	// return peer
@@ -140,11 +114,7 @@ func GetPeer(ctx echo.Context) error {
 }
 
 func GetGroup(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse id
 	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
@@ -153,17 +123,14 @@ func GetGroup(ctx echo.Context) error {
 	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&group)
+	group, err := store.GetGroup(objectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
 	// check read rights
-	if peer.Role != "admin" {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
 	}
 
 	// return peer
@@ -171,22 +138,7 @@ func GetGroup(ctx echo.Context) error {
 }
 
 func PostPeers(ctx echo.Context) error {
-	var peer Peer = Peer{}
-	bypass := ctx.Get("bypass").(bool)
-
-	if !bypass {
-		err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-		if err != nil {
-			return ctx.String(500, err.Error())
-		}
-	}
-
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
-	if !bypass {
-		if peer.Role == "user" {
-			return ctx.NoContent(403)
-		}
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// get peer info from request body
 	var data Peer
@@ -205,13 +157,43 @@ func PostPeers(ctx echo.Context) error {
 	}
 	peers.mu.RUnlock()
 
-	if !bypass {
-		// check if the requested peer is a neighbour of the user
-		if peer.Role == "distributor" {
-			if !strings.HasPrefix(data.Name, neighboursPrefix+"-") {
-				return ctx.NoContent(403)
-			}
-		}
+	if !keyAllowsName(ctx, data.Name) {
+		return ctx.NoContent(403)
+	}
+
+	// new peers belong to the user creating them
+	data.OwnerID = peer.ID
+
+	// periods are set with PUT /api/peers/:id/period
+	data.Period = nil
+
+	if !validOverQuota(data.OverQuota) {
+		return ctx.String(400, "overQuota must be disable or throttle")
+	}
+	if data.AllowedUsage < 0 {
+		return ctx.String(400, "allowed usage can not be negative")
+	}
+	if data.RateLimit.Down < 0 || data.RateLimit.Up < 0 {
+		return ctx.String(400, "rate limit can not be negative")
+	}
+	if !data.RateLimit.IsZero() && !hasPermission(peer, PermChangeRate) {
+		return ctx.NoContent(403)
+	}
+
+	// users can only create peers with roles that are not more powerful than their own
+	if data.Role == "" {
+		data.Role = defaultRole
+	}
+	if !canGrantRole(peer, data.Role) {
+		return ctx.String(403, "can not grant role "+data.Role)
+	}
+
+	// check budget of the user creating the peer
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(map[string]Budget{peer.ID: peerCost(data.AllowedUsage, data.ExpiresAt)})
+	if err != nil {
+		return ctx.String(403, err.Error())
 	}
 
 	// create private and public keys
@@ -227,51 +209,61 @@ func PostPeers(ctx echo.Context) error {
 	// set id
 	data.ID = publicKey.String()
 
-	// find unused ip
-	var ip IPAddress
-	err = ip.Parse(config.InterfaceAddress)
-	if err != nil {
-		logger.Error(err.Error(), slog.String("peer", data.Name))
-		return ctx.String(500, err.Error())
-	}
-	ip.Increment()
-
 	peers.mu.Lock()
 	defer peers.mu.Unlock()
 
-findIP:
-	// update device
-	device, err = wgc.Device(config.InterfaceName)
+	// addresses that are already given to peers
+	used, err := usedAddresses()
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", data.Name))
 		return ctx.String(500, err.Error())
 	}
 
-	for slices.ContainsFunc(device.Peers, func(p wgtypes.Peer) bool {
-		for _, aip := range p.AllowedIPs {
-			if aip.String() == ip.ToString()+"/32" {
-				return true
-			}
-		}
-		return false
-	}) {
-		ip.Increment()
+	// users with the permission can choose addresses instead of getting them from the pools
+	if (data.AllowedIPs != "" || data.AllowedIPsV6 != "") && !hasPermission(peer, PermStaticAddress) {
+		return ctx.String(403, "can not choose address")
 	}
-
-	_, allowedIPs, err := net.ParseCIDR(ip.ToString() + "/32")
+	static, err := ipam.ParseStatic(data.AllowedIPs, false, used)
 	if err != nil {
-		logger.Error(err.Error(), slog.String("peer", data.Name))
-		return ctx.String(500, err.Error())
+		return ctx.String(400, err.Error())
+	}
+	staticV6, err := ipam.ParseStatic(data.AllowedIPsV6, true, used)
+	if err != nil {
+		return ctx.String(400, err.Error())
 	}
-	data.AllowedIPs = ip.ToString() + "/32"
 
-	var udpAddress *net.UDPAddr = nil
+	var addr, addrV6 netip.Addr
+	attempts := 0
+findIP:
+	addr = static
+	if !addr.IsValid() {
+		addr, err = ipam.Allocate(used, false)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", data.Name))
+			return ctx.String(409, err.Error())
+		}
+	}
+	data.AllowedIPs = addrPrefix(addr)
 
-	if len(data.Endpoint) > 0 {
-		udpAddress, err = net.ResolveUDPAddr("udp4", data.Endpoint)
+	// peers get an ipv6 address too when an ipv6 pool is configured
+	addrV6 = staticV6
+	if !addrV6.IsValid() && ipam.HasV6() {
+		addrV6, err = ipam.Allocate(used, true)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", data.Name))
+			return ctx.String(409, err.Error())
+		}
+	}
+	if addrV6.IsValid() {
+		data.AllowedIPsV6 = addrPrefix(addrV6)
+	}
+
+	if len(data.PreferredEndpoint) > 0 {
+		udpAddress, err := net.ResolveUDPAddr("udp", data.PreferredEndpoint)
 		if err != nil {
 			return ctx.String(400, err.Error())
 		}
+		data.PreferredEndpoint = udpAddress.String()
 	}
 
 	data.ServerSpecificInfo = []*ServerSpecificInfo{{Address: config.PublicAddress}}
@@ -280,17 +272,21 @@ findIP:
 	peers.peers[data.PublicKey] = &data
 
 	// add peer to database
-	_, err = peersCollection.InsertOne(context.TODO(), data)
+	err = store.InsertPeer(&data)
 	if err != nil {
 		// Check if the error is a duplicate key error
-		if writeException, ok := err.(mongo.WriteException); ok {
-			for _, writeError := range writeException.WriteErrors {
-				if writeError.Code == 11000 {
-					logger.Error("duplicate key error when inserting into database", slog.String("peer", data.Name))
-					ip.Increment()
-					goto findIP
-				}
+		// another server may have given the address to a peer that is not synced yet
+		if (errors.Is(err, ErrDuplicateKey) || errors.Is(err, ErrOverlappingPrefix)) && attempts < 10 && (!static.IsValid() || (addrV6.IsValid() && !staticV6.IsValid())) {
+			logger.Error("duplicate key error when inserting into database", slog.String("peer", data.Name))
+			delete(peers.peers, data.PublicKey)
+			if !static.IsValid() {
+				used[addr] = true
+			}
+			if addrV6.IsValid() && !staticV6.IsValid() {
+				used[addrV6] = true
 			}
+			attempts++
+			goto findIP
 		} else {
 			delete(peers.peers, data.PublicKey)
 			logger.Error(err.Error(), slog.String("peer", data.Name))
@@ -298,48 +294,27 @@ findIP:
 		}
 	}
 
-	// add peer to device
-	err = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
-		PublicKey:  publicKey,
-		AllowedIPs: []net.IPNet{*allowedIPs},
-		Endpoint:   udpAddress,
-	}}})
-	if err != nil {
-		delete(peers.peers, data.PublicKey)
-		logger.Error(err.Error(), slog.String("peer", data.Name))
-		return ctx.String(500, err.Error())
-	}
-
-	logger.Info("Peer Created", slog.String("peer", data.Name))
+	audit(ctx, "peer.create", "peer", data.ID, data.Name, auditChanges(nil, map[string]interface{}{
+		"allowedUsage": data.AllowedUsage, "expiresAt": data.ExpiresAt, "role": data.Role, "allowedIPs": data.AllowedIPs, "allowedIPsV6": data.AllowedIPsV6,
+		"rateLimit": data.RateLimit,
+	}))
+	bus.Publish(PeerCreated{Peer: data})
 
 	return ctx.String(201, data.PublicKey)
 }
 
 func PostGroups(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// get group info from request body
 	var data Group
-	err = json.NewDecoder(ctx.Request().Body).Decode(&data)
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
 	if err != nil {
 		return ctx.String(400, err.Error())
 	}
 
-	// check if the requested peer is a neighbour of the user
-	if peer.Role == "distributor" {
-		if !strings.HasPrefix(data.Name, neighboursPrefix+"-") {
-			return ctx.NoContent(403)
-		}
+	if !keyAllowsName(ctx, data.Name) {
+		return ctx.NoContent(403)
 	}
 
 	// add group to database
@@ -349,15 +324,24 @@ func PostGroups(ctx echo.Context) error {
 	data.TotalRX = 0
 	data.TotalTX = 0
 	data.OwnerID = peer.ID
-	insertRes, err := groupsCollection.InsertOne(context.TODO(), data)
+	data.Period = nil
+	if !validOverQuota(data.OverQuota) {
+		return ctx.String(400, "overQuota must be disable or throttle")
+	}
+	if data.AllowedUsage < 0 {
+		return ctx.String(400, "allowed usage can not be negative")
+	}
+	if data.RateLimit.Down < 0 || data.RateLimit.Up < 0 {
+		return ctx.String(400, "rate limit can not be negative")
+	}
+	if !data.RateLimit.IsZero() && !hasPermission(peer, PermChangeRate) {
+		return ctx.NoContent(403)
+	}
+	err = store.InsertGroup(&data)
 	if err != nil {
 		// Check if the error is a duplicate key error
-		if writeException, ok := err.(mongo.WriteException); ok {
-			for _, writeError := range writeException.WriteErrors {
-				if writeError.Code == 11000 {
-					return ctx.String(400, "duplicate name")
-				}
-			}
+		if errors.Is(err, ErrDuplicateKey) {
+			return ctx.String(400, "duplicate name")
 		} else {
 			logger.Error(err.Error(), slog.String("group", data.Name))
 			return ctx.String(500, err.Error())
@@ -365,22 +349,15 @@ func PostGroups(ctx echo.Context) error {
 	}
 
 	logger.Info("Group Created", slog.String("group", data.Name))
+	audit(ctx, "group.create", "group", data.ID.Hex(), data.Name, auditChanges(nil, map[string]interface{}{
+		"allowedUsage": data.AllowedUsage, "expiresAt": data.ExpiresAt,
+	}))
 
-	return ctx.String(201, insertRes.InsertedID.(primitive.ObjectID).Hex())
+	return ctx.String(201, data.ID.Hex())
 }
 
 func DeletePeers(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// decode uri
 	id, err := url.QueryUnescape(ctx.Param("id"))
@@ -394,62 +371,36 @@ func DeletePeers(ctx echo.Context) error {
 		return ctx.NoContent(400)
 	}
 
-	// check if the requested peer is a neighbour the user
-	if peer.Role == "distributor" {
-		if !strings.HasPrefix(p.Name, neighboursPrefix+"-") {
-			return ctx.NoContent(403)
-		}
-	}
-
-	// parse peer public key
-	pk, err := wgtypes.ParseKey(p.PublicKey)
-	if err != nil {
-		logger.Error(err.Error(), slog.String("peer", p.Name))
-		return ctx.String(500, err.Error())
-	}
-
-	// remove peer from device
-	err = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
-		PublicKey: pk,
-		Remove:    true,
-	}}})
-	if err != nil {
-		logger.Error(err.Error(), slog.String("peer", p.Name))
-		return ctx.String(500, err.Error())
+	// check if the requested peer is owned by the user
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
 	}
 
-	// delete peer from database
-	_, err = peersCollection.DeleteOne(context.TODO(), bson.M{"name": p.Name})
+	// delete peer from database, it is removed from device by a subscriber
+	err = store.DeletePeer(p.ID)
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", p.Name))
 		return ctx.String(500, err.Error())
 	}
-	_, err = groupsCollection.UpdateByID(context.TODO(), p.GroupID, bson.M{"$pull": bson.M{"peerIDs": p.ID}})
+	err = store.RemovePeerFromGroup(p.GroupID, p.ID)
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", peer.Name))
 		return ctx.String(500, err.Error())
 	}
 
-	logger.Info("Peer removed", slog.String("peer", p.Name))
+	audit(ctx, "peer.delete", "peer", p.ID, p.Name, nil)
 
 	peers.mu.Lock()
 	defer peers.mu.Unlock()
 	// delete peer from local map
 	delete(peers.peers, p.ID)
+	bus.Publish(PeerDeleted{Peer: *p})
 
 	return ctx.NoContent(200)
 }
 
 func DeleteGroup(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse id
 	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
@@ -458,38 +409,28 @@ func DeleteGroup(ctx echo.Context) error {
 	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&group)
+	group, err := store.GetGroup(objectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
-	// check read rights
-	if peer.Role != "admin" && group.OwnerID != peer.ID {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
 	}
 
 	// delete group from database
-	_, err = groupsCollection.DeleteOne(context.TODO(), bson.M{"_id": group.ID})
+	err = store.DeleteGroup(group.ID)
 	if err != nil {
 		return ctx.String(500, err.Error())
 	}
+	audit(ctx, "group.delete", "group", group.ID.Hex(), group.Name, nil)
 
 	return ctx.NoContent(200)
 }
 
 func DeletePeerFromGroup(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse group id
 	groupObjectID, err := primitive.ObjectIDFromHex(ctx.Param("groupID"))
@@ -498,17 +439,14 @@ func DeletePeerFromGroup(ctx echo.Context) error {
 	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": groupObjectID}).Decode(&group)
+	group, err := store.GetGroup(groupObjectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
-	// check read rights
-	if peer.Role != "admin" && group.OwnerID != peer.ID {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
 	}
 
 	// parse peer id
@@ -516,32 +454,32 @@ func DeletePeerFromGroup(ctx echo.Context) error {
 	if err != nil {
 		return ctx.NoContent(400)
 	}
+	p, ok := peers.peers[peerID]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
 
 	// delete peer from group
-	_, err = peersCollection.UpdateByID(context.TODO(), peerID, bson.M{"$set": bson.M{"groupID": primitive.NilObjectID}})
+	err = store.UpdatePeers([]PeerUpdate{{ID: peerID, Set: map[string]interface{}{"groupID": primitive.NilObjectID}}})
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", peer.Name))
 		return ctx.String(500, err.Error())
 	}
-	_, err = groupsCollection.UpdateByID(context.TODO(), groupObjectID, bson.M{"$pull": bson.M{"peerIDs": peerID}})
+	err = store.RemovePeerFromGroup(groupObjectID, peerID)
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", peer.Name))
 		return ctx.String(500, err.Error())
 	}
+	audit(ctx, "group.removePeer", "peer", p.ID, p.Name, map[string]AuditChange{"groupID": {Before: groupObjectID, After: primitive.NilObjectID}})
 
 	return ctx.NoContent(200)
 }
 
 func PatchPeers(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// decode uri
 	id, err := url.QueryUnescape(ctx.Param("id"))
@@ -555,13 +493,9 @@ func PatchPeers(ctx echo.Context) error {
 		return ctx.NoContent(400)
 	}
 
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
-
-	// check if the requested peer is a neighbour of the user
-	if peer.Role == "distributor" {
-		if !strings.HasPrefix(p.Name, neighboursPrefix+"-") {
-			return ctx.NoContent(403)
-		}
+	// check if the requested peer is owned by the user
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
 	}
 
 	data := make(map[string]interface{})
@@ -570,105 +504,188 @@ func PatchPeers(ctx echo.Context) error {
 		return ctx.String(400, err.Error())
 	}
 
-	var updates []mongo.WriteModel
-	newPeerConfig := wgtypes.PeerConfig{UpdateOnly: true}
+	// keys restricted to a prefix can not rename out of it
+	if name, ok := data["name"].(string); ok && !keyAllowsName(ctx, name) {
+		return ctx.NoContent(403)
+	}
 
-	// parse peer public key
-	pk, err := wgtypes.ParseKey(p.PublicKey)
+	// check permissions of every changed field, peers can not raise their own limits
+	self := p.ID == peer.ID && !hasPermission(peer, PermAllPeers)
+	if _, ok := data["allowedUsage"]; ok && (!hasPermission(peer, PermChangeUsage) || self) {
+		return ctx.NoContent(403)
+	}
+	if _, ok := data["overQuota"]; ok && (!hasPermission(peer, PermChangeUsage) || self) {
+		return ctx.NoContent(403)
+	}
+	if v, ok := data["allowedUsage"].(float64); ok && v < 0 {
+		return ctx.String(400, "allowed usage can not be negative")
+	}
+	if policy, ok := data["overQuota"].(string); ok && !validOverQuota(policy) {
+		return ctx.String(400, "overQuota must be disable or throttle")
+	}
+	if _, ok := data["rateLimit"]; ok && (!hasPermission(peer, PermChangeRate) || self) {
+		return ctx.NoContent(403)
+	}
+	var rateLimit Rate
+	if v, ok := data["rateLimit"]; ok {
+		if rateLimit, err = parseRate(v); err != nil {
+			return ctx.String(400, err.Error())
+		}
+	}
+	if _, ok := data["expiresAt"]; ok && (!hasPermission(peer, PermChangeExpiry) || self) {
+		return ctx.NoContent(403)
+	}
+	if role, ok := data["role"].(string); ok {
+		// roles can only be changed between roles that are not more powerful than the caller
+		if !hasPermission(peer, PermChangeRole) || !canGrantRole(peer, p.Role) {
+			return ctx.NoContent(403)
+		}
+		if !canGrantRole(peer, role) {
+			return ctx.String(403, "can not grant role "+role)
+		}
+	}
+	ownerID, changeOwner := data["ownerID"].(string)
+	if changeOwner {
+		if !hasPermission(peer, PermChangeOwner) {
+			return ctx.NoContent(403)
+		}
+		if _, ok := peers.peers[ownerID]; !ok && ownerID != "" {
+			return ctx.String(400, "owner does not exist")
+		}
+	}
+	var profileID primitive.ObjectID
+	_, changeProfile := data["profileID"]
+	if changeProfile {
+		if profileID, err = parseProfileID(data["profileID"]); err != nil {
+			return ctx.String(400, err.Error())
+		}
+	}
+
+	// check budget of the owner before changing anything
+	allowedUsage, expiresAt := p.AllowedUsage, p.ExpiresAt
+	if v, ok := data["allowedUsage"].(float64); ok {
+		allowedUsage = int64(v)
+	}
+	if v, ok := data["expiresAt"].(float64); ok {
+		expiresAt = int64(v)
+	}
+	// a new owner takes the whole cost of the peer from its budget and the old owner gets it back
+	deltas := make(map[string]Budget)
+	if changeOwner && ownerID != p.OwnerID {
+		deltas[p.OwnerID] = Budget{}.Sub(peerCost(p.AllowedUsage, p.ExpiresAt))
+		deltas[ownerID] = peerCost(allowedUsage, expiresAt)
+	} else {
+		deltas[p.OwnerID] = peerCost(allowedUsage, expiresAt).Sub(peerCost(p.AllowedUsage, p.ExpiresAt))
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(deltas)
 	if err != nil {
-		logger.Error(err.Error(), slog.String("peer", p.Name))
-		return ctx.String(500, err.Error())
+		return ctx.String(403, err.Error())
+	}
+
+	// keep old values for the audit trail
+	before := map[string]interface{}{
+		"preferredEndpoint": p.PreferredEndpoint, "allowedUsage": p.AllowedUsage, "expiresAt": p.ExpiresAt, "role": p.Role, "name": p.Name, "ownerID": p.OwnerID,
+		"overQuota": p.OverQuota, "rateLimit": p.RateLimit, "profileID": p.ProfileID,
 	}
-	newPeerConfig.PublicKey = pk
+
+	update := PeerUpdate{ID: p.ID, Set: map[string]interface{}{}}
 
 	if preferredEndpoint, ok := data["preferredEndpoint"].(string); ok {
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"publicKey": p.PublicKey})
-		if preferredEndpoint == "" {
-			update.SetUpdate(bson.M{"$set": bson.M{"preferredEndpoint": ""}})
-			newPeerConfig.Endpoint = nil
-		} else {
-			udpAddress, err := net.ResolveUDPAddr("udp4", preferredEndpoint)
+		if preferredEndpoint != "" {
+			udpAddress, err := net.ResolveUDPAddr("udp", preferredEndpoint)
 			if err != nil {
 				return ctx.String(400, err.Error())
 			}
-			update.SetUpdate(bson.M{"$set": bson.M{"preferredEndpoint": udpAddress.String()}})
-			newPeerConfig.Endpoint = udpAddress
-		}
-		updates = append(updates, update)
-
-		err = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{newPeerConfig}})
-		if err != nil {
-			logger.Error(err.Error(), slog.String("peer", p.Name))
-			return ctx.String(500, err.Error())
+			preferredEndpoint = udpAddress.String()
 		}
+		update.Set["preferredEndpoint"] = preferredEndpoint
 		peers.mu.Lock()
 		p.PreferredEndpoint = preferredEndpoint
 		peers.mu.Unlock()
 	}
 
 	if allowedUsage, ok := data["allowedUsage"].(float64); ok {
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"publicKey": p.PublicKey})
-		update.SetUpdate(bson.M{"$set": bson.M{"allowedUsage": int64(allowedUsage)}})
-		updates = append(updates, update)
+		update.Set["allowedUsage"] = int64(allowedUsage)
 		peers.mu.Lock()
 		p.AllowedUsage = int64(allowedUsage)
 		peers.mu.Unlock()
 	}
 
 	if expiresAt, ok := data["expiresAt"].(float64); ok {
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"publicKey": p.PublicKey})
-		update.SetUpdate(bson.M{"$set": bson.M{"expiresAt": int64(expiresAt)}})
-		updates = append(updates, update)
+		update.Set["expiresAt"] = int64(expiresAt)
 		peers.mu.Lock()
 		p.ExpiresAt = int64(expiresAt)
 		peers.mu.Unlock()
 	}
 
+	if policy, ok := data["overQuota"].(string); ok {
+		update.Set["overQuota"] = policy
+		peers.mu.Lock()
+		p.OverQuota = policy
+		peers.mu.Unlock()
+	}
+
+	if _, ok := data["rateLimit"]; ok {
+		update.Set["rateLimit"] = rateLimit
+		peers.mu.Lock()
+		p.RateLimit = rateLimit
+		peers.mu.Unlock()
+	}
+
 	if role, ok := data["role"].(string); ok {
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"publicKey": p.PublicKey})
-		update.SetUpdate(bson.M{"$set": bson.M{"role": role}})
-		updates = append(updates, update)
+		update.Set["role"] = role
 		peers.mu.Lock()
 		p.Role = role
 		peers.mu.Unlock()
 	}
 
 	if name, ok := data["name"].(string); ok {
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"publicKey": p.PublicKey})
-		update.SetUpdate(bson.M{"$set": bson.M{"name": name}})
-		updates = append(updates, update)
+		update.Set["name"] = name
 		peers.mu.Lock()
 		p.Name = name
 		peers.mu.Unlock()
 	}
 
+	if changeOwner {
+		update.Set["ownerID"] = ownerID
+		peers.mu.Lock()
+		p.OwnerID = ownerID
+		peers.mu.Unlock()
+	}
+
+	if changeProfile {
+		update.Set["profileID"] = profileID
+		peers.mu.Lock()
+		p.ProfileID = profileID
+		peers.mu.Unlock()
+	}
+
 	// update database
-	if len(updates) > 0 {
-		_, err := peersCollection.BulkWrite(context.TODO(), updates, &options.BulkWriteOptions{})
+	if len(update.Set) > 0 {
+		err := store.UpdatePeers([]PeerUpdate{update})
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", p.Name))
 			return ctx.String(500, err.Error())
 		}
+		audit(ctx, "peer.update", "peer", p.ID, p.Name, auditChanges(before, update.Set))
+
+		// device and traffic control are changed by subscribers
+		fields := make([]string, 0, len(update.Set))
+		for k := range update.Set {
+			fields = append(fields, k)
+		}
+		peers.mu.RLock()
+		bus.Publish(PeerUpdated{Peer: *p, Fields: fields})
+		peers.mu.RUnlock()
 	}
 
 	return ctx.NoContent(200)
 }
 
 func PatchGroups(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse id
 	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
@@ -677,17 +694,14 @@ func PatchGroups(ctx echo.Context) error {
 	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&group)
+	group, err := store.GetGroup(objectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
-	// check read rights
-	if peer.Role != "admin" && group.OwnerID != peer.ID {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
 	}
 
 	data := make(map[string]interface{})
@@ -696,58 +710,148 @@ func PatchGroups(ctx echo.Context) error {
 		return ctx.String(400, err.Error())
 	}
 
-	var groupUpdates []mongo.WriteModel
-	var peerUpdates []mongo.WriteModel
+	// keys restricted to a prefix can not rename out of it
+	if name, ok := data["name"].(string); ok && !keyAllowsName(ctx, name) {
+		return ctx.NoContent(403)
+	}
+
+	// check permissions of every changed field
+	if _, ok := data["allowedUsage"]; ok && !hasPermission(peer, PermChangeUsage) {
+		return ctx.NoContent(403)
+	}
+	if _, ok := data["expiresAt"]; ok && !hasPermission(peer, PermChangeExpiry) {
+		return ctx.NoContent(403)
+	}
+	if _, ok := data["overQuota"]; ok && !hasPermission(peer, PermChangeUsage) {
+		return ctx.NoContent(403)
+	}
+	if v, ok := data["allowedUsage"].(float64); ok && v < 0 {
+		return ctx.String(400, "allowed usage can not be negative")
+	}
+	if policy, ok := data["overQuota"].(string); ok && !validOverQuota(policy) {
+		return ctx.String(400, "overQuota must be disable or throttle")
+	}
+	if _, ok := data["rateLimit"]; ok && !hasPermission(peer, PermChangeRate) {
+		return ctx.NoContent(403)
+	}
+	var rateLimit Rate
+	if v, ok := data["rateLimit"]; ok {
+		if rateLimit, err = parseRate(v); err != nil {
+			return ctx.String(400, err.Error())
+		}
+	}
+	var profileID primitive.ObjectID
+	_, changeProfile := data["profileID"]
+	if changeProfile {
+		if profileID, err = parseProfileID(data["profileID"]); err != nil {
+			return ctx.String(400, err.Error())
+		}
+	}
+
+	// check budgets of the owners of peers in the group before changing anything
+	deltas := make(map[string]Budget)
+	for _, peerID := range group.PeerIDs {
+		p, ok := peers.peers[peerID]
+		if !ok {
+			continue
+		}
+		allowedUsage, expiresAt := p.AllowedUsage, p.ExpiresAt
+		if v, ok := data["allowedUsage"].(float64); ok {
+			allowedUsage = int64(v)
+		}
+		if v, ok := data["expiresAt"].(float64); ok {
+			expiresAt = int64(v)
+		}
+		deltas[p.OwnerID] = deltas[p.OwnerID].Add(peerCost(allowedUsage, expiresAt).Sub(peerCost(p.AllowedUsage, p.ExpiresAt)))
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(deltas)
+	if err != nil {
+		return ctx.String(403, err.Error())
+	}
+
+	groupUpdate := GroupUpdate{ID: group.ID, Set: map[string]interface{}{}}
+	var peerUpdates []PeerUpdate
 
 	if allowedUsage, ok := data["allowedUsage"].(float64); ok {
-		groupUpdate := mongo.NewUpdateOneModel()
-		groupUpdate.SetFilter(bson.M{"_id": group.ID})
-		groupUpdate.SetUpdate(bson.M{"$set": bson.M{"allowedUsage": int64(allowedUsage)}})
-		groupUpdates = append(groupUpdates, groupUpdate)
+		groupUpdate.Set["allowedUsage"] = int64(allowedUsage)
+		peers.mu.Lock()
 		for _, peerID := range group.PeerIDs {
-			peerUpdate := mongo.NewUpdateOneModel()
-			peerUpdate.SetFilter(bson.M{"_id": peerID})
-			peerUpdate.SetUpdate(bson.M{"$set": bson.M{"allowedUsage": int64(allowedUsage)}})
-			peerUpdates = append(peerUpdates, peerUpdate)
-			peers.mu.Lock()
-			peers.peers[peerID].AllowedUsage = int64(allowedUsage)
-			peers.mu.Unlock()
+			// ids of deleted peers can still be in the group
+			if p, ok := peers.peers[peerID]; ok {
+				peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"allowedUsage": int64(allowedUsage)}})
+				p.AllowedUsage = int64(allowedUsage)
+			}
 		}
+		peers.mu.Unlock()
 	}
 
 	if expiresAt, ok := data["expiresAt"].(float64); ok {
-		groupUpdate := mongo.NewUpdateOneModel()
-		groupUpdate.SetFilter(bson.M{"_id": group.ID})
-		groupUpdate.SetUpdate(bson.M{"$set": bson.M{"expiresAt": int64(expiresAt)}})
-		groupUpdates = append(groupUpdates, groupUpdate)
+		groupUpdate.Set["expiresAt"] = int64(expiresAt)
+		peers.mu.Lock()
+		for _, peerID := range group.PeerIDs {
+			// ids of deleted peers can still be in the group
+			if p, ok := peers.peers[peerID]; ok {
+				peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"expiresAt": int64(expiresAt)}})
+				p.ExpiresAt = int64(expiresAt)
+			}
+		}
+		peers.mu.Unlock()
+	}
+
+	if policy, ok := data["overQuota"].(string); ok {
+		groupUpdate.Set["overQuota"] = policy
+		peers.mu.Lock()
 		for _, peerID := range group.PeerIDs {
-			peerUpdate := mongo.NewUpdateOneModel()
-			peerUpdate.SetFilter(bson.M{"_id": peerID})
-			peerUpdate.SetUpdate(bson.M{"$set": bson.M{"expiresAt": int64(expiresAt)}})
-			peerUpdates = append(peerUpdates, peerUpdate)
-			peers.mu.Lock()
-			peers.peers[peerID].ExpiresAt = int64(expiresAt)
-			peers.mu.Unlock()
+			// ids of deleted peers can still be in the group
+			if p, ok := peers.peers[peerID]; ok {
+				peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"overQuota": policy}})
+				p.OverQuota = policy
+			}
 		}
+		peers.mu.Unlock()
+	}
+
+	if _, ok := data["rateLimit"]; ok {
+		groupUpdate.Set["rateLimit"] = rateLimit
+		peers.mu.Lock()
+		for _, peerID := range group.PeerIDs {
+			// ids of deleted peers can still be in the group
+			if p, ok := peers.peers[peerID]; ok {
+				peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"rateLimit": rateLimit}})
+				p.RateLimit = rateLimit
+				if err = setRate(p); err != nil {
+					logger.Error(err.Error(), slog.String("peer", p.Name))
+				}
+			}
+		}
+		peers.mu.Unlock()
 	}
 
 	if name, ok := data["name"].(string); ok {
-		groupUpdate := mongo.NewUpdateOneModel()
-		groupUpdate.SetFilter(bson.M{"_id": group.ID})
-		groupUpdate.SetUpdate(bson.M{"$set": bson.M{"name": name}})
-		groupUpdates = append(groupUpdates, groupUpdate)
+		groupUpdate.Set["name"] = name
+	}
+
+	// peers take the profile from the group when configs are rendered, so it is not copied to them
+	if changeProfile {
+		groupUpdate.Set["profileID"] = profileID
 	}
 
 	// update database
-	if len(groupUpdates) > 0 {
-		_, err := groupsCollection.BulkWrite(context.TODO(), groupUpdates, &options.BulkWriteOptions{})
+	if len(groupUpdate.Set) > 0 {
+		err := store.UpdateGroups([]GroupUpdate{groupUpdate})
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", peer.Name))
 			return ctx.String(500, err.Error())
 		}
+		audit(ctx, "group.update", "group", group.ID.Hex(), group.Name, auditChanges(map[string]interface{}{
+			"allowedUsage": group.AllowedUsage, "expiresAt": group.ExpiresAt, "name": group.Name, "overQuota": group.OverQuota,
+			"rateLimit": group.RateLimit, "profileID": group.ProfileID,
+		}, groupUpdate.Set))
 	}
 	if len(peerUpdates) > 0 {
-		_, err := peersCollection.BulkWrite(context.TODO(), peerUpdates, &options.BulkWriteOptions{})
+		err := store.UpdatePeers(peerUpdates)
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", peer.Name))
 			return ctx.String(500, err.Error())
@@ -758,15 +862,7 @@ func PatchGroups(ctx echo.Context) error {
 }
 
 func PutPeers(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// decode uri
 	id, err := url.QueryUnescape(ctx.Param("id"))
@@ -780,23 +876,23 @@ func PutPeers(ctx echo.Context) error {
 		return ctx.NoContent(400)
 	}
 
-	neighboursPrefix := strings.Split(peer.Name, "-")[0]
-
-	// check if the requested peer is a neighbour of the user
-	if peer.Role == "distributor" {
-		if !strings.HasPrefix(p.Name, neighboursPrefix+"-") {
-			return ctx.NoContent(403)
-		}
+	// check if the requested peer is owned by the user, peers can not reset their own usage
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) || (p.ID == peer.ID && !hasPermission(peer, PermAllPeers)) {
+		return ctx.NoContent(403)
 	}
 
-	_, err = peersCollection.UpdateByID(context.TODO(), p.ID, bson.M{"$set": bson.M{
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{
 		"totalTX": int64(0), "totalRX": int64(0),
-	}})
+	}}})
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", p.Name))
 		return ctx.String(500, err.Error())
 	}
 
+	audit(ctx, "peer.resetUsage", "peer", p.ID, p.Name, map[string]AuditChange{
+		"totalTX": {Before: p.TotalTX, After: int64(0)}, "totalRX": {Before: p.TotalRX, After: int64(0)},
+	})
+
 	peers.mu.Lock()
 	defer peers.mu.Unlock()
 	p.TotalTX = 0
@@ -806,15 +902,7 @@ func PutPeers(ctx echo.Context) error {
 }
 
 func PutGroups(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role == "user" {
-		return ctx.NoContent(403)
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse id
 	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
@@ -823,46 +911,60 @@ func PutGroups(ctx echo.Context) error {
 	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&group)
+	group, err := store.GetGroup(objectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
-	// check read rights
-	if peer.Role != "admin" && group.OwnerID != peer.ID {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
 	}
 
-	_, err = groupsCollection.UpdateByID(context.TODO(), group.ID, bson.M{"$set": bson.M{
+	err = store.UpdateGroups([]GroupUpdate{{ID: group.ID, Set: map[string]interface{}{
 		"totalTX": int64(0), "totalRX": int64(0),
-	}})
+	}}})
 	if err != nil {
 		logger.Error(err.Error(), slog.String("peer", peer.Name))
 		return ctx.String(500, err.Error())
 	}
 
+	// only totals are reset, allowed usage of members is changed with PATCH so budgets are checked
+	var peerUpdates []PeerUpdate
+	peers.mu.RLock()
 	for _, peerID := range group.PeerIDs {
-		_, err = peersCollection.UpdateByID(context.TODO(), peerID, bson.M{"$set": bson.M{
-			"totalTX": int64(0), "totalRX": int64(0), "allowedUsage": group.AllowedUsage,
-		}})
+		// ids of deleted peers can still be in the group
+		if _, ok := peers.peers[peerID]; ok {
+			peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"totalTX": int64(0), "totalRX": int64(0)}})
+		}
+	}
+	peers.mu.RUnlock()
+	if len(peerUpdates) > 0 {
+		err = store.UpdatePeers(peerUpdates)
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", peer.Name))
 			return ctx.String(500, err.Error())
 		}
 	}
 
+	peers.mu.Lock()
+	for _, u := range peerUpdates {
+		if p, ok := peers.peers[u.ID]; ok {
+			p.TotalTX = 0
+			p.TotalRX = 0
+		}
+	}
+	peers.mu.Unlock()
+
+	audit(ctx, "group.resetUsage", "group", group.ID.Hex(), group.Name, map[string]AuditChange{
+		"totalTX": {Before: group.TotalTX, After: int64(0)}, "totalRX": {Before: group.TotalRX, After: int64(0)},
+	})
+
 	return ctx.NoContent(200)
 }
 
 func PutPeerToGroup(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
+	peer := ctx.Get("peer").(*Peer)
 
 	// parse group id
 	groupObjectID, err := primitive.ObjectIDFromHex(ctx.Param("groupID"))
@@ -875,72 +977,69 @@ func PutPeerToGroup(ctx echo.Context) error {
 	if err != nil {
 		return ctx.NoContent(400)
 	}
+	p, ok := peers.peers[peerID]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
 
 	// check if group exists
-	var group Group
-	err = groupsCollection.FindOne(context.TODO(), bson.M{"_id": groupObjectID}).Decode(&group)
+	group, err := store.GetGroup(groupObjectID)
 	if err != nil {
 		return ctx.NoContent(404)
 	}
 
 	// check read rights
-	if peer.Role != "admin" {
-		if group.OwnerID != peer.ID {
-			return ctx.NoContent(403)
-		}
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
+	}
+
+	// peers in a group get the usage and expiry of the group
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(map[string]Budget{p.OwnerID: peerCost(group.AllowedUsage, group.ExpiresAt).Sub(peerCost(p.AllowedUsage, p.ExpiresAt))})
+	if err != nil {
+		return ctx.String(403, err.Error())
 	}
 
 	// add peer to group
-	_, err = groupsCollection.UpdateByID(context.TODO(), groupObjectID, bson.M{"$push": bson.M{"peerIDs": peerID}})
+	err = store.AddPeerToGroup(groupObjectID, peerID)
 	if err != nil {
 		return ctx.String(500, err.Error())
 	}
 
 	// add group id to peer
-	_, err = peersCollection.UpdateByID(context.TODO(), peerID, bson.M{"$set": bson.M{"groupID": groupObjectID, "totalTX": int64(0), "totalRX": int64(0), "allowedUsage": group.AllowedUsage, "expiresAt": group.ExpiresAt}})
+	set := map[string]interface{}{"groupID": groupObjectID, "totalTX": int64(0), "totalRX": int64(0), "allowedUsage": group.AllowedUsage, "expiresAt": group.ExpiresAt, "overQuota": group.OverQuota, "rateLimit": group.RateLimit}
+	err = store.UpdatePeers([]PeerUpdate{{ID: peerID, Set: set}})
 	if err != nil {
 		return ctx.String(500, err.Error())
 	}
+	audit(ctx, "group.addPeer", "peer", p.ID, p.Name, auditChanges(map[string]interface{}{
+		"groupID": p.GroupID, "totalTX": p.TotalTX, "totalRX": p.TotalRX, "allowedUsage": p.AllowedUsage, "expiresAt": p.ExpiresAt, "overQuota": p.OverQuota, "rateLimit": p.RateLimit,
+	}, set))
 
 	// return peer
 	return ctx.NoContent(200)
 }
 
 func GetConfig(ctx echo.Context) error {
-	return ctx.JSON(200, map[string]interface{}{"serverPublicKey": device.PublicKey.String(), "serverAddress": fmt.Sprintf("%s:%d", config.PublicAddress, device.ListenPort), "endpoints": config.Endpoints, "telegramBotID": config.TelegramBotID})
+	return ctx.JSON(200, map[string]interface{}{"serverPublicKey": device.PublicKey.String(), "serverAddress": fmt.Sprintf("%s:%d", config.PublicAddress, device.ListenPort), "endpoints": config.Endpoints, "telegramBotID": config.TelegramBotID, "tunnelPrefixes": tunnelPrefixes(), "routes": allRoutes()})
 }
 
 func GetMe(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
-	if err != nil {
-		return ctx.String(500, err.Error())
-	}
+	peer := ctx.Get("peer").(*Peer)
 
-	if peer.Role == "distributor" {
-		return ctx.JSON(200, map[string]interface{}{"role": peer.Role, "prefix": strings.Split(peer.Name, "-")[0]})
+	if hasPermission(peer, PermCreatePeer) && !hasPermission(peer, PermAllPeers) {
+		return ctx.JSON(200, map[string]interface{}{"role": peer.Role, "prefix": strings.Split(peer.Name, "-")[0], "permissions": roles[peer.Role]})
 	}
-	return ctx.JSON(200, map[string]interface{}{"role": peer.Role, "prefix": ""})
+	return ctx.JSON(200, map[string]interface{}{"role": peer.Role, "prefix": "", "permissions": roles[peer.Role]})
 }
 
 func GetLogs(ctx echo.Context) error {
-	var peer Peer
-	err := peersCollection.FindOne(context.TODO(), bson.M{"allowedIPs": ctx.Get("peerIP").(string) + "/32"}).Decode(&peer)
+	logs, err := store.GetLogs()
 	if err != nil {
-		return ctx.String(500, err.Error())
-	}
-
-	if peer.Role != "admin" {
-		return ctx.NoContent(403)
-	}
-
-	var logs []Log
-	cursor, err := ioWriter.LogsCollection.Find(context.TODO(), bson.M{})
-	if err != nil {
-		logger.Error(err.Error())
-		return ctx.String(500, err.Error())
-	}
-	if err = cursor.All(context.TODO(), &logs); err != nil {
 		logger.Error(err.Error())
 		return ctx.String(500, err.Error())
 	}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
+// addressRange is an inclusive range of addresses
+type addressRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+func (r addressRange) contains(a netip.Addr) bool {
+	return r.from.Compare(a) <= 0 && a.Compare(r.to) <= 0
+}
+
+// IPAM hands out addresses of peers from the configured pools
+type IPAM struct {
+	pools    []netip.Prefix
+	reserved []addressRange // only given out as static addresses
+	servers  []netip.Addr   // ipv4 and ipv6 addresses of the interface
+}
+
+var ipam *IPAM // used to allocate addresses of new peers
+
+// NewIPAM creates pools from addressPools, or the interface prefixes if there are none, and parses reserved ranges
+func NewIPAM(c *Config) (*IPAM, error) {
+	ipam := &IPAM{}
+
+	for _, s := range []string{c.InterfaceAddress, c.InterfaceAddressV6} {
+		if s == "" {
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		ipam.servers = append(ipam.servers, a)
+	}
+
+	pools := c.AddressPools
+	if len(pools) == 0 {
+		pools = []string{c.InterfaceAddressCIDR}
+		if c.InterfaceAddressV6CIDR != "" {
+			pools = append(pools, c.InterfaceAddressV6CIDR)
+		}
+	}
+	for _, s := range pools {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		ipam.pools = append(ipam.pools, p.Masked())
+	}
+
+	for _, s := range c.ReservedRanges {
+		r, err := parseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ipam.reserved = append(ipam.reserved, r)
+	}
+
+	return ipam, nil
+}
+
+// parseRange parses a single address, a prefix or two addresses separated by a dash
+func parseRange(s string) (addressRange, error) {
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		r := addressRange{}
+		var err error
+		if r.from, err = netip.ParseAddr(strings.TrimSpace(from)); err != nil {
+			return r, err
+		}
+		if r.to, err = netip.ParseAddr(strings.TrimSpace(to)); err != nil {
+			return r, err
+		}
+		if r.from.BitLen() != r.to.BitLen() || r.to.Less(r.from) {
+			return r, fmt.Errorf("invalid address range %s", s)
+		}
+		return r, nil
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return addressRange{}, err
+		}
+		return addressRange{from: p.Masked().Addr(), to: lastAddr(p)}, nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return addressRange{}, err
+	}
+	return addressRange{from: a, to: a}, nil
+}
+
+// lastAddr returns the last address of p, which is the broadcast address of ipv4 prefixes
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// addrInt converts a to a number so ranges can be counted
+func addrInt(a netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(a.AsSlice())
+}
+
+// rangeSize returns the number of addresses from a to b, zero if b is before a
+func rangeSize(a netip.Addr, b netip.Addr) *big.Int {
+	if b.Less(a) {
+		return new(big.Int)
+	}
+	n := new(big.Int).Sub(addrInt(b), addrInt(a))
+	return n.Add(n, big.NewInt(1))
+}
+
+// clampUint64 converts n to uint64 for reports, huge ipv6 pools are capped
+func clampUint64(n *big.Int) uint64 {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if !n.IsUint64() {
+		return ^uint64(0)
+	}
+	return n.Uint64()
+}
+
+// usable checks if a can be given to a peer, network, broadcast and server addresses can not
+func (ipam *IPAM) usable(p netip.Prefix, a netip.Addr) bool {
+	if a == p.Addr() || slices.Contains(ipam.servers, a) {
+		return false
+	}
+	return !(a.Is4() && p.Bits() < 31 && a == lastAddr(p))
+}
+
+func (ipam *IPAM) isReserved(a netip.Addr) bool {
+	for _, r := range ipam.reserved {
+		if r.contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolOf returns the pool a belongs to
+func (ipam *IPAM) poolOf(a netip.Addr) (netip.Prefix, bool) {
+	for _, p := range ipam.pools {
+		if p.Contains(a) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// HasV6 checks if peers get ipv6 addresses
+func (ipam *IPAM) HasV6() bool {
+	return slices.ContainsFunc(ipam.pools, func(p netip.Prefix) bool { return p.Addr().Is6() })
+}
+
+// Allocate returns the first address in the ipv4 or ipv6 pools that is usable, not reserved and not in used
+func (ipam *IPAM) Allocate(used map[netip.Addr]bool, v6 bool) (netip.Addr, error) {
+	for _, p := range ipam.pools {
+		if p.Addr().Is6() != v6 {
+			continue
+		}
+		for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+			if ipam.usable(p, a) && !used[a] && !ipam.isReserved(a) {
+				return a, nil
+			}
+		}
+	}
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+// CheckStatic returns an error if a can not be given to a peer as a static address, reserved addresses are allowed
+func (ipam *IPAM) CheckStatic(a netip.Addr, used map[netip.Addr]bool) error {
+	p, ok := ipam.poolOf(a)
+	if !ok {
+		return fmt.Errorf("%s is not in any address pool", a)
+	}
+	if !ipam.usable(p, a) {
+		return fmt.Errorf("%s is a network, broadcast or server address", a)
+	}
+	if used[a] {
+		return fmt.Errorf("%s is already used", a)
+	}
+	return nil
+}
+
+// ParseStatic parses an address chosen for a new peer with or without a single address prefix and checks if it can be used
+func (ipam *IPAM) ParseStatic(s string, v6 bool, used map[netip.Addr]bool) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		p, e := netip.ParsePrefix(s)
+		if e != nil || !p.IsSingleIP() {
+			return a, err
+		}
+		a = p.Addr()
+	}
+	if a.Is6() != v6 {
+		return a, fmt.Errorf("%s is not an ipv%s address", a, map[bool]string{false: "4", true: "6"}[v6])
+	}
+	return a, ipam.CheckStatic(a, used)
+}
+
+type PoolUsage struct {
+	Prefix   string `json:"Prefix"`
+	Size     uint64 `json:"Size"`     // addresses that can be given to peers
+	Used     uint64 `json:"Used"`     // addresses given to peers
+	Reserved uint64 `json:"Reserved"` // unused addresses that are only given out as static addresses
+	Free     uint64 `json:"Free"`     // addresses left for allocation
+}
+
+// Usage reports utilisation of every pool
+func (ipam *IPAM) Usage(used map[netip.Addr]bool) []PoolUsage {
+	var usage []PoolUsage
+	for _, p := range ipam.pools {
+		first, last := p.Addr(), lastAddr(p)
+		size := rangeSize(first, last)
+
+		// network, broadcast and server addresses can not be used
+		size.Sub(size, big.NewInt(1))
+		if p.Addr().Is4() && p.Bits() < 31 {
+			size.Sub(size, big.NewInt(1))
+		}
+		for _, server := range ipam.servers {
+			if p.Contains(server) && server != first && !(server.Is4() && p.Bits() < 31 && server == last) {
+				size.Sub(size, big.NewInt(1))
+			}
+		}
+
+		var usedCount, usedReserved int64
+		for a := range used {
+			if p.Contains(a) && ipam.usable(p, a) {
+				usedCount++
+				if ipam.isReserved(a) {
+					usedReserved++
+				}
+			}
+		}
+
+		reserved := new(big.Int)
+		for _, r := range ipam.reserved {
+			from, to := r.from, r.to
+			if from.BitLen() != first.BitLen() {
+				continue
+			}
+			if from.Less(first) {
+				from = first
+			}
+			if last.Less(to) {
+				to = last
+			}
+			reserved.Add(reserved, rangeSize(from, to))
+		}
+		reserved.Sub(reserved, big.NewInt(usedReserved))
+
+		free := new(big.Int).Sub(size, big.NewInt(usedCount))
+		free.Sub(free, reserved)
+
+		usage = append(usage, PoolUsage{
+			Prefix:   p.String(),
+			Size:     clampUint64(size),
+			Used:     uint64(usedCount),
+			Reserved: clampUint64(reserved),
+			Free:     clampUint64(free),
+		})
+	}
+	return usage
+}
+
+// usedAddresses returns addresses of peers in local map and on device, peers.mu must be held
+func usedAddresses() (map[netip.Addr]bool, error) {
+	used := make(map[netip.Addr]bool)
+	for _, p := range peers.peers {
+		for _, s := range []string{p.AllowedIPs, p.AllowedIPsV6} {
+			if prefix, err := netip.ParsePrefix(s); err == nil && prefix.IsSingleIP() {
+				used[prefix.Addr()] = true
+			}
+		}
+	}
+
+	d, err := wgc.Device(config.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, dp := range d.Peers {
+		for _, aip := range dp.AllowedIPs {
+			if ones, bits := aip.Mask.Size(); ones != bits {
+				continue
+			}
+			if a, ok := netip.AddrFromSlice(aip.IP); ok {
+				used[a.Unmap()] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// addrPrefix returns a as a single address prefix like stored in allowedIPs
+func addrPrefix(a netip.Addr) string {
+	return netip.PrefixFrom(a, a.BitLen()).String()
+}
+
+// backfillV6Addresses gives ipv6 addresses to peers created before an ipv6 pool was configured
+func backfillV6Addresses() {
+	if !ipam.HasV6() {
+		return
+	}
+
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	used, err := usedAddresses()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	for _, p := range peers.peers {
+		if p.AllowedIPsV6 != "" {
+			continue
+		}
+		for {
+			a, err := ipam.Allocate(used, true)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("peer", p.Name))
+				return
+			}
+			used[a] = true
+
+			// another server may have given the address to a peer that is not synced yet
+			err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"allowedIPsV6": addrPrefix(a)}}})
+			if errors.Is(err, ErrDuplicateKey) || errors.Is(err, ErrOverlappingPrefix) {
+				continue
+			}
+			if err != nil {
+				logger.Error(err.Error(), slog.String("peer", p.Name))
+				return
+			}
+
+			p.AllowedIPsV6 = addrPrefix(a)
+			logger.Info("Assigned ipv6 address "+p.AllowedIPsV6, slog.String("peer", p.Name))
+			break
+		}
+	}
+}
+
+func GetIPAM(ctx echo.Context) error {
+	peers.mu.RLock()
+	used, err := usedAddresses()
+	peers.mu.RUnlock()
+	if err != nil {
+		logger.Error(err.Error())
+		return ctx.String(500, err.Error())
+	}
+	return ctx.JSON(200, ipam.Usage(used))
+}
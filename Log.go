@@ -1,13 +1,10 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"time"
-
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Log struct {
@@ -21,8 +18,8 @@ type Log struct {
 }
 
 type CustomWriter struct {
-	W              io.Writer
-	LogsCollection *mongo.Collection
+	W     io.Writer
+	Store Storage
 }
 
 func (e CustomWriter) Write(p []byte) (int, error) {
@@ -37,7 +34,7 @@ func (e CustomWriter) Write(p []byte) (int, error) {
 		// logs will be removed from db after 2 days
 		l.ExpireAt = time.Now().Add(time.Hour * 48)
 
-		_, err = e.LogsCollection.InsertOne(context.TODO(), l)
+		err = e.Store.InsertLog(&l)
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -1,28 +1,83 @@
 package main
 
 import (
+	"errors"
+	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
 	"strings"
 
 	"github.com/labstack/echo/v4"
 )
 
+// routes that do not need authentication
+var publicRoutes = []string{"/api/login"}
+
 func Auth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		// check for admin bypass
-		if ctx.Request().Header.Get("bypass_key") == config.BypassKey {
-			ctx.Set("bypass", true)
+		if slices.Contains(publicRoutes, ctx.Path()) {
 			return next(ctx)
 		}
 
-		ip := strings.Split(ctx.Request().RemoteAddr, ":")[0]
+		// check for session token or api key
+		if token, ok := strings.CutPrefix(ctx.Request().Header.Get("Authorization"), "Bearer "); ok {
+			peer, apiKey, err := authenticateToken(token)
+			if err != nil {
+				logger.Warn("Unauthorized request from "+ctx.Request().RemoteAddr, "error", err.Error())
+				return ctx.NoContent(401)
+			}
+			if apiKey != nil {
+				ctx.Set("apiKey", apiKey)
+				logger.Debug("API key "+apiKey.Name+" used for "+ctx.Request().Method+" "+ctx.Request().URL.Path, slog.String("peer", peer.Name))
+			}
+			ctx.Set("peer", peer)
+			return next(ctx)
+		}
+
+		ip := remoteIP(ctx)
 		// check if request is from peer
-		if !deviceCIDR.Contains(net.ParseIP(ip)) {
+		if !slices.ContainsFunc(deviceCIDRs, func(p netip.Prefix) bool { return p.Contains(ip) }) {
 			logger.Warn("Unauthorized request from " + ctx.Request().RemoteAddr)
 			return ctx.NoContent(403)
 		}
-		ctx.Set("peerIP", ip)
-		ctx.Set("bypass", false)
+
+		// static files do not need a peer
+		if !strings.HasPrefix(ctx.Path(), "/api/") {
+			return next(ctx)
+		}
+
+		// find peer by tunnel address
+		peer, err := store.GetPeerByAddress(addrPrefix(ip))
+		if errors.Is(err, ErrNotFound) {
+			return ctx.NoContent(403)
+		}
+		if err != nil {
+			return ctx.String(500, err.Error())
+		}
+		ctx.Set("peer", peer)
 		return next(ctx)
 	}
 }
+
+// remoteIP returns the address the request came from, ipv4 addresses mapped to ipv6 are unmapped
+func remoteIP(ctx echo.Context) netip.Addr {
+	host, _, err := net.SplitHostPort(ctx.Request().RemoteAddr)
+	if err != nil {
+		host = ctx.Request().RemoteAddr
+	}
+	ip, _ := netip.ParseAddr(host)
+	return ip.Unmap()
+}
+
+// RequireScope rejects requests made with api keys that were not granted scope
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if apiKey, ok := ctx.Get("apiKey").(*APIKey); ok && !apiKey.HasScope(scope) {
+				return ctx.NoContent(403)
+			}
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,768 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoStorage struct {
+	client     *mongo.Client
+	peers      *mongo.Collection
+	groups     *mongo.Collection
+	logs       *mongo.Collection
+	tokens     *mongo.Collection
+	keys       *mongo.Collection
+	audit      *mongo.Collection
+	usage      *mongo.Collection
+	periods    *mongo.Collection
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+	profiles   *mongo.Collection
+	locks      *mongo.Collection
+}
+
+func NewMongoStorage(uri string, dbName string) (*MongoStorage, error) {
+	// connect to database
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MongoStorage{
+		client:     client,
+		peers:      client.Database(dbName).Collection("peers"),
+		groups:     client.Database(dbName).Collection("groups"),
+		logs:       client.Database(dbName).Collection("logs"),
+		tokens:     client.Database(dbName).Collection("resumeTokens"),
+		keys:       client.Database(dbName).Collection("apiKeys"),
+		audit:      client.Database(dbName).Collection("audit"),
+		usage:      client.Database(dbName).Collection("usage"),
+		periods:    client.Database(dbName).Collection("periods"),
+		webhooks:   client.Database(dbName).Collection("webhooks"),
+		deliveries: client.Database(dbName).Collection("webhookDeliveries"),
+		profiles:   client.Database(dbName).Collection("profiles"),
+		locks:      client.Database(dbName).Collection("locks"),
+	}
+
+	// create unique index for allowedIPs
+	_, err = s.peers.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.M{"allowedIPs": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	// create unique index for allowedIPsV6, peers without an ipv6 address do not have the field
+	_, err = s.peers.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.M{"allowedIPsV6": 1}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"allowedIPsV6": bson.M{"$type": "string"}})})
+	if err != nil {
+		return nil, err
+	}
+
+	// create unique index for peer names
+	_, err = s.peers.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.M{"name": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	// create unique index for group names
+	_, err = s.groups.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.M{"name": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	// create unique index for api key hashes
+	_, err = s.keys.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.M{"hash": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	// create index for listing audit entries by time
+	_, err = s.audit.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{Key: "time", Value: -1}}})
+	if err != nil {
+		return nil, err
+	}
+
+	// create indexes for reading usage of peers, groups and servers and for compacting it
+	_, err = s.usage.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "peerID", Value: 1}, {Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "groupID", Value: 1}, {Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "server", Value: 1}, {Key: "step", Value: 1}, {Key: "time", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// create index for reading archived periods of peers and groups
+	_, err = s.periods.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{Key: "targetID", Value: 1}, {Key: "start", Value: -1}}})
+	if err != nil {
+		return nil, err
+	}
+
+	// create indexes for the delivery log of webhooks and for retrying deliveries
+	_, err = s.deliveries.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "webhookID", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "server", Value: 1}, {Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// create ttl index for logs
+	_, err = s.logs.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// mongoError converts driver errors to storage errors
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
+	}
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) {
+		// change streams are only available on replica sets
+		if serverError.HasErrorCode(40573) {
+			return ErrWatchUnsupported
+		}
+		// InvalidResumeToken, ChangeStreamFatalError and ChangeStreamHistoryLost
+		if serverError.HasErrorCode(260) || serverError.HasErrorCode(280) || serverError.HasErrorCode(286) {
+			return ErrResumeTokenLost
+		}
+	}
+	return err
+}
+
+func (s *MongoStorage) GetPeers() ([]*Peer, error) {
+	var result []*Peer
+	cursor, err := s.peers.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetPeer(id string) (*Peer, error) {
+	var peer Peer
+	err := s.peers.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&peer)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &peer, nil
+}
+
+func (s *MongoStorage) GetPeerByAddress(address string) (*Peer, error) {
+	var peer Peer
+	err := s.peers.FindOne(context.TODO(), bson.M{"$or": []bson.M{{"allowedIPs": address}, {"allowedIPsV6": address}}}).Decode(&peer)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &peer, nil
+}
+
+// addressLockLease is how long a server holds the address lock at most, a server that dies while holding it
+// blocks address writes of the others for that long
+const addressLockLease = time.Second * 30
+
+// lockAddresses takes the lock document that serialises writes of addresses and routes of all servers,
+// so no two servers can both pass checkOverlap with prefixes that overlap each other.
+// It returns the function that releases the lock.
+// A server that holds the lock longer than the lease loses it, the unique indexes on allowedIPs and allowedIPsV6
+// still stop equal addresses then but overlapping routes could be written.
+func (s *MongoStorage) lockAddresses() (func(), error) {
+	holder := primitive.NewObjectID()
+	deadline := time.Now().Add(addressLockLease)
+	for {
+		now := time.Now()
+		lock := bson.M{"_id": "addresses", "holder": holder, "expiresAt": now.Add(addressLockLease)}
+		_, err := s.locks.InsertOne(context.TODO(), lock)
+		if mongo.IsDuplicateKeyError(err) {
+			// take over the lock if its lease ran out
+			var result *mongo.UpdateResult
+			result, err = s.locks.UpdateOne(context.TODO(), bson.M{"_id": "addresses", "expiresAt": bson.M{"$lt": now}}, bson.M{"$set": lock})
+			if err == nil && result.MatchedCount == 0 {
+				if now.After(deadline) {
+					return nil, errors.New("timed out waiting for address lock")
+				}
+				time.Sleep(time.Millisecond * 50)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			if _, err := s.locks.DeleteOne(context.TODO(), bson.M{"_id": "addresses", "holder": holder}); err != nil {
+				logger.Error(err.Error())
+			}
+		}, nil
+	}
+}
+
+// checkOverlap returns ErrOverlappingPrefix if addresses or routes of peer overlap those of other peers on database.
+// Unique indexes only catch equal addresses, so prefixes are compared here, the address lock must be held.
+func (s *MongoStorage) checkOverlap(peer *Peer) error {
+	var others []*Peer
+	cursor, err := s.peers.Find(context.TODO(), bson.M{"_id": bson.M{"$ne": peer.ID}}, options.Find().SetProjection(bson.M{"name": 1, "allowedIPs": 1, "allowedIPsV6": 1, "routes": 1}))
+	if err != nil {
+		return err
+	}
+	if err = cursor.All(context.TODO(), &others); err != nil {
+		return err
+	}
+	return checkPeerOverlap(peer, others)
+}
+
+func (s *MongoStorage) InsertPeer(peer *Peer) error {
+	unlock, err := s.lockAddresses()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err = s.checkOverlap(peer); err != nil {
+		return err
+	}
+	_, err = s.peers.InsertOne(context.TODO(), peer)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdatePeers(updates []PeerUpdate) error {
+	// hold the address lock from checking new addresses and routes until they are written
+	for _, u := range updates {
+		if changesAddresses(u.Set) {
+			unlock, err := s.lockAddresses()
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			break
+		}
+	}
+
+	var models []mongo.WriteModel
+	for _, u := range updates {
+		// check new addresses and routes against other peers
+		if changesAddresses(u.Set) {
+			peer, err := s.GetPeer(u.ID)
+			if err != nil {
+				return err
+			}
+			setAddressFields(peer, u.Set)
+			if err = s.checkOverlap(peer); err != nil {
+				return err
+			}
+		}
+		if u.SSI != nil {
+			// counters are written together with the server specific info entry that holds their baselines,
+			// so a crash can not save one without the other
+			set := bson.M{"serverSpecificInfo.$": u.SSI}
+			for k, v := range u.Set {
+				set[k] = v
+			}
+			// replace existing entry of this server
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": u.ID, "serverSpecificInfo.address": u.SSI.Address}).SetUpdate(
+				bson.M{"$set": set, "$inc": withVersion(u.Inc)},
+			))
+			// or add it if it does not exist
+			push := bson.M{"$push": bson.M{"serverSpecificInfo": u.SSI}, "$inc": withVersion(u.Inc)}
+			if len(u.Set) > 0 {
+				push["$set"] = u.Set
+			}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": u.ID, "serverSpecificInfo.address": bson.M{"$ne": u.SSI.Address}}).SetUpdate(push))
+		} else if len(u.Set) > 0 || len(u.Inc) > 0 {
+			update := bson.M{"$inc": withVersion(u.Inc)}
+			if len(u.Set) > 0 {
+				update["$set"] = u.Set
+			}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": u.ID}).SetUpdate(update))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := s.peers.BulkWrite(context.TODO(), models, &options.BulkWriteOptions{})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) DeletePeer(id string) error {
+	_, err := s.peers.DeleteOne(context.TODO(), bson.M{"_id": id})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) ResetServerSpecificInfo() error {
+	_, err := s.peers.UpdateMany(context.TODO(), bson.M{}, bson.M{"$set": bson.M{"serverSpecificInfo": []ServerSpecificInfo{}}, "$inc": withVersion(nil)})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) findGroups(filter bson.M) ([]*Group, error) {
+	result := []*Group{}
+	cursor, err := s.groups.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetGroups() ([]*Group, error) {
+	return s.findGroups(bson.M{})
+}
+
+func (s *MongoStorage) GetGroupsByOwnerID(ownerID string) ([]*Group, error) {
+	return s.findGroups(bson.M{"ownerID": ownerID})
+}
+
+func (s *MongoStorage) GetGroup(id primitive.ObjectID) (*Group, error) {
+	var group Group
+	err := s.groups.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&group)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &group, nil
+}
+
+func (s *MongoStorage) InsertGroup(group *Group) error {
+	_, err := s.groups.InsertOne(context.TODO(), group)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdateGroups(updates []GroupUpdate) error {
+	var models []mongo.WriteModel
+	for _, u := range updates {
+		update := bson.M{}
+		if len(u.Set) > 0 {
+			update["$set"] = u.Set
+		}
+		if len(u.Inc) > 0 {
+			update["$inc"] = u.Inc
+		}
+		if len(update) > 0 {
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": u.ID}).SetUpdate(update))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := s.groups.BulkWrite(context.TODO(), models, &options.BulkWriteOptions{})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) AddPeerToGroup(groupID primitive.ObjectID, peerID string) error {
+	_, err := s.groups.UpdateByID(context.TODO(), groupID, bson.M{"$push": bson.M{"peerIDs": peerID}})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) RemovePeerFromGroup(groupID primitive.ObjectID, peerID string) error {
+	_, err := s.groups.UpdateByID(context.TODO(), groupID, bson.M{"$pull": bson.M{"peerIDs": peerID}})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) DeleteGroup(id primitive.ObjectID) error {
+	_, err := s.groups.DeleteOne(context.TODO(), bson.M{"_id": id})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) InsertLog(l *Log) error {
+	_, err := s.logs.InsertOne(context.TODO(), l)
+	return err
+}
+
+func (s *MongoStorage) GetLogs() ([]Log, error) {
+	var logs []Log
+	cursor, err := s.logs.Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func (s *MongoStorage) findAPIKeys(filter bson.M) ([]*APIKey, error) {
+	result := []*APIKey{}
+	cursor, err := s.keys.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetAPIKeys() ([]*APIKey, error) {
+	return s.findAPIKeys(bson.M{})
+}
+
+func (s *MongoStorage) GetAPIKeysByOwnerID(ownerID string) ([]*APIKey, error) {
+	return s.findAPIKeys(bson.M{"ownerID": ownerID})
+}
+
+func (s *MongoStorage) findAPIKey(filter bson.M) (*APIKey, error) {
+	var key APIKey
+	err := s.keys.FindOne(context.TODO(), filter).Decode(&key)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &key, nil
+}
+
+func (s *MongoStorage) GetAPIKey(id primitive.ObjectID) (*APIKey, error) {
+	return s.findAPIKey(bson.M{"_id": id})
+}
+
+func (s *MongoStorage) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	return s.findAPIKey(bson.M{"hash": hash})
+}
+
+func (s *MongoStorage) InsertAPIKey(key *APIKey) error {
+	_, err := s.keys.InsertOne(context.TODO(), key)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdateAPIKey(id primitive.ObjectID, set map[string]interface{}) error {
+	_, err := s.keys.UpdateByID(context.TODO(), id, bson.M{"$set": set})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) InsertAudit(entry *AuditEntry) error {
+	_, err := s.audit.InsertOne(context.TODO(), entry)
+	return err
+}
+
+func (s *MongoStorage) GetAudit(filter AuditFilter) ([]AuditEntry, int64, error) {
+	query := bson.M{}
+	if filter.ActorID != "" {
+		query["actorID"] = filter.ActorID
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.TargetID != "" {
+		query["targetID"] = filter.TargetID
+	}
+	if filter.From != 0 || filter.To != 0 {
+		timeRange := bson.M{}
+		if filter.From != 0 {
+			timeRange["$gte"] = filter.From
+		}
+		if filter.To != 0 {
+			timeRange["$lt"] = filter.To
+		}
+		query["time"] = timeRange
+	}
+
+	total, err := s.audit.CountDocuments(context.TODO(), query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []AuditEntry{}
+	cursor, err := s.audit.Find(context.TODO(), query, options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetSkip(filter.Skip).SetLimit(filter.Limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = cursor.All(context.TODO(), &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+func (s *MongoStorage) AddUsage(buckets []*UsageBucket) error {
+	var models []mongo.WriteModel
+	for _, b := range buckets {
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": b.ID}).SetUpsert(true).SetUpdate(bson.M{
+			"$setOnInsert": bson.M{"peerID": b.PeerID, "groupID": b.GroupID, "server": b.Server, "step": b.Step, "time": b.Time},
+			"$inc":         bson.M{"tx": b.TX, "rx": b.RX},
+		}))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := s.usage.BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return mongoError(err)
+}
+
+func (s *MongoStorage) GetUsage(filter UsageFilter) ([]*UsageBucket, error) {
+	query := bson.M{"time": bson.M{"$gte": filter.From, "$lt": filter.To}}
+	if filter.PeerID != "" {
+		query["peerID"] = filter.PeerID
+	}
+	if !filter.GroupID.IsZero() {
+		query["groupID"] = filter.GroupID
+	}
+	if filter.Server != "" {
+		query["server"] = filter.Server
+	}
+
+	result := []*UsageBucket{}
+	cursor, err := s.usage.Find(context.TODO(), query, options.Find().SetSort(bson.D{{Key: "time", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) RollupUsage(server string, from string, to string, before int64) error {
+	query := bson.M{"server": server, "step": from, "time": bson.M{"$lt": before}}
+	var buckets []*UsageBucket
+	cursor, err := s.usage.Find(context.TODO(), query)
+	if err != nil {
+		return err
+	}
+	if err = cursor.All(context.TODO(), &buckets); err != nil {
+		return err
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	// add sums to buckets of step to, they may already hold sums of an earlier rollup that ended inside them
+	err = s.AddUsage(rollupBuckets(buckets, to))
+	if err != nil {
+		return err
+	}
+
+	// remove only the buckets that were added up
+	ids := make([]string, len(buckets))
+	for i, b := range buckets {
+		ids[i] = b.ID
+	}
+	_, err = s.usage.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) DeleteUsage(server string, step string, before int64) error {
+	_, err := s.usage.DeleteMany(context.TODO(), bson.M{"server": server, "step": step, "time": bson.M{"$lt": before}})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) ArchivePeriod(archive *PeriodArchive) error {
+	_, err := s.periods.ReplaceOne(context.TODO(), bson.M{"_id": archive.ID}, archive, options.Replace().SetUpsert(true))
+	return mongoError(err)
+}
+
+func (s *MongoStorage) GetPeriodArchives(targetID string) ([]*PeriodArchive, error) {
+	result := []*PeriodArchive{}
+	cursor, err := s.periods.Find(context.TODO(), bson.M{"targetID": targetID}, options.Find().SetSort(bson.D{{Key: "start", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetWebhooks() ([]*Webhook, error) {
+	result := []*Webhook{}
+	cursor, err := s.webhooks.Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetWebhook(id primitive.ObjectID) (*Webhook, error) {
+	var webhook Webhook
+	err := s.webhooks.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&webhook)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &webhook, nil
+}
+
+func (s *MongoStorage) InsertWebhook(webhook *Webhook) error {
+	_, err := s.webhooks.InsertOne(context.TODO(), webhook)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdateWebhook(id primitive.ObjectID, set map[string]interface{}) error {
+	_, err := s.webhooks.UpdateByID(context.TODO(), id, bson.M{"$set": set})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) DeleteWebhook(id primitive.ObjectID) error {
+	_, err := s.webhooks.DeleteOne(context.TODO(), bson.M{"_id": id})
+	if err != nil {
+		return mongoError(err)
+	}
+	_, err = s.deliveries.DeleteMany(context.TODO(), bson.M{"webhookID": id})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) GetProfiles() ([]*ConfigProfile, error) {
+	result := []*ConfigProfile{}
+	cursor, err := s.profiles.Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetProfile(id primitive.ObjectID) (*ConfigProfile, error) {
+	var profile ConfigProfile
+	err := s.profiles.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&profile)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &profile, nil
+}
+
+func (s *MongoStorage) InsertProfile(profile *ConfigProfile) error {
+	_, err := s.profiles.InsertOne(context.TODO(), profile)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdateProfile(id primitive.ObjectID, set map[string]interface{}) error {
+	_, err := s.profiles.UpdateByID(context.TODO(), id, bson.M{"$set": set})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) DeleteProfile(id primitive.ObjectID) error {
+	_, err := s.profiles.DeleteOne(context.TODO(), bson.M{"_id": id})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) InsertDelivery(delivery *WebhookDelivery) error {
+	_, err := s.deliveries.InsertOne(context.TODO(), delivery)
+	return mongoError(err)
+}
+
+func (s *MongoStorage) UpdateDelivery(id primitive.ObjectID, set map[string]interface{}) error {
+	_, err := s.deliveries.UpdateByID(context.TODO(), id, bson.M{"$set": set})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) GetDelivery(id primitive.ObjectID) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := s.deliveries.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&delivery)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &delivery, nil
+}
+
+func (s *MongoStorage) findDeliveries(filter bson.M, opts *options.FindOptions) ([]*WebhookDelivery, error) {
+	result := []*WebhookDelivery{}
+	cursor, err := s.deliveries.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(context.TODO(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *MongoStorage) GetDeliveries(webhookID primitive.ObjectID) ([]*WebhookDelivery, error) {
+	return s.findDeliveries(bson.M{"webhookID": webhookID}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(100))
+}
+
+func (s *MongoStorage) GetPendingDeliveries(server string, before int64) ([]*WebhookDelivery, error) {
+	return s.findDeliveries(bson.M{"server": server, "status": deliveryPending, "nextAttemptAt": bson.M{"$lte": before}}, options.Find().SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}))
+}
+
+func (s *MongoStorage) DeleteDeliveries(before int64) error {
+	_, err := s.deliveries.DeleteMany(context.TODO(), bson.M{"createdAt": bson.M{"$lt": before}})
+	return mongoError(err)
+}
+
+func (s *MongoStorage) WatchPeers(ctx context.Context, resumeToken []byte, startAt time.Time, fn func(*PeerChange)) error {
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(bson.Raw(resumeToken))
+	} else {
+		opts.SetStartAtOperationTime(&primitive.Timestamp{T: uint32(startAt.Unix())})
+	}
+
+	// create change stream
+	changeStream, err := s.peers.Watch(ctx, mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.M{"$in": bson.A{"insert", "update", "delete"}}}}}}}, opts)
+	if err != nil {
+		return mongoError(err)
+	}
+	defer changeStream.Close(context.TODO())
+
+	// loop over changes
+	for changeStream.Next(ctx) {
+		// parse change
+		var data struct {
+			OperationType string `bson:"operationType"`
+			DocumentKey   struct {
+				ID string `bson:"_id"`
+			} `bson:"documentKey"`
+			FullDocument      *Peer `bson:"fullDocument"`
+			UpdateDescription struct {
+				UpdatedFields map[string]interface{} `bson:"updatedFields"`
+			} `bson:"updateDescription"`
+		}
+		if err = changeStream.Decode(&data); err != nil {
+			// skip changes that can not be parsed instead of stopping
+			logger.Error(err.Error())
+			continue
+		}
+
+		fn(&PeerChange{
+			OperationType: data.OperationType,
+			ID:            data.DocumentKey.ID,
+			FullDocument:  data.FullDocument,
+			UpdatedFields: data.UpdateDescription.UpdatedFields,
+			ResumeToken:   changeStream.ResumeToken(),
+		})
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return mongoError(changeStream.Err())
+}
+
+func (s *MongoStorage) GetResumeToken(server string) ([]byte, error) {
+	var data struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := s.tokens.FindOne(context.TODO(), bson.M{"_id": server}).Decode(&data)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data.Token, nil
+}
+
+func (s *MongoStorage) SetResumeToken(server string, token []byte) error {
+	_, err := s.tokens.UpdateByID(context.TODO(), server, bson.M{"$set": bson.M{"token": bson.Raw(token)}}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStorage) Close() error {
+	return s.client.Disconnect(context.TODO())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// events of notifications
+const (
+	eventUsageWarning  = "usage.warning"
+	eventExpiryWarning = "expiry.warning"
+	eventPeerDisabled  = "peer.disabled"
+	eventPeerEnabled   = "peer.enabled"
+)
+
+// Notification tells a peer and its owner about something that happened to the peer
+type Notification struct {
+	Event     string `json:"Event"`
+	PeerID    string `json:"PeerID"`
+	PeerName  string `json:"PeerName"`
+	OwnerID   string `json:"OwnerID"`
+	Threshold int    `json:"Threshold"` // percent of allowed usage or days before expiry of warnings
+	Message   string `json:"Message"`
+	Time      int64  `json:"Time"`
+}
+
+// Notifier delivers notifications to a channel, Notify may be called concurrently
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+var notifiers = []Notifier{logNotifier{}, webhookNotifier{}} // channels every notification is delivered to
+
+// notify delivers n to every channel without blocking the caller
+func notify(n *Notification) {
+	go func() {
+		for _, notifier := range notifiers {
+			if err := notifier.Notify(n); err != nil {
+				logger.Error(err.Error(), slog.String("peer", n.PeerName))
+			}
+		}
+	}()
+}
+
+// logNotifier writes notifications to logs
+type logNotifier struct{}
+
+func (logNotifier) Notify(n *Notification) error {
+	logger.Warn(n.Message, slog.String("peer", n.PeerName), slog.String("event", n.Event))
+	return nil
+}
+
+// formatBytes formats n with a binary unit for messages
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
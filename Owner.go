@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// canAccessPeer checks if peer can read and manage p, peers can access themselves and peers they own
+func canAccessPeer(peer *Peer, p *Peer) bool {
+	return hasPermission(peer, PermAllPeers) || p.ID == peer.ID || (p.OwnerID != "" && p.OwnerID == peer.ID)
+}
+
+// canAccessGroup checks if peer can read and manage g
+func canAccessGroup(peer *Peer, g *Group) bool {
+	return hasPermission(peer, PermAllGroups) || (g.OwnerID != "" && g.OwnerID == peer.ID)
+}
+
+// migratePeerOwners assigns peers without an owner to the distributor with the same name prefix, or to an admin if there is none.
+// It follows the old rule based on role names.
+func migratePeerOwners() {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	var distributors, admins []*Peer
+	for _, p := range peers.peers {
+		if p.Role == "distributor" {
+			distributors = append(distributors, p)
+		} else if p.Role == "admin" {
+			admins = append(admins, p)
+		}
+	}
+
+	// sort so the same owner is picked on every run
+	byName := func(a, b *Peer) int { return strings.Compare(a.Name, b.Name) }
+	slices.SortFunc(distributors, byName)
+	slices.SortFunc(admins, byName)
+
+	var updates []PeerUpdate
+	for _, p := range peers.peers {
+		if p.OwnerID != "" {
+			continue
+		}
+
+		var owner *Peer
+		prefix := strings.Split(p.Name, "-")[0]
+		if p.Role != "admin" && p.Role != "distributor" {
+			for _, d := range distributors {
+				if strings.Split(d.Name, "-")[0] == prefix {
+					owner = d
+					break
+				}
+			}
+		}
+		if owner == nil && len(admins) > 0 && admins[0] != p {
+			owner = admins[0]
+		}
+		if owner == nil {
+			continue
+		}
+
+		p.OwnerID = owner.ID
+		updates = append(updates, PeerUpdate{ID: p.ID, Set: map[string]interface{}{"ownerID": owner.ID}})
+		logger.Info("Assigned owner "+owner.Name, slog.String("peer", p.Name))
+	}
+
+	if len(updates) > 0 {
+		if e := store.UpdatePeers(updates); e != nil {
+			logger.Error(e.Error())
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"net"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type Peer struct {
 	ID                 string                `json:"ID" bson:"_id"`
@@ -8,11 +12,17 @@ type Peer struct {
 	Name               string                `json:"Name" bson:"name"`
 	PreferredEndpoint  string                `json:"PreferredEndpoint" bson:"preferredEndpoint"`
 	AllowedIPs         string                `json:"AllowedIPs" bson:"allowedIPs"`
+	AllowedIPsV6       string                `json:"AllowedIPsV6" bson:"allowedIPsV6,omitempty"` // empty when no ipv6 pool is configured
+	Routes             []string              `json:"Routes" bson:"routes,omitempty"`             // subnets routed to this peer, like the network of a branch office
 	PublicKey          string                `json:"PublicKey" bson:"publicKey"`
 	PrivateKey         string                `json:"PrivateKey" bson:"privateKey"`
 	Disabled           bool                  `json:"Disabled" bson:"disabled"`
 	AllowedUsage       int64                 `json:"AllowedUsage" bson:"allowedUsage"`
 	ExpiresAt          int64                 `json:"ExpiresAt" bson:"expiresAt"`
+	OverQuota          string                `json:"OverQuota" bson:"overQuota"` // disable(default) or throttle when usage exceeds allowed usage
+	Throttled          bool                  `json:"Throttled" bson:"-"`         // slowed down on this server because of the over quota policy
+	RateLimit          Rate                  `json:"RateLimit" bson:"rateLimit"` // speed of the peer's plan
+	Warnings           map[string]int64      `json:"Warnings" bson:"warnings"`   // time each usage or expiry warning was sent, removed when the peer is back under its threshold
 	Endpoint           string                `json:"-" bson:"-"`
 	LastHandshakeTime  string                `json:"-" bson:"-"`
 	TempTX             int64                 `json:"-" bson:"-"`
@@ -24,6 +34,16 @@ type Peer struct {
 	ServerSpecificInfo []*ServerSpecificInfo `json:"ServerSpecificInfo" bson:"serverSpecificInfo"`
 	TelegramChatID     int64                 `json:"TelegramChatID" bson:"telegramChatID"`
 	GroupID            primitive.ObjectID    `json:"GroupID" bson:"groupID"`
+	OwnerID            string                `json:"OwnerID" bson:"ownerID"` // peer that created this peer, only admins and the owner can manage it
+	Budget             *Budget               `json:"Budget" bson:"budget"`   // limits peers created by this distributor and everyone below it, nil means no limit of its own
+	Period             *QuotaPeriod          `json:"Period" bson:"period"`   // renews allowed usage every period, nil means allowed usage is a lifetime limit
+	Version            int64                 `json:"Version" bson:"version"` // incremented on every update
+	PasswordHash       string                `json:"-" bson:"passwordHash"`
+	TokensRevokedAt    int64                 `json:"-" bson:"tokensRevokedAt"`    // session tokens issued before this are rejected
+	ProfileID          primitive.ObjectID    `json:"ProfileID" bson:"profileID"`  // config profile of the peer and of peers below it, zero means none
+	TelegramLinkHash   string                `json:"-" bson:"telegramLinkHash"`   // hash of the single use token of the telegram start link, empty if there is none
+	TelegramLinkExpiry int64                 `json:"-" bson:"telegramLinkExpiry"` // the start link can not be used after this
+	TelegramRelink     bool                  `json:"-" bson:"telegramRelink"`     // the start link may replace the chat the peer is linked to
 }
 
 type ServerSpecificInfo struct {
@@ -32,6 +52,25 @@ type ServerSpecificInfo struct {
 	Endpoint          string `json:"Endpoint" bson:"endpoint"`
 	CurrentTX         int64  `json:"CurrentTX" bson:"currentTX"`
 	CurrentRX         int64  `json:"CurrentRX" bson:"currentRX"`
+	BaselineTX        int64  `json:"-" bson:"baselineTX"`     // transmit counter of device that is already counted in totalTX
+	BaselineRX        int64  `json:"-" bson:"baselineRX"`     // receive counter of device that is already counted in totalRX
+	InterfaceIndex    int    `json:"-" bson:"interfaceIndex"` // index of the interface the baselines were read from
+}
+
+// AllowedIPNets returns the networks that should be set as allowed ips of peer on device
+func (peer *Peer) AllowedIPNets() ([]net.IPNet, error) {
+	var ipNets []net.IPNet
+	for _, s := range append([]string{peer.AllowedIPs, peer.AllowedIPsV6}, peer.Routes...) {
+		if s == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, *ipNet)
+	}
+	return ipNets, nil
 }
 
 func (peer *Peer) FindSSIByAddress(address string) *ServerSpecificInfo {
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// lengths of quota periods
+const (
+	periodDaily   = "daily"
+	periodWeekly  = "weekly"
+	periodMonthly = "monthly"
+)
+
+// QuotaPeriod makes the allowed usage of a peer or group renew at the end of every period
+type QuotaPeriod struct {
+	Length    string `json:"Length" bson:"length"`       // daily, weekly or monthly
+	Anchor    int    `json:"Anchor" bson:"anchor"`       // weekday periods start on (0 is sunday) or day of month, the last day is used in shorter months
+	Quota     int64  `json:"Quota" bson:"quota"`         // usage allowed in each period
+	CarryOver bool   `json:"CarryOver" bson:"carryOver"` // add unused usage of a period to the next one, at most one quota is carried
+	Start     int64  `json:"Start" bson:"start"`         // start of the current period in milliseconds
+	End       int64  `json:"End" bson:"end"`             // end of the current period in milliseconds, exclusive
+}
+
+// PeriodArchive is the final usage of a peer or group in a period that ended
+type PeriodArchive struct {
+	ID           string `json:"ID" bson:"_id"` // made from target and start so archiving a period twice overwrites it
+	TargetType   string `json:"TargetType" bson:"targetType"`
+	TargetID     string `json:"TargetID" bson:"targetID"`
+	TargetName   string `json:"TargetName" bson:"targetName"`
+	Start        int64  `json:"Start" bson:"start"`
+	End          int64  `json:"End" bson:"end"`
+	AllowedUsage int64  `json:"AllowedUsage" bson:"allowedUsage"`
+	TotalTX      int64  `json:"TotalTX" bson:"totalTX"`
+	TotalRX      int64  `json:"TotalRX" bson:"totalRX"`
+	CarriedOver  int64  `json:"CarriedOver" bson:"carriedOver"` // unused usage added to the next period
+}
+
+// anchorDate returns the anchor day of month of year and month at midnight in utc
+func anchorDate(year int, month time.Month, anchor int) time.Time {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	return time.Date(year, month, min(anchor, last), 0, 0, 0, 0, time.UTC)
+}
+
+// bounds returns start and end of the period of length and anchor that contains t
+func (period *QuotaPeriod) bounds(t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period.Length {
+	case periodWeekly:
+		start := day.AddDate(0, 0, -((int(day.Weekday()) - period.Anchor + 7) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case periodMonthly:
+		start := anchorDate(t.Year(), t.Month(), period.Anchor)
+		if t.Before(start) {
+			start = anchorDate(t.Year(), t.Month()-1, period.Anchor)
+		}
+		return start, anchorDate(start.Year(), start.Month()+1, period.Anchor)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
+}
+
+// validate checks length, anchor and quota of period
+func (period *QuotaPeriod) validate() error {
+	switch period.Length {
+	case periodDaily:
+		period.Anchor = 0
+	case periodWeekly:
+		if period.Anchor < 0 || period.Anchor > 6 {
+			return errors.New("anchor of weekly periods must be a weekday from 0 (sunday) to 6")
+		}
+	case periodMonthly:
+		if period.Anchor < 1 || period.Anchor > 31 {
+			return errors.New("anchor of monthly periods must be a day of month from 1 to 31")
+		}
+	default:
+		return fmt.Errorf("unknown period length %q, must be daily, weekly or monthly", period.Length)
+	}
+	if period.Quota < 0 {
+		return errors.New("quota can not be negative")
+	}
+	return nil
+}
+
+// next returns the period that contains t with the same settings
+func (period *QuotaPeriod) next(t time.Time) *QuotaPeriod {
+	result := *period
+	start, end := period.bounds(t)
+	result.Start, result.End = start.UnixMilli(), end.UnixMilli()
+	return &result
+}
+
+// carriedOver returns unused usage of a period that is added to the next one
+func (period *QuotaPeriod) carriedOver(allowedUsage int64, used int64) int64 {
+	if !period.CarryOver {
+		return 0
+	}
+	return min(max(allowedUsage-used, 0), period.Quota)
+}
+
+// decodePeriod converts a period from change streams and updated fields
+func decodePeriod(v interface{}) (*QuotaPeriod, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if period, ok := v.(*QuotaPeriod); ok {
+		return period, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var period QuotaPeriod
+	if err = bson.Unmarshal(b, &period); err != nil {
+		return nil, err
+	}
+	return &period, nil
+}
+
+// rollPeriods starts new periods of peers and groups whose period ended, only the main server does this
+func rollPeriods() {
+	if !config.IsMainServer {
+		return
+	}
+	for {
+		now := time.Now()
+		rollPeerPeriods(now)
+		rollGroupPeriods(now)
+		time.Sleep(time.Minute)
+	}
+}
+
+// renewalFits checks if owners of peers have budget for the allowed usage of their next period, peers.mu must not be held
+func renewalFits(deltas map[string]Budget) bool {
+	err := checkBudget(deltas)
+	if err != nil && !errors.Is(err, ErrBudgetExceeded) {
+		logger.Error(err.Error())
+	}
+	return err == nil
+}
+
+// rollPeerPeriods archives ended periods of peers and starts their next period, peers in a group follow the period of the group
+func rollPeerPeriods(now time.Time) {
+	peers.mu.RLock()
+	var due []Peer
+	for _, p := range peers.peers {
+		if p.Period != nil && p.GroupID.IsZero() && now.UnixMilli() >= p.Period.End {
+			due = append(due, *p)
+		}
+	}
+	peers.mu.RUnlock()
+
+	for _, p := range due {
+		next := p.Period.next(now)
+		carried := p.Period.carriedOver(p.AllowedUsage, p.TotalTX+p.TotalRX)
+		allowedUsage := next.Quota + carried
+
+		// allowed usage lowered during the period freed budget that may have been handed out since,
+		// so the renewal is checked even without carry over
+		budgetMu.Lock()
+		if !renewalFits(map[string]Budget{p.OwnerID: {TotalBytes: allowedUsage - p.AllowedUsage}}) {
+			carried = 0
+			if renewalFits(map[string]Budget{p.OwnerID: {TotalBytes: next.Quota - p.AllowedUsage}}) {
+				logger.Warn("Unused usage not carried over, budget exceeded", slog.String("peer", p.Name))
+				allowedUsage = next.Quota
+			} else {
+				logger.Warn("Allowed usage kept instead of renewed, budget exceeded", slog.String("peer", p.Name))
+				allowedUsage = p.AllowedUsage
+			}
+		}
+
+		err := store.ArchivePeriod(&PeriodArchive{
+			ID: fmt.Sprintf("peer/%s/%d", p.ID, p.Period.Start), TargetType: "peer", TargetID: p.ID, TargetName: p.Name,
+			Start: p.Period.Start, End: p.Period.End, AllowedUsage: p.AllowedUsage, TotalTX: p.TotalTX, TotalRX: p.TotalRX, CarriedOver: carried,
+		})
+		if err != nil {
+			budgetMu.Unlock()
+			logger.Error(err.Error(), slog.String("peer", p.Name))
+			continue
+		}
+
+		// subtract the archived usage instead of setting zero so traffic counted meanwhile is kept
+		err = store.UpdatePeers([]PeerUpdate{{
+			ID:  p.ID,
+			Set: map[string]interface{}{"allowedUsage": allowedUsage, "period": next},
+			Inc: map[string]int64{"totalTX": -p.TotalTX, "totalRX": -p.TotalRX},
+		}})
+		if err != nil {
+			budgetMu.Unlock()
+			logger.Error(err.Error(), slog.String("peer", p.Name))
+			continue
+		}
+
+		// totals in local map are updated when the change is synced
+		peers.mu.Lock()
+		if local, ok := peers.peers[p.ID]; ok {
+			local.AllowedUsage = allowedUsage
+			local.Period = next
+		}
+		peers.mu.Unlock()
+		budgetMu.Unlock()
+
+		logger.Info("Period renewed", slog.String("peer", p.Name))
+	}
+}
+
+// rollGroupPeriods archives ended periods of groups and starts their next period for the group and its peers
+func rollGroupPeriods(now time.Time) {
+	groups, err := store.GetGroups()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	for _, g := range groups {
+		if g.Period == nil || now.UnixMilli() < g.Period.End {
+			continue
+		}
+		next := g.Period.next(now)
+		carried := g.Period.carriedOver(g.AllowedUsage, g.TotalTX+g.TotalRX)
+
+		budgetMu.Lock()
+
+		// every peer of the group gets the allowed usage of the group
+		peers.mu.RLock()
+		var members []Peer
+		for _, peerID := range g.PeerIDs {
+			if p, ok := peers.peers[peerID]; ok {
+				members = append(members, *p)
+			}
+		}
+		peers.mu.RUnlock()
+		deltas := func(allowedUsage int64) map[string]Budget {
+			result := make(map[string]Budget)
+			for _, p := range members {
+				result[p.OwnerID] = result[p.OwnerID].Add(Budget{TotalBytes: allowedUsage - p.AllowedUsage})
+			}
+			return result
+		}
+
+		// allowed usage lowered during the period freed budget that may have been handed out since,
+		// so the renewal is checked even without carry over and members keep their allowed usage if it does not fit
+		allowedUsage := next.Quota + carried
+		renew := true
+		if !renewalFits(deltas(allowedUsage)) {
+			carried = 0
+			if renewalFits(deltas(next.Quota)) {
+				logger.Warn("Unused usage not carried over, budget exceeded", slog.String("group", g.Name))
+				allowedUsage = next.Quota
+			} else {
+				logger.Warn("Allowed usage kept instead of renewed, budget exceeded", slog.String("group", g.Name))
+				allowedUsage = g.AllowedUsage
+				renew = false
+			}
+		}
+
+		err = store.ArchivePeriod(&PeriodArchive{
+			ID: fmt.Sprintf("group/%s/%d", g.ID.Hex(), g.Period.Start), TargetType: "group", TargetID: g.ID.Hex(), TargetName: g.Name,
+			Start: g.Period.Start, End: g.Period.End, AllowedUsage: g.AllowedUsage, TotalTX: g.TotalTX, TotalRX: g.TotalRX, CarriedOver: carried,
+		})
+		if err != nil {
+			budgetMu.Unlock()
+			logger.Error(err.Error(), slog.String("group", g.Name))
+			continue
+		}
+
+		err = store.UpdateGroups([]GroupUpdate{{
+			ID:  g.ID,
+			Set: map[string]interface{}{"allowedUsage": allowedUsage, "period": next},
+			Inc: map[string]int64{"totalTX": -g.TotalTX, "totalRX": -g.TotalRX},
+		}})
+		if err != nil {
+			budgetMu.Unlock()
+			logger.Error(err.Error(), slog.String("group", g.Name))
+			continue
+		}
+
+		var peerUpdates []PeerUpdate
+		for _, p := range members {
+			update := PeerUpdate{ID: p.ID, Set: map[string]interface{}{}, Inc: map[string]int64{"totalTX": -p.TotalTX, "totalRX": -p.TotalRX}}
+			if renew {
+				update.Set["allowedUsage"] = allowedUsage
+			}
+			peerUpdates = append(peerUpdates, update)
+		}
+		if len(peerUpdates) > 0 {
+			err = store.UpdatePeers(peerUpdates)
+			if err != nil {
+				budgetMu.Unlock()
+				logger.Error(err.Error(), slog.String("group", g.Name))
+				continue
+			}
+		}
+
+		if renew {
+			peers.mu.Lock()
+			for _, p := range members {
+				if local, ok := peers.peers[p.ID]; ok {
+					local.AllowedUsage = allowedUsage
+				}
+			}
+			peers.mu.Unlock()
+		}
+		budgetMu.Unlock()
+
+		logger.Info("Period renewed", slog.String("group", g.Name))
+	}
+}
+
+// decodeNewPeriod reads a period from the request body and starts its current period
+func decodeNewPeriod(ctx echo.Context) (*QuotaPeriod, error) {
+	var period QuotaPeriod
+	err := json.NewDecoder(ctx.Request().Body).Decode(&period)
+	if err != nil {
+		return nil, err
+	}
+	if err = period.validate(); err != nil {
+		return nil, err
+	}
+	return period.next(time.Now()), nil
+}
+
+func PutPeerPeriod(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	// peers can not renew their own usage
+	if !canAccessPeer(peer, p) || (p.ID == peer.ID && !hasPermission(peer, PermAllPeers)) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+	if !p.GroupID.IsZero() {
+		return ctx.String(400, "peer is in a group, set the period of the group instead")
+	}
+
+	period, err := decodeNewPeriod(ctx)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// the quota replaces the allowed usage of the peer
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(map[string]Budget{p.OwnerID: peerCost(period.Quota, p.ExpiresAt).Sub(peerCost(p.AllowedUsage, p.ExpiresAt))})
+	if err != nil {
+		return ctx.String(403, err.Error())
+	}
+
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"period": period, "allowedUsage": period.Quota}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	audit(ctx, "peer.period", "peer", p.ID, p.Name, map[string]AuditChange{
+		"period": {Before: p.Period, After: period}, "allowedUsage": {Before: p.AllowedUsage, After: period.Quota},
+	})
+
+	peers.mu.Lock()
+	p.Period = period
+	p.AllowedUsage = period.Quota
+	peers.mu.Unlock()
+
+	logger.Info("Period changed by "+peer.Name, slog.String("peer", p.Name))
+
+	return ctx.NoContent(200)
+}
+
+func DeletePeerPeriod(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, p) || (p.ID == peer.ID && !hasPermission(peer, PermAllPeers)) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+	if p.Period == nil {
+		return ctx.NoContent(200)
+	}
+
+	// allowed usage of the current period stays as a lifetime limit
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"period": nil}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	audit(ctx, "peer.period", "peer", p.ID, p.Name, map[string]AuditChange{"period": {Before: p.Period, After: nil}})
+
+	peers.mu.Lock()
+	p.Period = nil
+	peers.mu.Unlock()
+
+	logger.Info("Period removed by "+peer.Name, slog.String("peer", p.Name))
+
+	return ctx.NoContent(200)
+}
+
+func GetPeerPeriods(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+
+	archives, err := store.GetPeriodArchives(p.ID)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	return ctx.JSON(200, archives)
+}
+
+func PutGroupPeriod(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if group exists
+	group, err := store.GetGroup(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
+	}
+
+	period, err := decodeNewPeriod(ctx)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// the quota replaces the allowed usage of the group and its peers
+	deltas := make(map[string]Budget)
+	for _, peerID := range group.PeerIDs {
+		p, ok := peers.peers[peerID]
+		if !ok {
+			continue
+		}
+		deltas[p.OwnerID] = deltas[p.OwnerID].Add(peerCost(period.Quota, p.ExpiresAt).Sub(peerCost(p.AllowedUsage, p.ExpiresAt)))
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	err = checkBudget(deltas)
+	if err != nil {
+		return ctx.String(403, err.Error())
+	}
+
+	err = store.UpdateGroups([]GroupUpdate{{ID: group.ID, Set: map[string]interface{}{"period": period, "allowedUsage": period.Quota}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	var peerUpdates []PeerUpdate
+	for _, peerID := range group.PeerIDs {
+		peerUpdates = append(peerUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"allowedUsage": period.Quota}})
+		peers.mu.Lock()
+		if p, ok := peers.peers[peerID]; ok {
+			p.AllowedUsage = period.Quota
+		}
+		peers.mu.Unlock()
+	}
+	if len(peerUpdates) > 0 {
+		err = store.UpdatePeers(peerUpdates)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", peer.Name))
+			return ctx.String(500, err.Error())
+		}
+	}
+
+	audit(ctx, "group.period", "group", group.ID.Hex(), group.Name, map[string]AuditChange{
+		"period": {Before: group.Period, After: period}, "allowedUsage": {Before: group.AllowedUsage, After: period.Quota},
+	})
+
+	return ctx.NoContent(200)
+}
+
+func DeleteGroupPeriod(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if group exists
+	group, err := store.GetGroup(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	// check write rights
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
+	}
+	if group.Period == nil {
+		return ctx.NoContent(200)
+	}
+
+	err = store.UpdateGroups([]GroupUpdate{{ID: group.ID, Set: map[string]interface{}{"period": nil}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	audit(ctx, "group.period", "group", group.ID.Hex(), group.Name, map[string]AuditChange{"period": {Before: group.Period, After: nil}})
+
+	return ctx.NoContent(200)
+}
+
+func GetGroupPeriods(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if group exists
+	group, err := store.GetGroup(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
+	}
+
+	archives, err := store.GetPeriodArchives(group.ID.Hex())
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	return ctx.JSON(200, archives)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// permissions that can be given to roles, * gives all of them
+const (
+	PermAllPeers       = "peers:all"           // see and manage every peer, not only owned ones
+	PermCreatePeer     = "peers:create"        // create peers
+	PermUpdatePeer     = "peers:update"        // change name and endpoint of peers
+	PermDeletePeer     = "peers:delete"        // delete peers
+	PermStaticAddress  = "peers:staticAddress" // choose the address of new peers instead of getting one from the pool
+	PermManageRoutes   = "peers:routes"        // attach routed subnets to peers
+	PermResetUsage     = "peers:resetUsage"    // reset usage of peers and groups
+	PermChangeUsage    = "peers:changeUsage"   // change allowed usage of peers and groups
+	PermChangeExpiry   = "peers:changeExpiry"  // change expiry of peers and groups
+	PermChangeRate     = "peers:changeRate"    // change rate limits of peers and groups
+	PermChangeRole     = "peers:changeRole"    // change roles of peers to roles with no more permissions than the caller
+	PermChangeOwner    = "peers:changeOwner"   // move peers to another owner
+	PermManageGroups   = "groups:manage"       // create, change and delete owned groups
+	PermAllGroups      = "groups:all"          // see and manage every group
+	PermManageBudgets  = "budgets:manage"      // see and give out budgets to owned resellers
+	PermUnlimited      = "budgets:unlimited"   // not limited by any budget
+	PermViewLogs       = "logs:read"           // read logs and drift reports
+	PermViewAudit      = "audit:read"          // read the audit trail
+	PermAllKeys        = "keys:all"            // see and revoke api keys of every peer
+	PermLogin          = "account:login"       // log in with a password outside the tunnel
+	PermManageWebhooks = "webhooks:manage"     // create, change and delete webhooks and see their deliveries
+	PermManageProfiles = "profiles:manage"     // create, change and delete config profiles
+)
+
+var permissions = []string{
+	PermAllPeers, PermCreatePeer, PermUpdatePeer, PermDeletePeer, PermStaticAddress, PermManageRoutes, PermResetUsage, PermChangeUsage, PermChangeExpiry, PermChangeRate, PermChangeRole,
+	PermChangeOwner, PermManageGroups, PermAllGroups, PermManageBudgets, PermUnlimited, PermViewLogs, PermViewAudit, PermAllKeys, PermLogin, PermManageWebhooks,
+	PermManageProfiles,
+}
+
+// defaultRole is given to new peers when no role is requested
+const defaultRole = "user"
+
+// roles that exist when they are not overridden in config
+var defaultRoles = map[string][]string{
+	"admin": {"*"},
+	"distributor": {
+		PermCreatePeer, PermUpdatePeer, PermDeletePeer, PermResetUsage, PermChangeUsage, PermChangeExpiry, PermChangeRate, PermChangeRole,
+		PermManageGroups, PermManageBudgets, PermLogin,
+	},
+	"user": {},
+}
+
+var roles map[string][]string // permissions of every role
+
+// loadRoles merges roles from config with default roles and checks their permissions
+func loadRoles() error {
+	roles = make(map[string][]string, len(defaultRoles)+len(config.Roles))
+	for role, perms := range defaultRoles {
+		roles[role] = perms
+	}
+	for role, perms := range config.Roles {
+		for _, perm := range perms {
+			if perm != "*" && !slices.Contains(permissions, perm) {
+				return fmt.Errorf("unknown permission %s in role %s", perm, role)
+			}
+		}
+		roles[role] = perms
+	}
+	return nil
+}
+
+// hasPermission checks if the role of peer has perm
+func hasPermission(peer *Peer, perm string) bool {
+	perms := roles[peer.Role]
+	return slices.Contains(perms, "*") || slices.Contains(perms, perm)
+}
+
+// canGrantRole checks if role exists and peer has every permission of it
+func canGrantRole(peer *Peer, role string) bool {
+	perms, ok := roles[role]
+	if !ok {
+		return false
+	}
+	if slices.Contains(roles[peer.Role], "*") {
+		return true
+	}
+	for _, perm := range perms {
+		if perm == "*" || !hasPermission(peer, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequirePermission rejects requests from peers whose role is missing any of perms
+func RequirePermission(perms ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			peer := ctx.Get("peer").(*Peer)
+			for _, perm := range perms {
+				if !hasPermission(peer, perm) {
+					return ctx.NoContent(403)
+				}
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func GetRoles(ctx echo.Context) error {
+	return ctx.JSON(200, roles)
+}
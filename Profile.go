@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ConfigProfile holds client config settings that can be given to a peer, a group or a distributor.
+// Empty fields are taken from the next profile, from peer to group to owners to the global settings in config.
+type ConfigProfile struct {
+	ID         primitive.ObjectID `json:"ID" bson:"_id"`
+	Name       string             `json:"Name" bson:"name"`
+	DNS        []string           `json:"DNS" bson:"dns"`
+	MTU        int                `json:"MTU" bson:"mtu"`               // 0 inherits
+	Keepalive  int                `json:"Keepalive" bson:"keepalive"`   // seconds between keepalives, 0 inherits
+	Tunnel     string             `json:"Tunnel" bson:"tunnel"`         // full or split, empty inherits
+	AllowedIPs []string           `json:"AllowedIPs" bson:"allowedIPs"` // traffic sent through the tunnel, overrides tunnel of this and less specific profiles
+	Endpoints  []string           `json:"Endpoints" bson:"endpoints"`   // endpoints clients may use, the first one is the default
+	CreatedAt  int64              `json:"CreatedAt" bson:"createdAt"`
+}
+
+// profileData is the request body of creating and changing profiles, nil fields are not changed
+type profileData struct {
+	Name       *string   `json:"name"`
+	DNS        *[]string `json:"dns"`
+	MTU        *int      `json:"mtu"`
+	Keepalive  *int      `json:"keepalive"`
+	Tunnel     *string   `json:"tunnel"`
+	AllowedIPs *[]string `json:"allowedIPs"`
+	Endpoints  *[]string `json:"endpoints"`
+}
+
+// parseDNS checks dns servers and returns them in canonical form
+func parseDNS(servers []string) ([]string, error) {
+	result := []string{}
+	for _, s := range servers {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns server %s", s)
+		}
+		result = append(result, addr.String())
+	}
+	return result, nil
+}
+
+// parseAllowedIPs checks allowed ips of client configs and returns them in canonical form
+func parseAllowedIPs(prefixes []string) ([]string, error) {
+	result := []string{}
+	for _, s := range prefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed ip %s", s)
+		}
+		result = append(result, prefix.Masked().String())
+	}
+	return result, nil
+}
+
+func validMTU(mtu int) bool {
+	return mtu == 0 || (mtu >= 576 && mtu <= 9000)
+}
+
+func validKeepalive(keepalive int) bool {
+	return keepalive >= 0 && keepalive <= 65535
+}
+
+func validTunnel(tunnel string) bool {
+	return tunnel == "" || tunnel == "full" || tunnel == "split"
+}
+
+// apply validates the fields of data and copies them to profile, set gets the bson names and new values of changed fields
+func (data *profileData) apply(profile *ConfigProfile, set map[string]interface{}) error {
+	var err error
+	if data.Name != nil {
+		if *data.Name == "" {
+			return fmt.Errorf("name can not be empty")
+		}
+		profile.Name = *data.Name
+		set["name"] = profile.Name
+	}
+	if data.DNS != nil {
+		if profile.DNS, err = parseDNS(*data.DNS); err != nil {
+			return err
+		}
+		set["dns"] = profile.DNS
+	}
+	if data.MTU != nil {
+		if !validMTU(*data.MTU) {
+			return fmt.Errorf("mtu must be 0 or between 576 and 9000")
+		}
+		profile.MTU = *data.MTU
+		set["mtu"] = profile.MTU
+	}
+	if data.Keepalive != nil {
+		if !validKeepalive(*data.Keepalive) {
+			return fmt.Errorf("keepalive must be between 0 and 65535 seconds")
+		}
+		profile.Keepalive = *data.Keepalive
+		set["keepalive"] = profile.Keepalive
+	}
+	if data.Tunnel != nil {
+		if !validTunnel(*data.Tunnel) {
+			return fmt.Errorf("tunnel must be full or split")
+		}
+		profile.Tunnel = *data.Tunnel
+		set["tunnel"] = profile.Tunnel
+	}
+	if data.AllowedIPs != nil {
+		if profile.AllowedIPs, err = parseAllowedIPs(*data.AllowedIPs); err != nil {
+			return err
+		}
+		set["allowedIPs"] = profile.AllowedIPs
+	}
+	if data.Endpoints != nil {
+		for _, endpoint := range *data.Endpoints {
+			if _, _, err = net.SplitHostPort(endpoint); err != nil {
+				return fmt.Errorf("endpoint %s must be host:port", endpoint)
+			}
+		}
+		profile.Endpoints = *data.Endpoints
+		set["endpoints"] = profile.Endpoints
+	}
+	return nil
+}
+
+// peerProfiles returns profiles that apply to p, the most specific one first, peers.mu must not be held
+func peerProfiles(p *Peer) ([]*ConfigProfile, error) {
+	ids := []primitive.ObjectID{p.ProfileID}
+
+	if !p.GroupID.IsZero() {
+		group, err := store.GetGroup(p.GroupID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if group != nil {
+			ids = append(ids, group.ProfileID)
+		}
+	}
+
+	// distributors pass their profile down to peers below them
+	peers.mu.RLock()
+	visited := map[string]bool{p.ID: true}
+	for o := peers.peers[p.OwnerID]; o != nil && !visited[o.ID]; o = peers.peers[o.OwnerID] {
+		visited[o.ID] = true
+		ids = append(ids, o.ProfileID)
+	}
+	peers.mu.RUnlock()
+
+	var profiles []*ConfigProfile
+	for _, id := range ids {
+		if id.IsZero() {
+			continue
+		}
+		profile, err := store.GetProfile(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// profileInUse checks if a peer or group uses the profile with id
+func profileInUse(id primitive.ObjectID) (bool, error) {
+	peers.mu.RLock()
+	for _, p := range peers.peers {
+		if p.ProfileID == id {
+			peers.mu.RUnlock()
+			return true, nil
+		}
+	}
+	peers.mu.RUnlock()
+
+	groups, err := store.GetGroups()
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if g.ProfileID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseProfileID returns the id of an existing profile, an empty id removes the profile
+func parseProfileID(v interface{}) (primitive.ObjectID, error) {
+	s, ok := v.(string)
+	if !ok {
+		return primitive.NilObjectID, fmt.Errorf("profileID must be a string")
+	}
+	if s == "" {
+		return primitive.NilObjectID, nil
+	}
+	id, err := primitive.ObjectIDFromHex(s)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("invalid profileID")
+	}
+	if _, err = store.GetProfile(id); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("profile does not exist")
+	}
+	return id, nil
+}
+
+// profileNameTaken checks if a profile other than id is called name
+func profileNameTaken(name string, id primitive.ObjectID) (bool, error) {
+	profiles, err := store.GetProfiles()
+	if err != nil {
+		return false, err
+	}
+	for _, profile := range profiles {
+		if profile.Name == name && profile.ID != id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func GetProfiles(ctx echo.Context) error {
+	profiles, err := store.GetProfiles()
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+	return ctx.JSON(200, profiles)
+}
+
+func PostProfiles(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// get profile info from request body
+	var data profileData
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if data.Name == nil {
+		return ctx.String(400, "name can not be empty")
+	}
+
+	profile := ConfigProfile{ID: primitive.NewObjectID(), CreatedAt: time.Now().UnixMilli()}
+	set := map[string]interface{}{}
+	if err = data.apply(&profile, set); err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// check if name is taken
+	taken, err := profileNameTaken(profile.Name, profile.ID)
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+	if taken {
+		return ctx.String(409, "profile name is taken")
+	}
+
+	err = store.InsertProfile(&profile)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Profile "+profile.Name+" created", slog.String("peer", peer.Name))
+	audit(ctx, "profile.create", "profile", profile.ID.Hex(), profile.Name, auditChanges(nil, set))
+
+	return ctx.JSON(201, profile)
+}
+
+func PatchProfile(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if profile exists
+	profile, err := store.GetProfile(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	var data profileData
+	err = json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// keep old values for the audit trail
+	before := map[string]interface{}{
+		"name": profile.Name, "dns": profile.DNS, "mtu": profile.MTU, "keepalive": profile.Keepalive, "tunnel": profile.Tunnel,
+		"allowedIPs": profile.AllowedIPs, "endpoints": profile.Endpoints,
+	}
+
+	set := map[string]interface{}{}
+	if err = data.apply(profile, set); err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if len(set) == 0 {
+		return ctx.NoContent(200)
+	}
+
+	// check if name is taken
+	if data.Name != nil {
+		taken, err := profileNameTaken(profile.Name, profile.ID)
+		if err != nil {
+			return ctx.String(500, err.Error())
+		}
+		if taken {
+			return ctx.String(409, "profile name is taken")
+		}
+	}
+
+	err = store.UpdateProfile(profile.ID, set)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Profile "+profile.Name+" updated", slog.String("peer", peer.Name))
+	audit(ctx, "profile.update", "profile", profile.ID.Hex(), profile.Name, auditChanges(before, set))
+
+	return ctx.NoContent(200)
+}
+
+func DeleteProfile(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if profile exists
+	profile, err := store.GetProfile(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	// profiles that are still given to peers or groups can not be deleted
+	inUse, err := profileInUse(profile.ID)
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+	if inUse {
+		return ctx.String(409, "profile is used by peers or groups")
+	}
+
+	err = store.DeleteProfile(profile.ID)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Profile "+profile.Name+" deleted", slog.String("peer", peer.Name))
+	audit(ctx, "profile.delete", "profile", profile.ID.Hex(), profile.Name, nil)
+
+	return ctx.NoContent(200)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lowerRate returns the lower of two rates where zero means unlimited
+func lowerRate(a int64, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// peerRate returns the rate peer is limited to on this server, the lower of its rate limit and the throttle rate, peers.mu must be held
+func peerRate(peer *Peer) Rate {
+	rate := peer.RateLimit
+	if peer.Throttled {
+		throttle := config.ThrottleRate
+		if throttle <= 0 {
+			throttle = 1024
+		}
+		rate.Down = lowerRate(rate.Down, throttle)
+		rate.Up = lowerRate(rate.Up, throttle)
+	}
+	return rate
+}
+
+// setRate applies the rate of p to the interface, peers.mu must be held
+func setRate(p *Peer) error {
+	if shaper == nil {
+		return nil
+	}
+	return shaper.Set(p.ID, p.Prefixes(), peerRate(p))
+}
+
+// shapePeer applies the rate of p to the interface
+func shapePeer(p *Peer) error {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+	return setRate(p)
+}
+
+// shapePeers applies rate limits of every peer in local map when the server starts
+func shapePeers() {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+	for _, p := range peers.peers {
+		if p.RateLimit.IsZero() {
+			continue
+		}
+		if err := setRate(p); err != nil {
+			logger.Error(err.Error(), slog.String("peer", p.Name))
+		}
+	}
+}
+
+// parseRate converts a rate limit from a request body
+func parseRate(v interface{}) (Rate, error) {
+	var rate Rate
+	b, err := json.Marshal(v)
+	if err != nil {
+		return rate, err
+	}
+	if err = json.Unmarshal(b, &rate); err != nil {
+		return rate, err
+	}
+	if rate.Down < 0 || rate.Up < 0 {
+		return rate, errors.New("rate limit can not be negative")
+	}
+	return rate, nil
+}
+
+// decodeRate converts a rate limit from change streams and updated fields
+func decodeRate(v interface{}) (Rate, error) {
+	if rate, ok := v.(Rate); ok {
+		return rate, nil
+	}
+	var rate Rate
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return rate, err
+	}
+	err = bson.Unmarshal(b, &rate)
+	return rate, err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Drift is a single difference found between database, device and local map
+type Drift struct {
+	Peer   string `json:"peer"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+type DriftReport struct {
+	StartedAt  int64   `json:"startedAt"`
+	FinishedAt int64   `json:"finishedAt"`
+	DryRun     bool    `json:"dryRun"`
+	Drifts     []Drift `json:"drifts"`
+	Error      string  `json:"error,omitempty"`
+}
+
+var lastDriftReport *DriftReport
+var reconcileMu sync.Mutex // only one reconciliation runs at a time
+
+// reconcilePeers periodically fixes drift between database, device and local map
+func reconcilePeers() {
+	interval := time.Duration(config.ReconcileInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute * 5
+	}
+	for {
+		time.Sleep(interval)
+		report := reconcile(config.ReconcileDryRun)
+		if report.Error != "" {
+			logger.Error(report.Error)
+		}
+		reconcileMu.Lock()
+		lastDriftReport = report
+		reconcileMu.Unlock()
+	}
+}
+
+// reconcile compares database, device and local map and fixes the differences unless dryRun is set
+func reconcile(dryRun bool) *DriftReport {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	report := &DriftReport{StartedAt: time.Now().UnixMilli(), DryRun: dryRun, Drifts: []Drift{}}
+	defer func() { report.FinishedAt = time.Now().UnixMilli() }()
+
+	addDrift := func(peer string, kind string, detail string, fix func() error) {
+		drift := Drift{Peer: peer, Kind: kind, Detail: detail}
+		if !dryRun {
+			if e := fix(); e != nil {
+				logger.Error(e.Error(), slog.String("peer", peer))
+			} else {
+				drift.Fixed = true
+				logger.Warn("Fixed "+kind+" drift", slog.String("peer", peer))
+			}
+		}
+		report.Drifts = append(report.Drifts, drift)
+	}
+
+	// read device first, peers created after it are then only missing on the snapshot of device which is harmless,
+	// instead of being on device but missing on the snapshot of database which would remove them
+	d, e := wgc.Device(config.InterfaceName)
+	if e != nil {
+		report.Error = e.Error()
+		return report
+	}
+
+	// take a snapshot of local map before reading database so peers being created are not seen as deleted
+	peers.mu.RLock()
+	localPeers := make(map[string]*Peer, len(peers.peers))
+	for id, p := range peers.peers {
+		localPeers[id] = p
+	}
+	peers.mu.RUnlock()
+
+	dbPeers, e := store.GetPeers()
+	if e != nil {
+		report.Error = e.Error()
+		return report
+	}
+
+	// compare database and local map
+	dbPeersByID := make(map[string]*Peer, len(dbPeers))
+	for _, pdb := range dbPeers {
+		dbPeersByID[pdb.ID] = pdb
+		p, ok := localPeers[pdb.ID]
+		if !ok {
+			addDrift(pdb.Name, "missingInMemory", "peer exists on database but not in local map", func() error {
+				onPeerInserted(pdb)
+				return nil
+			})
+			continue
+		}
+		if p.Version == pdb.Version {
+			continue
+		}
+		updatedFields, e := changedFields(p, pdb)
+		if e != nil {
+			logger.Error(e.Error(), slog.String("peer", pdb.Name))
+			continue
+		}
+		// usage counters and server specific info change every second and are expected to lag behind
+		var fields []string
+		for k := range updatedFields {
+			if !strings.HasPrefix(k, "serverSpecificInfo") && k != "version" && k != "totalTX" && k != "totalRX" {
+				fields = append(fields, k)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		slices.Sort(fields)
+		addDrift(pdb.Name, "staleInMemory", "fields differ from database: "+strings.Join(fields, ", "), func() error {
+			onPeerUpdated(pdb.ID, updatedFields)
+			return nil
+		})
+	}
+	for id, p := range localPeers {
+		if _, ok := dbPeersByID[id]; !ok {
+			addDrift(p.Name, "deletedFromDatabase", "peer exists in local map but not on database", func() error {
+				onPeerDeleted(id)
+				return nil
+			})
+		}
+	}
+
+	// compare database and device
+	onDevice := make(map[string]bool, len(d.Peers))
+	for _, dp := range d.Peers {
+		onDevice[dp.PublicKey.String()] = true
+		pdb, ok := dbPeersByID[dp.PublicKey.String()]
+		if !ok {
+			addDrift(dp.PublicKey.String(), "unknownOnDevice", "peer exists on device but not on database", func() error {
+				// check again in case the peer was created since the snapshot
+				peers.mu.RLock()
+				_, ok := peers.peers[dp.PublicKey.String()]
+				peers.mu.RUnlock()
+				if ok {
+					return fmt.Errorf("peer was created while reconciling")
+				}
+				if _, e := store.GetPeer(dp.PublicKey.String()); !errors.Is(e, ErrNotFound) {
+					if e == nil {
+						e = fmt.Errorf("peer was created while reconciling")
+					}
+					return e
+				}
+				return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: dp.PublicKey, Remove: true}}})
+			})
+			continue
+		}
+
+		// check allowed ips
+		expected, e := pdb.AllowedIPNets()
+		if e != nil {
+			logger.Error(e.Error(), slog.String("peer", pdb.Name))
+			continue
+		}
+		if !sameIPNets(expected, dp.AllowedIPs) {
+			addDrift(pdb.Name, "allowedIPs", "device has "+ipNetsString(dp.AllowedIPs)+" instead of "+ipNetsString(expected), func() error {
+				return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: dp.PublicKey, UpdateOnly: true, ReplaceAllowedIPs: true, AllowedIPs: expected}}})
+			})
+		}
+
+		// disabled peers must have a preshared key and enabled peers must not
+		disabled := pdb.Disabled
+		if p, ok := localPeers[pdb.ID]; ok {
+			peers.mu.RLock()
+			disabled = p.Disabled
+			peers.mu.RUnlock()
+		}
+		hasPresharedKey := dp.PresharedKey != wgtypes.Key{}
+		if disabled && !hasPresharedKey {
+			addDrift(pdb.Name, "presharedKey", "disabled peer has no preshared key on device", func() error {
+				presharedKey, e := wgtypes.GenerateKey()
+				if e != nil {
+					return e
+				}
+				return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: dp.PublicKey, UpdateOnly: true, PresharedKey: &presharedKey}}})
+			})
+		} else if !disabled && hasPresharedKey {
+			addDrift(pdb.Name, "presharedKey", "enabled peer has a preshared key on device", func() error {
+				return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: dp.PublicKey, UpdateOnly: true, PresharedKey: &wgtypes.Key{}}}})
+			})
+		}
+	}
+	for _, pdb := range dbPeers {
+		if onDevice[pdb.PublicKey] {
+			continue
+		}
+		addDrift(pdb.Name, "missingOnDevice", "peer exists on database but not on device", func() error {
+			publicKey, e := wgtypes.ParseKey(pdb.PublicKey)
+			if e != nil {
+				return e
+			}
+			allowedIPs, e := pdb.AllowedIPNets()
+			if e != nil {
+				return e
+			}
+			presharedKey := wgtypes.Key{}
+			if pdb.Disabled {
+				presharedKey, e = wgtypes.GenerateKey()
+				if e != nil {
+					return e
+				}
+			}
+			e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, AllowedIPs: allowedIPs, PresharedKey: &presharedKey}}})
+			if e != nil {
+				return e
+			}
+
+			// counters of the new device peer start from zero
+			resetCounterBaseline(pdb.PublicKey)
+			return nil
+		})
+	}
+
+	return report
+}
+
+// sameIPNets checks if a and b contain the same networks regardless of order
+func sameIPNets(a []net.IPNet, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		if !slices.ContainsFunc(b, func(y net.IPNet) bool { return x.String() == y.String() }) {
+			return false
+		}
+	}
+	return true
+}
+
+func ipNetsString(ipNets []net.IPNet) string {
+	s := make([]string, len(ipNets))
+	for i, ipNet := range ipNets {
+		s[i] = ipNet.String()
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func GetReconcile(ctx echo.Context) error {
+	// run a reconciliation without fixing anything
+	if ctx.QueryParam("dryRun") == "true" {
+		return ctx.JSON(200, reconcile(true))
+	}
+
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	if lastDriftReport == nil {
+		return ctx.NoContent(204)
+	}
+	return ctx.JSON(200, lastDriftReport)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrOverlappingPrefix = errors.New("prefix overlaps a prefix of another peer")
+
+// Prefixes returns the tunnel addresses and routed subnets of peer, invalid entries are skipped
+func (peer *Peer) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range append([]string{peer.AllowedIPs, peer.AllowedIPsV6}, peer.Routes...) {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes
+}
+
+// overlappingPrefixes returns the first pair of prefixes of a and b that overlap
+func overlappingPrefixes(a []netip.Prefix, b []netip.Prefix) (netip.Prefix, netip.Prefix, bool) {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Overlaps(y) {
+				return x, y, true
+			}
+		}
+	}
+	return netip.Prefix{}, netip.Prefix{}, false
+}
+
+// checkPeerOverlap returns ErrOverlappingPrefix if prefixes of peer overlap prefixes of any of others
+func checkPeerOverlap(peer *Peer, others []*Peer) error {
+	prefixes := peer.Prefixes()
+	for _, o := range others {
+		if o.ID == peer.ID {
+			continue
+		}
+		if x, y, ok := overlappingPrefixes(prefixes, o.Prefixes()); ok {
+			return fmt.Errorf("%w, %s overlaps %s of %s", ErrOverlappingPrefix, x, y, o.Name)
+		}
+	}
+	return nil
+}
+
+// parseRoutes checks routed subnets of p and returns them in canonical form, peers.mu must be held
+func parseRoutes(p *Peer, routes []string) ([]string, error) {
+	var prefixes []netip.Prefix
+	for _, s := range routes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix = prefix.Masked()
+
+		// routes must not take addresses that are given to peers or each other
+		for _, pool := range append(slices.Clone(ipam.pools), deviceCIDRs...) {
+			if prefix.Overlaps(pool) {
+				return nil, fmt.Errorf("%s overlaps address pool %s", prefix, pool)
+			}
+		}
+		if x, y, ok := overlappingPrefixes([]netip.Prefix{prefix}, prefixes); ok {
+			return nil, fmt.Errorf("%s overlaps %s", x, y)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	result := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		result = append(result, prefix.String())
+	}
+
+	// check local map before the database so errors name the peer
+	others := make([]*Peer, 0, len(peers.peers))
+	for _, o := range peers.peers {
+		others = append(others, o)
+	}
+	if err := checkPeerOverlap(&Peer{ID: p.ID, Routes: result}, others); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// decodeRoutes converts routes from change streams and updated fields
+func decodeRoutes(v interface{}) []string {
+	switch routes := v.(type) {
+	case []string:
+		return routes
+	case primitive.A:
+		return decodeRoutes([]interface{}(routes))
+	case []interface{}:
+		result := make([]string, 0, len(routes))
+		for _, r := range routes {
+			if s, ok := r.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// addressFields are peer fields that hold prefixes which must not overlap other peers
+var addressFields = []string{"allowedIPs", "allowedIPsV6", "routes"}
+
+// changesAddresses checks if set changes any address fields
+func changesAddresses(set map[string]interface{}) bool {
+	return slices.ContainsFunc(addressFields, func(field string) bool { _, ok := set[field]; return ok })
+}
+
+// setAddressFields copies address fields in set to peer
+func setAddressFields(peer *Peer, set map[string]interface{}) {
+	if v, ok := set["allowedIPs"]; ok {
+		peer.AllowedIPs, _ = v.(string)
+	}
+	if v, ok := set["allowedIPsV6"]; ok {
+		peer.AllowedIPsV6, _ = v.(string)
+	}
+	if v, ok := set["routes"]; ok {
+		peer.Routes = decodeRoutes(v)
+	}
+}
+
+// configureAllowedIPs replaces allowed ips of p on device with its addresses and routes
+func configureAllowedIPs(p *Peer) error {
+	pk, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return err
+	}
+	peers.mu.RLock()
+	allowedIPs, err := p.AllowedIPNets()
+	peers.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, UpdateOnly: true, ReplaceAllowedIPs: true, AllowedIPs: allowedIPs}}})
+}
+
+// allRoutes returns routed subnets of every peer, site peers send traffic for them through the tunnel
+func allRoutes() []string {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+	routes := []string{}
+	for _, p := range peers.peers {
+		routes = append(routes, p.Routes...)
+	}
+	slices.Sort(routes)
+	return routes
+}
+
+// tunnelPrefixes returns the prefixes peers get addresses from, site peers send traffic for them through the tunnel
+func tunnelPrefixes() []string {
+	prefixes := []string{}
+	for _, p := range append(slices.Clone(deviceCIDRs), ipam.pools...) {
+		if !slices.Contains(prefixes, p.String()) {
+			prefixes = append(prefixes, p.String())
+		}
+	}
+	return prefixes
+}
+
+func PutRoutes(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+
+	var data struct {
+		Routes []string `json:"routes"`
+	}
+	err = json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	peers.mu.Lock()
+	routes, err := parseRoutes(p, data.Routes)
+	peers.mu.Unlock()
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// database checks routes against peers this server has not synced yet
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"routes": routes}}})
+	if errors.Is(err, ErrOverlappingPrefix) {
+		return ctx.String(409, err.Error())
+	}
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	before := p.Routes
+	peers.mu.Lock()
+	p.Routes = routes
+	updated := PeerUpdated{Peer: *p, Fields: []string{"routes"}}
+	peers.mu.Unlock()
+
+	logger.Info("Routes changed by "+peer.Name, slog.String("peer", p.Name))
+	audit(ctx, "peer.routes", "peer", p.ID, p.Name, map[string]AuditChange{"routes": {Before: before, After: routes}})
+	bus.Publish(updated)
+
+	return ctx.NoContent(200)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errRevokedToken = errors.New("token has been revoked")
+var errExpiredToken = errors.New("token has expired")
+
+var jwtSecret []byte // used to sign session tokens
+
+// sessionClaims are the claims of session tokens
+type sessionClaims struct {
+	jwt.StandardClaims
+	IssuedAtMilli int64 `json:"iatMs"` // compared with tokensRevokedAt, iat only has whole seconds
+}
+
+// newSessionToken returns a session token of peer issued at now and when it expires
+func newSessionToken(peer *Peer, now time.Time) (string, time.Time, error) {
+	sessionDuration := time.Duration(config.SessionDuration) * time.Hour
+	if sessionDuration <= 0 {
+		sessionDuration = time.Hour * 24
+	}
+	expiresAt := now.Add(sessionDuration)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, sessionClaims{
+		StandardClaims: jwt.StandardClaims{Subject: peer.ID, IssuedAt: now.Unix(), ExpiresAt: expiresAt.Unix()},
+		IssuedAtMilli:  now.UnixMilli(),
+	}).SignedString(jwtSecret)
+	return token, expiresAt, err
+}
+
+// authenticateToken returns the peer a session token or api key belongs to, the key is nil for session tokens
+func authenticateToken(token string) (*Peer, *APIKey, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		apiKey, peer, err := authenticateAPIKey(token)
+		return peer, apiKey, err
+	}
+
+	var claims sessionClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := store.GetPeer(claims.Subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	// tokens issued before milliseconds were added only have whole seconds
+	issuedAt := claims.IssuedAtMilli
+	if issuedAt == 0 {
+		issuedAt = claims.IssuedAt * 1000
+	}
+	if issuedAt < peer.TokensRevokedAt {
+		return nil, nil, errRevokedToken
+	}
+	return peer, nil, nil
+}
+
+// canLogin checks if peer is allowed to get session tokens
+func canLogin(peer *Peer) bool {
+	return hasPermission(peer, PermLogin) && peer.PasswordHash != ""
+}
+
+func PostLogin(ctx echo.Context) error {
+	var data struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	// find peer by name
+	var peer *Peer
+	peers.mu.RLock()
+	for _, p := range peers.peers {
+		if p.Name == data.Name {
+			peer = p
+			break
+		}
+	}
+	peers.mu.RUnlock()
+	if peer == nil {
+		return ctx.NoContent(401)
+	}
+
+	// get password hash from database because it is not kept in local map
+	peer, err = store.GetPeer(peer.ID)
+	if err != nil {
+		return ctx.NoContent(401)
+	}
+	if !canLogin(peer) || bcrypt.CompareHashAndPassword([]byte(peer.PasswordHash), []byte(data.Password)) != nil {
+		logger.Warn("Failed login from "+ctx.Request().RemoteAddr, slog.String("peer", data.Name))
+		return ctx.NoContent(401)
+	}
+
+	// create session token
+	token, expiresAt, err := newSessionToken(peer, time.Now())
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Logged in from "+ctx.Request().RemoteAddr, slog.String("peer", peer.Name))
+	ctx.Set("peer", peer)
+	audit(ctx, "account.login", "peer", peer.ID, peer.Name, nil)
+
+	return ctx.JSON(200, map[string]interface{}{"token": token, "expiresAt": expiresAt.UnixMilli()})
+}
+
+func PutPassword(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	var data struct {
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if len(data.Password) < 8 {
+		return ctx.String(400, "password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+
+	// changing password revokes every session including the one used for this request,
+	// the caller gets a new token issued at the time of revocation which is not revoked
+	now := time.Now()
+	token, expiresAt, err := newSessionToken(peer, now)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+	err = store.UpdatePeers([]PeerUpdate{{ID: peer.ID, Set: map[string]interface{}{"passwordHash": string(hash), "tokensRevokedAt": now.UnixMilli()}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Password changed", slog.String("peer", peer.Name))
+	audit(ctx, "account.password", "peer", peer.ID, peer.Name, nil)
+
+	return ctx.JSON(200, map[string]interface{}{"token": token, "expiresAt": expiresAt.UnixMilli()})
+}
+
+func DeleteSessions(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	// peers can revoke their own sessions and sessions of peers they can manage
+	if !canAccessPeer(peer, p) {
+		return ctx.NoContent(403)
+	}
+
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{"tokensRevokedAt": time.Now().UnixMilli()}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Sessions revoked", slog.String("peer", p.Name))
+	audit(ctx, "account.revokeSessions", "peer", p.ID, p.Name, nil)
+
+	return ctx.NoContent(200)
+}
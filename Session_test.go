@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionRevocation(t *testing.T) {
+	originalStore, originalSecret := store, jwtSecret
+	s, err := NewBoltStorage(filepath.Join(t.TempDir(), "wgui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, jwtSecret = s, []byte("secret")
+	t.Cleanup(func() {
+		s.Close()
+		store, jwtSecret = originalStore, originalSecret
+	})
+
+	revokedAt := time.UnixMilli(time.Now().UnixMilli())
+	p := &Peer{ID: "peer", Name: "peer", AllowedIPs: "10.0.0.2/32", TokensRevokedAt: revokedAt.UnixMilli()}
+	if err = store.InsertPeer(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"before revocation in the same second", revokedAt.Add(-time.Millisecond), true},
+		{"at revocation", revokedAt, false},
+		{"after revocation", revokedAt.Add(time.Millisecond), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := newSessionToken(p, tt.issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = authenticateToken(token)
+			if revoked := errors.Is(err, errRevokedToken); revoked != tt.revoked || (err != nil && !revoked) {
+				t.Errorf("authenticateToken() error = %v, want revoked %v", err, tt.revoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var ErrNoClasses = errors.New("no traffic classes left on interface")
+
+// Rate limits traffic of a peer in kbit/s, zero means unlimited
+type Rate struct {
+	Down int64 `json:"Down" bson:"down"` // traffic sent to the peer
+	Up   int64 `json:"Up" bson:"up"`     // traffic received from the peer
+}
+
+func (r Rate) IsZero() bool {
+	return r.Down <= 0 && r.Up <= 0
+}
+
+// shapedPeer is the class and filters of a peer on the interface
+type shapedPeer struct {
+	minor    uint16
+	prefixes []netip.Prefix
+	rate     Rate
+}
+
+// Shaper limits rates of peers on an interface, traffic to a peer goes through its own htb class
+// and traffic from a peer is policed on ingress, both are matched by the peer's prefixes
+type Shaper struct {
+	handle *netlink.Handle
+	link   netlink.Link
+	peers  map[string]*shapedPeer // keyed by peer id
+	free   []uint16               // minors of removed classes
+	next   uint16
+	mu     sync.Mutex
+}
+
+var shaper *Shaper // nil if traffic shaping is not available
+
+// maxClassMinor keeps minors of classes below the handles the kernel picks for leaf qdiscs
+const maxClassMinor = 0x7fff
+
+var (
+	rootHandle    = netlink.MakeHandle(1, 0)
+	ingressHandle = netlink.MakeHandle(0xffff, 0)
+)
+
+// NewShaper replaces root and ingress qdiscs of interface name with empty ones owned by wgui,
+// handle selects the network namespace
+func NewShaper(handle *netlink.Handle, name string) (*Shaper, error) {
+	link, err := handle.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Shaper{handle: handle, link: link, peers: make(map[string]*shapedPeer), next: 1}
+
+	// start from a clean interface, classes of a previous run are unknown
+	qdiscs, err := handle.QdiscList(link)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT || q.Attrs().Parent == netlink.HANDLE_INGRESS {
+			if err = handle.QdiscDel(q); err != nil && !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.EINVAL) {
+				return nil, err
+			}
+		}
+	}
+
+	// unclassified traffic is sent without limit
+	root := netlink.NewHtb(netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: rootHandle, Parent: netlink.HANDLE_ROOT})
+	if err = handle.QdiscAdd(root); err != nil {
+		return nil, err
+	}
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: ingressHandle, Parent: netlink.HANDLE_INGRESS}}
+	if err = handle.QdiscAdd(ingress); err != nil {
+		return nil, err
+	}
+
+	// check that the kernel has every classifier, qdisc and action that is used
+	probe := []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("2001:db8::1/128")}
+	if err = s.Set("probe", probe, Rate{Down: 1000, Up: 1000}); err != nil {
+		handle.QdiscDel(root)
+		handle.QdiscDel(ingress)
+		return nil, err
+	}
+	if err = s.Remove("probe"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Set limits traffic of peer id matching prefixes to rate, a zero rate removes the limit
+func (s *Shaper) Set(id string, prefixes []netip.Prefix, rate Rate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.peers[id]
+	if ok && existing.rate == rate && slices.Equal(existing.prefixes, prefixes) {
+		return nil
+	}
+	if ok {
+		if err := s.remove(id); err != nil {
+			return err
+		}
+	}
+	if rate.IsZero() || len(prefixes) == 0 {
+		return nil
+	}
+
+	minor, err := s.allocate()
+	if err != nil {
+		return err
+	}
+	sp := &shapedPeer{minor: minor, prefixes: prefixes, rate: rate}
+	s.peers[id] = sp
+
+	if err = s.add(sp); err != nil {
+		// leave nothing behind so the next attempt starts clean
+		s.remove(id)
+		return err
+	}
+	return nil
+}
+
+// Remove removes limits of peer id
+func (s *Shaper) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(id)
+}
+
+func (s *Shaper) allocate() (uint16, error) {
+	if n := len(s.free); n > 0 {
+		minor := s.free[n-1]
+		s.free = s.free[:n-1]
+		return minor, nil
+	}
+	if s.next > maxClassMinor {
+		return 0, ErrNoClasses
+	}
+	s.next++
+	return s.next - 1, nil
+}
+
+// filter returns the filter of the ith prefix of sp, ingress filters match the source and egress filters the destination
+func (s *Shaper) filter(sp *shapedPeer, i int, ingress bool) *netlink.Flower {
+	p := sp.prefixes[i]
+	f := &netlink.Flower{FilterAttrs: netlink.FilterAttrs{
+		LinkIndex: s.link.Attrs().Index,
+		Handle:    uint32(sp.minor)<<8 | uint32(i),
+		Parent:    rootHandle,
+		Priority:  1,
+		Protocol:  unix.ETH_P_IP,
+	}}
+	if p.Addr().Is6() {
+		f.Priority = 2
+		f.Protocol = unix.ETH_P_IPV6
+	}
+	f.EthType = f.Protocol
+	ip, mask := net.IP(p.Addr().AsSlice()), net.CIDRMask(p.Bits(), p.Addr().BitLen())
+	if ingress {
+		f.Parent = ingressHandle
+		f.SrcIP, f.SrcIPMask = ip, mask
+	} else {
+		f.DestIP, f.DestIPMask = ip, mask
+		f.ClassId = netlink.MakeHandle(1, sp.minor)
+	}
+	return f
+}
+
+func (s *Shaper) add(sp *shapedPeer) error {
+	if len(sp.prefixes) > 256 {
+		return fmt.Errorf("can not shape more than 256 prefixes of a peer")
+	}
+
+	if sp.rate.Down > 0 {
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: s.link.Attrs().Index,
+			Parent:    rootHandle,
+			Handle:    netlink.MakeHandle(1, sp.minor),
+		}, netlink.HtbClassAttrs{Rate: uint64(sp.rate.Down) * 1000, Ceil: uint64(sp.rate.Down) * 1000})
+		if err := s.handle.ClassAdd(class); err != nil {
+			return err
+		}
+
+		// fair queueing inside the class keeps latency low while the peer is at its limit
+		leaf := netlink.NewFqCodel(netlink.QdiscAttrs{LinkIndex: s.link.Attrs().Index, Parent: class.Handle})
+		if err := s.handle.QdiscAdd(leaf); err != nil {
+			return err
+		}
+
+		for i := range sp.prefixes {
+			if err := s.handle.FilterAdd(s.filter(sp, i, false)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sp.rate.Up > 0 {
+		// policing takes bytes per second and drops what exceeds it
+		rate := uint32(min(sp.rate.Up*1000/8, int64(^uint32(0))))
+		for i := range sp.prefixes {
+			police := netlink.NewPoliceAction()
+			police.Rate = rate
+			police.Burst = max(rate/10, 16*1024)
+			police.Mtu = 64 * 1024
+			police.ExceedAction = netlink.TC_POLICE_SHOT
+			f := s.filter(sp, i, true)
+			f.Actions = []netlink.Action{police}
+			if err := s.handle.FilterAdd(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove deletes filters and class of peer id, missing ones are ignored
+func (s *Shaper) remove(id string) error {
+	sp, ok := s.peers[id]
+	if !ok {
+		return nil
+	}
+	for i := range sp.prefixes {
+		if sp.rate.Down > 0 {
+			if err := s.handle.FilterDel(s.filter(sp, i, false)); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return err
+			}
+		}
+		if sp.rate.Up > 0 {
+			if err := s.handle.FilterDel(s.filter(sp, i, true)); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return err
+			}
+		}
+	}
+	if sp.rate.Down > 0 {
+		// the leaf qdisc is deleted with its class
+		class := netlink.NewHtbClass(netlink.ClassAttrs{LinkIndex: s.link.Attrs().Index, Parent: rootHandle, Handle: netlink.MakeHandle(1, sp.minor)}, netlink.HtbClassAttrs{})
+		if err := s.handle.ClassDel(class); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+	}
+	delete(s.peers, id)
+	s.free = append(s.free, sp.minor)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// newTestHandle returns a handle of a new network namespace that is removed after the test
+func newTestHandle(t *testing.T) *netlink.Handle {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces needs root")
+	}
+
+	// netns.New switches the namespace of the calling thread, so switch it back before unlocking it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip("can not create network namespace: " + err.Error())
+	}
+	if err = netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(handle.Close)
+	return handle
+}
+
+// shaperState returns the number of classes below the root qdisc and of egress and ingress filters on link
+func shaperState(t *testing.T, handle *netlink.Handle, link netlink.Link) (int, int, int) {
+	classes, err := handle.ClassList(link, rootHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egress, err := handle.FilterList(link, rootHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress, err := handle.FilterList(link, ingressHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(classes), len(egress), len(ingress)
+}
+
+func TestShaper(t *testing.T) {
+	handle := newTestHandle(t)
+
+	// the loopback interface exists in every namespace, it only has to be up
+	link, err := handle.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = handle.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewShaper(handle, "lo")
+	if errors.Is(err, syscall.ENOENT) {
+		t.Skip("kernel lacks a qdisc, classifier or action the shaper uses")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("fd00::2/128")}
+	if err = s.Set("peer", prefixes, Rate{Down: 1000, Up: 500}); err != nil {
+		t.Fatal(err)
+	}
+	classes, egress, ingress := shaperState(t, handle, link)
+	if classes != 1 || egress != 2 || ingress != 2 {
+		t.Errorf("after Set got %d classes, %d egress and %d ingress filters, want 1, 2 and 2", classes, egress, ingress)
+	}
+
+	// changing the rate replaces class and filters
+	if err = s.Set("peer", prefixes, Rate{Down: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	classes, egress, ingress = shaperState(t, handle, link)
+	if classes != 1 || egress != 2 || ingress != 0 {
+		t.Errorf("after changing rate got %d classes, %d egress and %d ingress filters, want 1, 2 and 0", classes, egress, ingress)
+	}
+
+	if err = s.Remove("peer"); err != nil {
+		t.Fatal(err)
+	}
+	classes, egress, ingress = shaperState(t, handle, link)
+	if classes != 0 || egress != 0 || ingress != 0 {
+		t.Errorf("after Remove got %d classes, %d egress and %d ingress filters, want none", classes, egress, ingress)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNotFound = errors.New("not found")
+var ErrDuplicateKey = errors.New("duplicate key")
+var ErrWatchUnsupported = errors.New("watching changes is not supported by database")
+var ErrResumeTokenLost = errors.New("changes after resume token are no longer available")
+
+// PeerUpdate describes changes to a single peer, keys of Set and Inc are bson field names of Peer
+type PeerUpdate struct {
+	ID  string
+	Set map[string]interface{}
+	Inc map[string]int64
+	SSI *ServerSpecificInfo // replaces the server specific info entry with the same address or adds it
+}
+
+// GroupUpdate describes changes to a single group, keys of Set and Inc are bson field names of Group
+type GroupUpdate struct {
+	ID  primitive.ObjectID
+	Set map[string]interface{}
+	Inc map[string]int64
+}
+
+// PeerChange is an insert, update or delete of a peer made by any server
+type PeerChange struct {
+	OperationType string
+	ID            string
+	FullDocument  *Peer                  // set for inserts
+	UpdatedFields map[string]interface{} // set for updates
+	ResumeToken   []byte                 // used to continue watching after this change
+}
+
+// Storage is implemented by every backend that can hold peers, groups and logs
+type Storage interface {
+	GetPeers() ([]*Peer, error)
+	GetPeer(id string) (*Peer, error)
+	GetPeerByAddress(address string) (*Peer, error) // matches allowedIPs or allowedIPsV6
+	InsertPeer(peer *Peer) error
+	UpdatePeers(updates []PeerUpdate) error
+	DeletePeer(id string) error
+	ResetServerSpecificInfo() error
+
+	GetGroups() ([]*Group, error)
+	GetGroupsByOwnerID(ownerID string) ([]*Group, error)
+	GetGroup(id primitive.ObjectID) (*Group, error)
+	InsertGroup(group *Group) error
+	UpdateGroups(updates []GroupUpdate) error
+	AddPeerToGroup(groupID primitive.ObjectID, peerID string) error
+	RemovePeerFromGroup(groupID primitive.ObjectID, peerID string) error
+	DeleteGroup(id primitive.ObjectID) error
+
+	InsertLog(l *Log) error
+	GetLogs() ([]Log, error)
+
+	GetAPIKeys() ([]*APIKey, error)
+	GetAPIKeysByOwnerID(ownerID string) ([]*APIKey, error)
+	GetAPIKey(id primitive.ObjectID) (*APIKey, error)
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	InsertAPIKey(key *APIKey) error
+	UpdateAPIKey(id primitive.ObjectID, set map[string]interface{}) error
+
+	InsertAudit(entry *AuditEntry) error
+	// GetAudit returns entries matching filter newest first and the number of all matching entries
+	GetAudit(filter AuditFilter) ([]AuditEntry, int64, error)
+
+	// AddUsage adds traffic of buckets to stored buckets with the same ID or stores them if they do not exist
+	AddUsage(buckets []*UsageBucket) error
+	// GetUsage returns buckets of every step matching filter ordered by time
+	GetUsage(filter UsageFilter) ([]*UsageBucket, error)
+	// RollupUsage replaces buckets of server with step from that start before before with buckets of step to holding their sums.
+	// Sums are added to existing buckets of step to like AddUsage. On MongoDB a crash between adding the sums and removing
+	// the buckets they were made of counts that traffic twice.
+	RollupUsage(server string, from string, to string, before int64) error
+	DeleteUsage(server string, step string, before int64) error
+
+	// ArchivePeriod stores archive or replaces the archive with the same ID
+	ArchivePeriod(archive *PeriodArchive) error
+	// GetPeriodArchives returns archived periods of a peer or group newest first
+	GetPeriodArchives(targetID string) ([]*PeriodArchive, error)
+
+	GetWebhooks() ([]*Webhook, error)
+	GetWebhook(id primitive.ObjectID) (*Webhook, error)
+	InsertWebhook(webhook *Webhook) error
+	UpdateWebhook(id primitive.ObjectID, set map[string]interface{}) error
+	// DeleteWebhook deletes a webhook and its deliveries
+	DeleteWebhook(id primitive.ObjectID) error
+	InsertDelivery(delivery *WebhookDelivery) error
+	UpdateDelivery(id primitive.ObjectID, set map[string]interface{}) error
+	GetDelivery(id primitive.ObjectID) (*WebhookDelivery, error)
+	// GetDeliveries returns the last 100 deliveries of a webhook newest first
+	GetDeliveries(webhookID primitive.ObjectID) ([]*WebhookDelivery, error)
+	// GetPendingDeliveries returns pending deliveries of server that are due before before
+	GetPendingDeliveries(server string, before int64) ([]*WebhookDelivery, error)
+	DeleteDeliveries(before int64) error
+
+	GetProfiles() ([]*ConfigProfile, error)
+	GetProfile(id primitive.ObjectID) (*ConfigProfile, error)
+	InsertProfile(profile *ConfigProfile) error
+	UpdateProfile(id primitive.ObjectID, set map[string]interface{}) error
+	DeleteProfile(id primitive.ObjectID) error
+
+	// WatchPeers blocks and calls fn for every change made to peers after resumeToken, or after startAt if there is no token, until ctx is done.
+	// It returns ErrWatchUnsupported if the database can not stream changes and ErrResumeTokenLost if the requested changes are gone.
+	WatchPeers(ctx context.Context, resumeToken []byte, startAt time.Time, fn func(*PeerChange)) error
+	GetResumeToken(server string) ([]byte, error)
+	SetResumeToken(server string, token []byte) error
+
+	Close() error
+}
+
+// withVersion returns a copy of inc that also increments the version of a peer
+func withVersion(inc map[string]int64) map[string]int64 {
+	result := map[string]int64{"version": 1}
+	for k, v := range inc {
+		result[k] = v
+	}
+	return result
+}
+
+// NewStorage creates the storage backend selected in config
+func NewStorage(c *Config) (Storage, error) {
+	switch c.Storage {
+	case "", "mongo":
+		return NewMongoStorage(c.MongoURI, c.DBName)
+	case "bolt":
+		boltPath := c.BoltPath
+		if boltPath == "" {
+			boltPath = filepath.Join(path, "wgui.db")
+		}
+		return NewBoltStorage(boltPath)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", c.Storage)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var peersLoadedAt time.Time // set right before peers are loaded from database so no change after it is missed
+
+// clockSkew is subtracted from local times used to start change streams on database
+const clockSkew = time.Second * 5
+
+// watchPeers keeps device and local map in sync with changes made by other servers
+func watchPeers() {
+	if config.SyncMode == "poll" {
+		pollPeers()
+		return
+	}
+
+	// continue from the last change this server has seen
+	resumeToken, e := store.GetResumeToken(config.PublicAddress)
+	if e != nil {
+		logger.Error(e.Error())
+	}
+	startAt := peersLoadedAt.Add(-clockSkew)
+
+	var savedAt time.Time
+	backoff := time.Second
+	for {
+		e = store.WatchPeers(context.TODO(), resumeToken, startAt, func(change *PeerChange) {
+			onPeerChange(change)
+			resumeToken = change.ResumeToken
+			backoff = time.Second
+
+			// save resume token every few seconds, replaying a few changes after a crash is harmless
+			if time.Since(savedAt) > time.Second*5 {
+				if e := store.SetResumeToken(config.PublicAddress, resumeToken); e != nil {
+					logger.Error(e.Error())
+				}
+				savedAt = time.Now()
+			}
+		})
+		if errors.Is(e, ErrWatchUnsupported) {
+			if config.SyncMode == "changeStream" {
+				logger.Error(e.Error())
+				panic(e)
+			}
+			logger.Warn("Database does not support change streams, falling back to polling")
+			pollPeers()
+			return
+		}
+		if errors.Is(e, ErrResumeTokenLost) {
+			// changes were missed, compare everything and watch from now on
+			logger.Warn("Resume token is no longer available, reconciling peers")
+			resumeToken = nil
+			startAt = time.Now().Add(-clockSkew)
+			if e = syncPeers(); e != nil {
+				logger.Error(e.Error())
+			}
+			continue
+		}
+		if e != nil {
+			logger.Error("Change stream stopped, reconnecting in "+backoff.String(), slog.String("error", e.Error()))
+		}
+
+		// reconnect with backoff
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// onPeerChange applies a change made to peers on database
+func onPeerChange(change *PeerChange) {
+	switch change.OperationType {
+	case "insert":
+		onPeerInserted(change.FullDocument)
+	case "update":
+		onPeerUpdated(change.ID, change.UpdatedFields)
+	case "delete":
+		onPeerDeleted(change.ID)
+	}
+}
+
+// pollPeers periodically syncs peers when change streams are not available
+func pollPeers() {
+	interval := time.Duration(config.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second * 5
+	}
+	for {
+		time.Sleep(interval)
+		if e := syncPeers(); e != nil {
+			logger.Error(e.Error())
+		}
+	}
+}
+
+// syncPeers compares peers on database with local map and applies the differences like change streams do
+func syncPeers() error {
+	// take a snapshot of local map before reading database so peers being created are not seen as deleted
+	peers.mu.RLock()
+	localPeers := make(map[string]*Peer, len(peers.peers))
+	for id, p := range peers.peers {
+		localPeers[id] = p
+	}
+	peers.mu.RUnlock()
+
+	dbPeers, e := store.GetPeers()
+	if e != nil {
+		return e
+	}
+
+	seen := make(map[string]bool, len(dbPeers))
+	for _, pdb := range dbPeers {
+		seen[pdb.ID] = true
+		p, ok := localPeers[pdb.ID]
+		if !ok {
+			onPeerInserted(pdb)
+			continue
+		}
+		if p.Version == pdb.Version {
+			continue
+		}
+		updatedFields, e := changedFields(p, pdb)
+		if e != nil {
+			logger.Error(e.Error(), slog.String("peer", pdb.Name))
+			continue
+		}
+		onPeerUpdated(pdb.ID, updatedFields)
+	}
+
+	for id := range localPeers {
+		if !seen[id] {
+			onPeerDeleted(id)
+		}
+	}
+
+	return nil
+}
+
+// changedFields returns fields of pdb that differ from p in change stream format
+func changedFields(p *Peer, pdb *Peer) (map[string]interface{}, error) {
+	peers.mu.RLock()
+	local, e := bson.Marshal(p)
+	ssis := make(map[string]ServerSpecificInfo, len(p.ServerSpecificInfo))
+	for _, ssi := range p.ServerSpecificInfo {
+		ssis[ssi.Address] = *ssi
+	}
+	peers.mu.RUnlock()
+	if e != nil {
+		return nil, e
+	}
+	remote, e := bson.Marshal(pdb)
+	if e != nil {
+		return nil, e
+	}
+
+	var localFields, remoteFields map[string]interface{}
+	if e = bson.Unmarshal(local, &localFields); e != nil {
+		return nil, e
+	}
+	if e = bson.Unmarshal(remote, &remoteFields); e != nil {
+		return nil, e
+	}
+
+	updatedFields := make(map[string]interface{})
+	for k, v := range remoteFields {
+		if k != "serverSpecificInfo" && !reflect.DeepEqual(localFields[k], v) {
+			updatedFields[k] = v
+		}
+	}
+	// omitempty fields like routes are missing on database once they are cleared
+	for k := range localFields {
+		if _, ok := remoteFields[k]; !ok {
+			updatedFields[k] = nil
+		}
+	}
+
+	// server specific info entries are sent one by one like positional updates
+	for _, ssi := range pdb.ServerSpecificInfo {
+		if local, ok := ssis[ssi.Address]; ok && local == *ssi {
+			continue
+		}
+		updatedFields["serverSpecificInfo."+ssi.Address] = map[string]interface{}{
+			"address":           ssi.Address,
+			"endpoint":          ssi.Endpoint,
+			"lastHandshakeTime": ssi.LastHandshakeTime,
+			"currentTX":         ssi.CurrentTX,
+			"currentRX":         ssi.CurrentRX,
+		}
+	}
+
+	return updatedFields, nil
+}
+
+// onPeerInserted adds a peer created by any server to local map, subscribers add it to device
+func onPeerInserted(peer *Peer) {
+	// check if peer already exists
+	_, ok := peers.peers[peer.ID]
+	if ok {
+		return
+	}
+
+	// add peer to local map
+	peers.mu.Lock()
+	peers.peers[peer.PublicKey] = peer
+	peers.mu.Unlock()
+
+	peers.mu.RLock()
+	bus.Publish(PeerCreated{Peer: *peer, Remote: true})
+	peers.mu.RUnlock()
+
+	// add server specific info entry to database
+	e := store.UpdatePeers([]PeerUpdate{{ID: peer.ID, SSI: &ServerSpecificInfo{Address: config.PublicAddress}}})
+	if e != nil {
+		logger.Error(e.Error(), slog.String("peer", peer.Name))
+	}
+}
+
+// onPeerUpdated applies fields updated by any server to local map, subscribers apply them to device
+func onPeerUpdated(id string, updatedFields map[string]interface{}) {
+	var ssi *ServerSpecificInfo
+	var m map[string]interface{}
+
+	p, ok := peers.peers[id]
+	if !ok {
+		logger.Error("Recieved update for a peer that does not exist in local map", slog.String("peer", id))
+		return
+	}
+
+	// check all the updated fields
+	for k, v := range updatedFields {
+		if k == "groupID" {
+			peers.mu.Lock()
+			p.GroupID = v.(primitive.ObjectID)
+			peers.mu.Unlock()
+		} else if k == "profileID" {
+			peers.mu.Lock()
+			p.ProfileID = v.(primitive.ObjectID)
+			peers.mu.Unlock()
+		} else if k == "telegramChatID" {
+			peers.mu.Lock()
+			p.TelegramChatID = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "telegramLinkHash" {
+			peers.mu.Lock()
+			p.TelegramLinkHash = v.(string)
+			peers.mu.Unlock()
+		} else if k == "telegramLinkExpiry" {
+			peers.mu.Lock()
+			p.TelegramLinkExpiry = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "telegramRelink" {
+			peers.mu.Lock()
+			p.TelegramRelink = v.(bool)
+			peers.mu.Unlock()
+		} else if k == "totalTX" {
+			peers.mu.Lock()
+			p.TotalTX = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "totalRX" {
+			peers.mu.Lock()
+			p.TotalRX = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "allowedUsage" {
+			peers.mu.Lock()
+			p.AllowedUsage = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "expiresAt" {
+			peers.mu.Lock()
+			p.ExpiresAt = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "disabled" {
+			// do nothing
+		} else if k == "version" {
+			peers.mu.Lock()
+			p.Version = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "name" {
+			peers.mu.Lock()
+			p.Name = v.(string)
+			peers.mu.Unlock()
+		} else if k == "role" {
+			peers.mu.Lock()
+			p.Role = v.(string)
+			peers.mu.Unlock()
+		} else if k == "ownerID" {
+			peers.mu.Lock()
+			p.OwnerID = v.(string)
+			peers.mu.Unlock()
+		} else if k == "budget" {
+			budget, e := decodeBudget(v)
+			if e != nil {
+				logger.Error(e.Error(), slog.String("peer", p.Name))
+				continue
+			}
+			peers.mu.Lock()
+			p.Budget = budget
+			peers.mu.Unlock()
+		} else if k == "overQuota" {
+			// peers loop throttles or disables the peer
+			peers.mu.Lock()
+			p.OverQuota = v.(string)
+			peers.mu.Unlock()
+		} else if k == "rateLimit" {
+			rate, e := decodeRate(v)
+			if e != nil {
+				logger.Error(e.Error(), slog.String("peer", p.Name))
+				continue
+			}
+			peers.mu.Lock()
+			p.RateLimit = rate
+			peers.mu.Unlock()
+		} else if k == "warnings" {
+			warnings, e := decodeWarnings(v)
+			if e != nil {
+				logger.Error(e.Error(), slog.String("peer", p.Name))
+				continue
+			}
+			peers.mu.Lock()
+			p.Warnings = warnings
+			peers.mu.Unlock()
+		} else if k == "period" {
+			period, e := decodePeriod(v)
+			if e != nil {
+				logger.Error(e.Error(), slog.String("peer", p.Name))
+				continue
+			}
+			peers.mu.Lock()
+			p.Period = period
+			peers.mu.Unlock()
+		} else if k == "passwordHash" {
+			peers.mu.Lock()
+			p.PasswordHash = v.(string)
+			peers.mu.Unlock()
+		} else if k == "tokensRevokedAt" {
+			peers.mu.Lock()
+			p.TokensRevokedAt = v.(int64)
+			peers.mu.Unlock()
+		} else if k == "allowedIPsV6" || k == "routes" {
+			peers.mu.Lock()
+			setAddressFields(p, map[string]interface{}{k: v})
+			peers.mu.Unlock()
+		} else if k == "preferredEndpoint" {
+			peers.mu.Lock()
+			p.PreferredEndpoint = v.(string)
+			peers.mu.Unlock()
+		} else if m, ok = v.(map[string]interface{}); ok {
+			if _, ok = m["address"]; ok && m["address"].(string) != config.PublicAddress {
+				ssi = p.FindSSIByAddress(m["address"].(string))
+				if ssi == nil {
+					peers.mu.Lock()
+					p.ServerSpecificInfo = append(p.ServerSpecificInfo, &ServerSpecificInfo{
+						Address:           m["address"].(string),
+						Endpoint:          m["endpoint"].(string),
+						LastHandshakeTime: m["lastHandshakeTime"].(string),
+						CurrentTX:         m["currentTX"].(int64),
+						CurrentRX:         m["currentRX"].(int64),
+					})
+					peers.mu.Unlock()
+				} else {
+					peers.mu.Lock()
+					ssi.Address = m["address"].(string)
+					ssi.Endpoint = m["endpoint"].(string)
+					ssi.LastHandshakeTime = m["lastHandshakeTime"].(string)
+					ssi.CurrentTX = m["currentTX"].(int64)
+					ssi.CurrentRX = m["currentRX"].(int64)
+					peers.mu.Unlock()
+				}
+			}
+		}
+	}
+
+	// tell subscribers which fields changed
+	fields := make([]string, 0, len(updatedFields))
+	for k := range updatedFields {
+		fields = append(fields, k)
+	}
+	peers.mu.RLock()
+	updated := PeerUpdated{Peer: *p, Fields: fields}
+	peers.mu.RUnlock()
+	bus.Publish(updated)
+}
+
+// onPeerDeleted removes a peer deleted by any server from local map, subscribers remove it from device
+func onPeerDeleted(id string) {
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return
+	}
+
+	// delete peer from local map
+	peers.mu.Lock()
+	delete(peers.peers, p.PublicKey)
+	deleted := PeerDeleted{Peer: *p, Remote: true}
+	peers.mu.Unlock()
+
+	bus.Publish(deleted)
+}
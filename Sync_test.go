@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  Peer
+		remote Peer
+		want   map[string]interface{}
+	}{
+		{"unchanged", Peer{ID: "peer", Routes: []string{"10.1.0.0/24"}}, Peer{ID: "peer", Routes: []string{"10.1.0.0/24"}}, map[string]interface{}{}},
+		{"changed", Peer{ID: "peer", Name: "a"}, Peer{ID: "peer", Name: "b"}, map[string]interface{}{"name": "b"}},
+		{"routes cleared", Peer{ID: "peer", Routes: []string{"10.1.0.0/24"}}, Peer{ID: "peer"}, map[string]interface{}{"routes": nil}},
+		{"ipv6 cleared", Peer{ID: "peer", AllowedIPsV6: "fd00::2/128"}, Peer{ID: "peer"}, map[string]interface{}{"allowedIPsV6": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := changedFields(&tt.local, &tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedFields() = %v, want %v", got, tt.want)
+			}
+
+			// applying the changes clears the fields
+			setAddressFields(&tt.local, got)
+			if len(tt.local.Routes) != len(tt.remote.Routes) || tt.local.AllowedIPsV6 != tt.remote.AllowedIPsV6 {
+				t.Errorf("after applying changes routes are %v and ipv6 is %q", tt.local.Routes, tt.local.AllowedIPsV6)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// seconds telegram holds a getUpdates request open when there are no updates
+const telegramPollTimeout = 30
+
+// how long a start link can be used after it was created
+const telegramLinkLifetime = time.Hour * 24
+
+// TelegramBot links telegram chats to peers through single use start links created on the peer page,
+// answers commands of linked chats and delivers notifications to them
+type TelegramBot struct {
+	apiURL string
+	token  string
+	client *http.Client
+	offset int64 // id of the next update to receive
+}
+
+var telegram *TelegramBot // nil if no bot token is configured or this is not the main server
+
+func NewTelegramBot(apiURL string, token string) *TelegramBot {
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	return &TelegramBot{
+		apiURL: strings.TrimRight(apiURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: time.Second * (telegramPollTimeout + 10)},
+	}
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// call sends body to a method of the bot api and decodes its result into result if it is not nil
+func (b *TelegramBot) call(method string, contentType string, body io.Reader, result interface{}) error {
+	res, err := b.client.Post(b.apiURL+"/bot"+b.token+"/"+method, contentType, body)
+	if err != nil {
+		// errors of the http client contain the url and with it the token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer res.Body.Close()
+
+	var r telegramResponse
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, res.Status)
+	}
+	if !r.OK {
+		return fmt.Errorf("telegram %s: %s", method, r.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+func (b *TelegramBot) callJSON(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return b.call(method, "application/json", bytes.NewReader(body), result)
+}
+
+func (b *TelegramBot) SendMessage(chatID int64, text string) error {
+	return b.callJSON("sendMessage", map[string]interface{}{"chat_id": chatID, "text": text}, nil)
+}
+
+// SendDocument sends content as a file called name
+func (b *TelegramBot) SendDocument(chatID int64, name string, content []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("chat_id", fmt.Sprint(chatID)); err != nil {
+		return err
+	}
+	part, err := w.CreateFormFile("document", name)
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(content); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return b.call("sendDocument", w.FormDataContentType(), &body, nil)
+}
+
+// Run long polls the bot api for messages and answers them
+func (b *TelegramBot) Run() {
+	for {
+		var updates []telegramUpdate
+		err := b.callJSON("getUpdates", map[string]interface{}{"offset": b.offset, "timeout": telegramPollTimeout, "allowed_updates": []string{"message"}}, &updates)
+		if err != nil {
+			logger.Error(err.Error())
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		for _, u := range updates {
+			b.offset = u.UpdateID + 1
+			if u.Message == nil {
+				continue
+			}
+			if err = b.handle(u.Message.Chat.ID, u.Message.Text); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// handle answers a command sent to chatID
+func (b *TelegramBot) handle(chatID int64, text string) error {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// commands in groups are sent as /command@bot
+	command, _, _ := strings.Cut(fields[0], "@")
+
+	if command == "/start" {
+		if len(fields) < 2 {
+			return b.SendMessage(chatID, "Open the Telegram link on your peer's page to link this chat to it.")
+		}
+		return b.link(chatID, fields[1])
+	}
+
+	if command != "/usage" && command != "/expiry" && command != "/config" {
+		return b.SendMessage(chatID, "/usage shows used and remaining traffic\n/expiry shows when your peer expires\n/config sends your WireGuard config")
+	}
+
+	linked := chatPeers(chatID)
+	if len(linked) == 0 {
+		return b.SendMessage(chatID, "This chat is not linked to a peer. Open the Telegram link on your peer's page to link it.")
+	}
+
+	for _, p := range linked {
+		var err error
+		if command == "/usage" {
+			err = b.SendMessage(chatID, usageMessage(p, time.Now()))
+		} else if command == "/expiry" {
+			err = b.SendMessage(chatID, expiryMessage(p, time.Now()))
+		} else {
+			var settings ClientSettings
+			var conf string
+			if settings, err = clientSettings(&p); err == nil {
+				if conf, err = renderClientConfig(&p, settings); err == nil {
+					err = b.SendDocument(chatID, p.Name+".conf", []byte(conf))
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// link links chatID to the peer the token of the start link was created for and uses up the token
+func (b *TelegramBot) link(chatID int64, token string) error {
+	hash := hashLinkToken(token)
+
+	peers.mu.RLock()
+	var p *Peer
+	for _, candidate := range peers.peers {
+		if candidate.TelegramLinkHash == hash {
+			p = candidate
+			break
+		}
+	}
+	var name string
+	var expired, linked bool
+	if p != nil {
+		name = p.Name
+		expired = p.TelegramLinkExpiry < time.Now().UnixMilli()
+		linked = p.TelegramChatID != 0 && p.TelegramChatID != chatID && !p.TelegramRelink
+	}
+	peers.mu.RUnlock()
+	if p == nil {
+		return b.SendMessage(chatID, "This link is not valid or was already used.")
+	}
+	if expired {
+		return b.SendMessage(chatID, "This link expired, create a new one on your peer's page.")
+	}
+	if linked {
+		return b.SendMessage(chatID, "This peer is already linked to another chat.")
+	}
+
+	// update peer on database, the token can only be used once
+	err := store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{
+		"telegramChatID": chatID, "telegramLinkHash": "", "telegramLinkExpiry": int64(0), "telegramRelink": false,
+	}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", name))
+		return b.SendMessage(chatID, "Linking failed, please try again later.")
+	}
+
+	// update peer in local map
+	peers.mu.Lock()
+	p.TelegramChatID = chatID
+	p.TelegramLinkHash = ""
+	p.TelegramLinkExpiry = 0
+	p.TelegramRelink = false
+	peers.mu.Unlock()
+
+	logger.Info("Telegram chat linked", slog.String("peer", name))
+	return b.SendMessage(chatID, fmt.Sprintf("This chat is now linked to %s. Send /usage, /expiry or /config.", name))
+}
+
+// Notify sends n to the chats of the peer and its owner
+func (b *TelegramBot) Notify(n *Notification) error {
+	peers.mu.RLock()
+	var chats []int64
+	if p, ok := peers.peers[n.PeerID]; ok && p.TelegramChatID != 0 {
+		chats = append(chats, p.TelegramChatID)
+	}
+	if o, ok := peers.peers[n.OwnerID]; ok && o.TelegramChatID != 0 && !slices.Contains(chats, o.TelegramChatID) {
+		chats = append(chats, o.TelegramChatID)
+	}
+	peers.mu.RUnlock()
+
+	for _, chatID := range chats {
+		if err := b.SendMessage(chatID, n.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashLinkToken returns the hash that is stored instead of the token of a start link
+func hashLinkToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// PostTelegramLink creates a single use start link that links the chat opening it to the peer.
+// A peer that is already linked to a chat keeps it unless relinking is asked for.
+func PostTelegramLink(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	if config.TelegramBotID == "" {
+		return ctx.String(404, "telegram bot is not configured")
+	}
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	peers.mu.RLock()
+	p, ok := peers.peers[id]
+	var linked bool
+	if ok {
+		linked = p.TelegramChatID != 0
+	}
+	peers.mu.RUnlock()
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	// peers can link their own chats and chats of peers they can manage
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+
+	var data struct {
+		Relink bool `json:"relink"`
+	}
+	if err = json.NewDecoder(ctx.Request().Body).Decode(&data); err != nil && err != io.EOF {
+		return ctx.String(400, err.Error())
+	}
+	if linked && !data.Relink {
+		return ctx.String(409, "peer is already linked to a chat, ask for relinking to replace it")
+	}
+
+	// generate token, start parameters can only hold url safe base64 characters
+	b := make([]byte, 24)
+	if _, err = rand.Read(b); err != nil {
+		return ctx.String(500, err.Error())
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiry := time.Now().Add(telegramLinkLifetime).UnixMilli()
+
+	// a new link replaces the previous one
+	err = store.UpdatePeers([]PeerUpdate{{ID: p.ID, Set: map[string]interface{}{
+		"telegramLinkHash": hashLinkToken(token), "telegramLinkExpiry": expiry, "telegramRelink": data.Relink,
+	}}})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	peers.mu.Lock()
+	p.TelegramLinkHash = hashLinkToken(token)
+	p.TelegramLinkExpiry = expiry
+	p.TelegramRelink = data.Relink
+	peers.mu.Unlock()
+
+	logger.Info("Telegram link created", slog.String("peer", p.Name))
+	audit(ctx, "peer.telegramLink", "peer", p.ID, p.Name, nil)
+
+	return ctx.JSON(200, map[string]interface{}{"link": "https://t.me/" + config.TelegramBotID + "?start=" + token, "expiresAt": expiry})
+}
+
+// chatPeers returns copies of peers linked to chatID
+func chatPeers(chatID int64) []Peer {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+	var linked []Peer
+	for _, p := range peers.peers {
+		if p.TelegramChatID == chatID {
+			linked = append(linked, *p)
+		}
+	}
+	slices.SortFunc(linked, func(a, b Peer) int { return strings.Compare(a.Name, b.Name) })
+	return linked
+}
+
+func usageMessage(p Peer, now time.Time) string {
+	used := p.TotalTX + p.TotalRX
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\nUsed: %s", p.Name, formatBytes(used))
+	if p.AllowedUsage > 0 {
+		fmt.Fprintf(&sb, " of %s (%d%%)\nRemaining: %s", formatBytes(p.AllowedUsage), used*100/p.AllowedUsage, formatBytes(max(p.AllowedUsage-used, 0)))
+	}
+	if p.Period != nil && p.Period.End > now.UnixMilli() {
+		fmt.Fprintf(&sb, "\nRenews on %s", time.UnixMilli(p.Period.End).UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if p.Disabled {
+		sb.WriteString("\nDisabled")
+	} else if p.Throttled {
+		sb.WriteString("\nThrottled")
+	}
+	return sb.String()
+}
+
+func expiryMessage(p Peer, now time.Time) string {
+	at := time.UnixMilli(p.ExpiresAt).UTC().Format("2006-01-02 15:04 MST")
+	left := time.Duration(p.ExpiresAt-now.UnixMilli()) * time.Millisecond
+	if left <= 0 {
+		return fmt.Sprintf("%s expired on %s", p.Name, at)
+	}
+	return fmt.Sprintf("%s expires in %s, on %s", p.Name, formatDays(left), at)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// telegramStub is a bot api that records sent messages
+type telegramStub struct {
+	messages []telegramMessage
+	mu       sync.Mutex
+}
+
+type telegramMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+func (s *telegramStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bottest-token/sendMessage" {
+		w.Write([]byte(`{"ok":false,"description":"Not Found"}`))
+		return
+	}
+	var m telegramMessage
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.Write([]byte(`{"ok":false,"description":"Bad Request"}`))
+		return
+	}
+	s.mu.Lock()
+	s.messages = append(s.messages, m)
+	s.mu.Unlock()
+	w.Write([]byte(`{"ok":true,"result":{}}`))
+}
+
+// last returns the last message sent and forgets every message
+func (s *telegramStub) last(t *testing.T) telegramMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		t.Fatal("no message was sent")
+	}
+	m := s.messages[len(s.messages)-1]
+	s.messages = nil
+	return m
+}
+
+// setupTelegramTest returns a bot talking to a stub and stores p and its owner o in a bolt database and the local map
+func setupTelegramTest(t *testing.T, p *Peer, o *Peer) (*TelegramBot, *telegramStub) {
+	originalLogger, originalStore := logger, store
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := NewBoltStorage(filepath.Join(t.TempDir(), "wgui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() {
+		s.Close()
+		logger, store = originalLogger, originalStore
+	})
+
+	for _, peer := range []*Peer{p, o} {
+		if err = store.InsertPeer(peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPeers(t, p, o)
+
+	stub := &telegramStub{}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	return NewTelegramBot(server.URL, "test-token"), stub
+}
+
+func TestTelegramBot(t *testing.T) {
+	now := time.Now()
+	p := &Peer{ID: "peer", Name: "peer", AllowedIPs: "10.0.0.2/32", OwnerID: "owner", AllowedUsage: 1000, TotalTX: 100, TotalRX: 150,
+		TelegramLinkHash: hashLinkToken("token"), TelegramLinkExpiry: now.Add(time.Hour).UnixMilli()}
+	o := &Peer{ID: "owner", Name: "owner", AllowedIPs: "10.0.0.3/32", TelegramChatID: 2}
+	b, stub := setupTelegramTest(t, p, o)
+
+	// chats that are not linked are told how to link them
+	if err := b.handle(1, "/usage"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); m.ChatID != 1 || !strings.Contains(m.Text, "not linked") {
+		t.Errorf("/usage of a chat that is not linked sent %+v", m)
+	}
+
+	// links with a wrong token do nothing
+	if err := b.handle(1, "/start wrong"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "not valid") || p.TelegramChatID != 0 {
+		t.Errorf("/start with a wrong token sent %+v and linked chat %d", m, p.TelegramChatID)
+	}
+
+	// the token links the chat once
+	if err := b.handle(1, "/start token"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "now linked to peer") {
+		t.Errorf("/start sent %+v", m)
+	}
+	if p.TelegramChatID != 1 || p.TelegramLinkHash != "" {
+		t.Errorf("after /start chat is %d and link hash is %q, want 1 and none", p.TelegramChatID, p.TelegramLinkHash)
+	}
+	stored, err := store.GetPeer(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TelegramChatID != 1 || stored.TelegramLinkHash != "" {
+		t.Errorf("after /start stored chat is %d and link hash is %q, want 1 and none", stored.TelegramChatID, stored.TelegramLinkHash)
+	}
+
+	if err = b.handle(3, "/start token"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "already used") || p.TelegramChatID != 1 {
+		t.Errorf("reusing the token sent %+v and linked chat %d", m, p.TelegramChatID)
+	}
+
+	// linked chats get usage of their peers
+	if err = b.handle(1, "/usage@wgui_bot"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); m.ChatID != 1 || !strings.HasPrefix(m.Text, "peer\nUsed: ") || !strings.Contains(m.Text, "(25%)") {
+		t.Errorf("/usage sent %+v", m)
+	}
+
+	// notifications go to chats of the peer and its owner
+	if err = b.Notify(&Notification{PeerID: p.ID, OwnerID: o.ID, Message: "warning"}); err != nil {
+		t.Fatal(err)
+	}
+	stub.mu.Lock()
+	got := stub.messages
+	stub.mu.Unlock()
+	want := []telegramMessage{{ChatID: 1, Text: "warning"}, {ChatID: 2, Text: "warning"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Notify sent %+v, want %+v", got, want)
+	}
+}
+
+func TestTelegramLinkExpiredOrLinked(t *testing.T) {
+	now := time.Now()
+	p := &Peer{ID: "peer", Name: "peer", AllowedIPs: "10.0.0.2/32", TelegramChatID: 5,
+		TelegramLinkHash: hashLinkToken("token"), TelegramLinkExpiry: now.Add(time.Hour).UnixMilli()}
+	o := &Peer{ID: "owner", Name: "owner", AllowedIPs: "10.0.0.3/32"}
+	b, stub := setupTelegramTest(t, p, o)
+
+	// a peer linked to a chat keeps it unless relinking was asked for
+	if err := b.handle(1, "/start token"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "already linked") || p.TelegramChatID != 5 {
+		t.Errorf("/start of a linked peer sent %+v and linked chat %d", m, p.TelegramChatID)
+	}
+
+	p.TelegramRelink = true
+	if err := b.handle(1, "/start token"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "now linked") || p.TelegramChatID != 1 || p.TelegramRelink {
+		t.Errorf("/start of a relink sent %+v and linked chat %d", m, p.TelegramChatID)
+	}
+
+	// expired links are refused
+	p.TelegramLinkHash = hashLinkToken("old")
+	p.TelegramLinkExpiry = now.Add(-time.Minute).UnixMilli()
+	if err := b.handle(3, "/start old"); err != nil {
+		t.Fatal(err)
+	}
+	if m := stub.last(t); !strings.Contains(m.Text, "expired") || p.TelegramChatID != 1 {
+		t.Errorf("/start of an expired link sent %+v and linked chat %d", m, p.TelegramChatID)
+	}
+}
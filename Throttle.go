@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// policies for peers that used their allowed usage
+const (
+	overQuotaDisable  = "disable"
+	overQuotaThrottle = "throttle"
+)
+
+// validOverQuota checks if policy is a known over quota policy, empty means disable
+func validOverQuota(policy string) bool {
+	return policy == "" || policy == overQuotaDisable || policy == overQuotaThrottle
+}
+
+// throttles checks if peer is slowed down instead of disabled when it is over quota,
+// peers are disabled if this server can not shape traffic
+func (peer *Peer) throttles() bool {
+	return peer.OverQuota == overQuotaThrottle && shaper != nil
+}
+
+// setThrottled throttles or unthrottles p on this server
+func setThrottled(p *Peer, throttled bool) {
+	peers.mu.Lock()
+	p.Throttled = throttled
+	peers.mu.Unlock()
+
+	err := shapePeer(p)
+	if err != nil {
+		// try again in the next iteration
+		peers.mu.Lock()
+		p.Throttled = !throttled
+		peers.mu.Unlock()
+		logger.Error(err.Error(), slog.String("peer", p.Name))
+		return
+	}
+
+	if throttled {
+		logger.Info("Peer Throttled", slog.String("peer", p.Name))
+	} else {
+		logger.Info("Peer Unthrottled", slog.String("peer", p.Name))
+	}
+}
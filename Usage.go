@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// steps of stored usage buckets, minute buckets are compacted to hourly and then daily buckets as they age
+const (
+	usageMinute = "minute"
+	usageHour   = "hour"
+	usageDay    = "day"
+)
+
+var usageSteps = map[string]time.Duration{usageMinute: time.Minute, usageHour: time.Hour, usageDay: time.Hour * 24}
+
+// UsageBucket is the traffic of one peer through one server in a minute, hour or day
+type UsageBucket struct {
+	ID      string             `json:"-" bson:"_id"` // made from the other fields so rollups can be repeated safely
+	PeerID  string             `json:"PeerID" bson:"peerID"`
+	GroupID primitive.ObjectID `json:"GroupID" bson:"groupID"` // group of the peer when the traffic was recorded
+	Server  string             `json:"Server" bson:"server"`
+	Step    string             `json:"Step" bson:"step"`
+	Time    int64              `json:"Time" bson:"time"` // start of the bucket in milliseconds, aligned to its step in utc
+	TX      int64              `json:"TX" bson:"tx"`
+	RX      int64              `json:"RX" bson:"rx"`
+}
+
+// UsageFilter selects usage buckets, empty fields match everything
+type UsageFilter struct {
+	PeerID  string
+	GroupID primitive.ObjectID
+	Server  string
+	From    int64 // milliseconds, inclusive
+	To      int64 // milliseconds, exclusive
+}
+
+func usageBucketID(step string, server string, peerID string, groupID primitive.ObjectID, t int64) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%d", step, server, peerID, groupID.Hex(), t)
+}
+
+// rollupBuckets sums buckets into buckets of step to
+func rollupBuckets(buckets []*UsageBucket, to string) []*UsageBucket {
+	size := usageSteps[to].Milliseconds()
+	sums := make(map[string]*UsageBucket)
+	var result []*UsageBucket
+	for _, b := range buckets {
+		t := b.Time - b.Time%size
+		id := usageBucketID(to, b.Server, b.PeerID, b.GroupID, t)
+		sum, ok := sums[id]
+		if !ok {
+			sum = &UsageBucket{ID: id, PeerID: b.PeerID, GroupID: b.GroupID, Server: b.Server, Step: to, Time: t}
+			sums[id] = sum
+			result = append(result, sum)
+		}
+		sum.TX += b.TX
+		sum.RX += b.RX
+	}
+	return result
+}
+
+// usageRecorder collects traffic of the current minute before it is written to database
+var usageRecorder = struct {
+	buckets map[string]*UsageBucket
+	mu      sync.Mutex
+}{buckets: make(map[string]*UsageBucket)}
+
+// recordUsage adds traffic of a peer to its minute bucket of t
+func recordUsage(u PeerUsage, t time.Time) {
+	if u.TX <= 0 && u.RX <= 0 {
+		return
+	}
+	start := t.UnixMilli() - t.UnixMilli()%time.Minute.Milliseconds()
+	id := usageBucketID(usageMinute, config.PublicAddress, u.ID, u.GroupID, start)
+
+	usageRecorder.mu.Lock()
+	defer usageRecorder.mu.Unlock()
+	b, ok := usageRecorder.buckets[id]
+	if !ok {
+		b = &UsageBucket{ID: id, PeerID: u.ID, GroupID: u.GroupID, Server: config.PublicAddress, Step: usageMinute, Time: start}
+		usageRecorder.buckets[id] = b
+	}
+	b.TX += u.TX
+	b.RX += u.RX
+}
+
+// flushUsage writes minute buckets that ended before t to database, they are kept for the next flush if writing fails
+func flushUsage(t time.Time) {
+	current := t.UnixMilli() - t.UnixMilli()%time.Minute.Milliseconds()
+
+	usageRecorder.mu.Lock()
+	var buckets []*UsageBucket
+	for id, b := range usageRecorder.buckets {
+		if b.Time < current {
+			buckets = append(buckets, b)
+			delete(usageRecorder.buckets, id)
+		}
+	}
+	usageRecorder.mu.Unlock()
+
+	if len(buckets) == 0 {
+		return
+	}
+	err := store.AddUsage(buckets)
+	if err != nil {
+		logger.Error(err.Error())
+		usageRecorder.mu.Lock()
+		for _, b := range buckets {
+			if existing, ok := usageRecorder.buckets[b.ID]; ok {
+				existing.TX += b.TX
+				existing.RX += b.RX
+			} else {
+				usageRecorder.buckets[b.ID] = b
+			}
+		}
+		usageRecorder.mu.Unlock()
+	}
+}
+
+// compactUsage rolls old minute buckets of this server into hourly buckets, old hourly buckets into daily buckets and removes expired daily buckets
+func compactUsage() {
+	minuteRetention := time.Duration(config.UsageMinuteRetention) * time.Hour
+	if minuteRetention <= 0 {
+		minuteRetention = time.Hour * 48
+	}
+	hourRetention := time.Duration(config.UsageHourRetention) * time.Hour * 24
+	if hourRetention <= 0 {
+		hourRetention = time.Hour * 24 * 60
+	}
+	dayRetention := time.Duration(config.UsageDayRetention) * time.Hour * 24
+
+	hour, day := time.Hour.Milliseconds(), (time.Hour * 24).Milliseconds()
+	for {
+		now := time.Now().UnixMilli()
+
+		// cutoffs are aligned to the target step so every bucket of a window is rolled up at once
+		minuteCutoff := now - minuteRetention.Milliseconds()
+		minuteCutoff -= minuteCutoff % hour
+		hourCutoff := min(now-hourRetention.Milliseconds(), minuteCutoff)
+		hourCutoff -= hourCutoff % day
+
+		err := store.RollupUsage(config.PublicAddress, usageMinute, usageHour, minuteCutoff)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		err = store.RollupUsage(config.PublicAddress, usageHour, usageDay, hourCutoff)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		if dayRetention > 0 {
+			err = store.DeleteUsage(config.PublicAddress, usageDay, now-dayRetention.Milliseconds())
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		}
+
+		time.Sleep(time.Minute * 10)
+	}
+}
+
+type UsagePoint struct {
+	Time int64 `json:"Time"`
+	TX   int64 `json:"TX"`
+	RX   int64 `json:"RX"`
+}
+
+// getUsage reads from, to, step and server query parameters and returns traffic matching filter summed per step
+func getUsage(ctx echo.Context, filter UsageFilter) error {
+	var err error
+	filter.To = time.Now().UnixMilli()
+	if v := ctx.QueryParam("to"); v != "" {
+		if filter.To, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ctx.String(400, "invalid to")
+		}
+	}
+	filter.From = filter.To - (time.Hour * 24).Milliseconds()
+	if v := ctx.QueryParam("from"); v != "" {
+		if filter.From, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ctx.String(400, "invalid from")
+		}
+	}
+	step := time.Hour
+	if v := ctx.QueryParam("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < time.Minute || step%time.Minute != 0 {
+			return ctx.String(400, "step must be a whole number of minutes like 5m, 1h or 24h")
+		}
+	}
+	if server := ctx.QueryParam("server"); server != "" && filter.Server == "" {
+		filter.Server = server
+	}
+
+	// align range to step so points start on round times
+	size := step.Milliseconds()
+	filter.From -= filter.From % size
+	if filter.To <= filter.From {
+		return ctx.String(400, "to must be after from")
+	}
+	count := (filter.To - filter.From + size - 1) / size
+	if count > 10000 {
+		return ctx.String(400, "too many points, use a larger step")
+	}
+
+	buckets, err := store.GetUsage(filter)
+	if err != nil {
+		logger.Error(err.Error())
+		return ctx.String(500, err.Error())
+	}
+
+	// buckets larger than step are counted in the point they start in
+	points := make([]UsagePoint, count)
+	for i := range points {
+		points[i].Time = filter.From + int64(i)*size
+	}
+	var totalTX, totalRX int64
+	for _, b := range buckets {
+		i := (b.Time - filter.From) / size
+		if i < 0 || i >= count {
+			continue
+		}
+		points[i].TX += b.TX
+		points[i].RX += b.RX
+		totalTX += b.TX
+		totalRX += b.RX
+	}
+
+	return ctx.JSON(200, map[string]interface{}{"from": filter.From, "to": filter.To, "step": size, "totalTX": totalTX, "totalRX": totalRX, "points": points})
+}
+
+func GetPeerUsage(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// decode uri
+	id, err := url.QueryUnescape(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if peer exists
+	p, ok := peers.peers[id]
+	if !ok {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessPeer(peer, p) || !keyAllowsName(ctx, p.Name) {
+		return ctx.NoContent(403)
+	}
+
+	return getUsage(ctx, UsageFilter{PeerID: p.ID})
+}
+
+func GetGroupUsage(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if group exists
+	group, err := store.GetGroup(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	if !canAccessGroup(peer, group) || !keyAllowsName(ctx, group.Name) {
+		return ctx.NoContent(403)
+	}
+
+	return getUsage(ctx, UsageFilter{GroupID: group.ID})
+}
+
+func GetServerUsage(ctx echo.Context) error {
+	server, err := url.QueryUnescape(ctx.Param("address"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+	return getUsage(ctx, UsageFilter{Server: server})
+}
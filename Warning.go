@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// usageWarnings returns percents of allowed usage peers are warned at
+func usageWarnings() []int {
+	if config.UsageWarnings == nil {
+		return []int{80, 95}
+	}
+	return config.UsageWarnings
+}
+
+// expiryWarnings returns days before expiry peers are warned at
+func expiryWarnings() []int {
+	if config.ExpiryWarnings == nil {
+		return []int{3, 1}
+	}
+	return config.ExpiryWarnings
+}
+
+// checkWarnings notifies about thresholds peer crossed and rearms thresholds it is back under, like after a new period or a top-up.
+// Sent warnings are stored on the peer so each is sent once, the returned update is nil if nothing changed.
+func checkWarnings(peer *Peer, now time.Time) *PeerUpdate {
+	// totals and expiry are the same on every server so only the main server checks them
+	if !config.IsMainServer {
+		return nil
+	}
+
+	peers.mu.RLock()
+	warnings := maps.Clone(peer.Warnings)
+	used, allowedUsage, expiresAt := peer.TotalTX+peer.TotalRX, peer.AllowedUsage, peer.ExpiresAt
+	id, name, ownerID := peer.ID, peer.Name, peer.OwnerID
+	peers.mu.RUnlock()
+	if warnings == nil {
+		warnings = make(map[string]int64)
+	}
+
+	var sent []*Notification
+	changed := false
+	for _, percent := range usageWarnings() {
+		key := fmt.Sprintf("usage:%d", percent)
+		crossed := allowedUsage > 0 && used*100 >= allowedUsage*int64(percent)
+		if crossed && warnings[key] == 0 {
+			warnings[key] = now.UnixMilli()
+			changed = true
+			sent = append(sent, &Notification{
+				Event: eventUsageWarning, Threshold: percent,
+				Message: fmt.Sprintf("%s has used %d%% of its allowed usage (%s of %s)", name, percent, formatBytes(used), formatBytes(allowedUsage)),
+			})
+		} else if !crossed && warnings[key] != 0 {
+			delete(warnings, key)
+			changed = true
+		}
+	}
+	for _, days := range expiryWarnings() {
+		key := fmt.Sprintf("expiry:%d", days)
+		left := time.Duration(expiresAt-now.UnixMilli()) * time.Millisecond
+		crossed := left <= time.Duration(days)*time.Hour*24
+		if crossed && warnings[key] == 0 {
+			warnings[key] = now.UnixMilli()
+			changed = true
+			// peers that already expired are disabled instead
+			if left > 0 {
+				sent = append(sent, &Notification{
+					Event: eventExpiryWarning, Threshold: days,
+					Message: fmt.Sprintf("%s expires in %s, on %s", name, formatDays(left), time.UnixMilli(expiresAt).UTC().Format("2006-01-02 15:04 MST")),
+				})
+			}
+		} else if !crossed && warnings[key] != 0 {
+			delete(warnings, key)
+			changed = true
+		}
+	}
+
+	for _, n := range sent {
+		n.PeerID, n.PeerName, n.OwnerID, n.Time = id, name, ownerID, now.UnixMilli()
+		bus.Publish(PeerWarned{Notification: *n})
+	}
+	if !changed {
+		return nil
+	}
+
+	peers.mu.Lock()
+	peer.Warnings = warnings
+	peers.mu.Unlock()
+	return &PeerUpdate{ID: id, Set: map[string]interface{}{"warnings": warnings}}
+}
+
+// formatDays formats d in days and hours for messages
+func formatDays(d time.Duration) string {
+	days, hours := int(d/(time.Hour*24)), int(d%(time.Hour*24)/time.Hour)
+	if days == 0 {
+		return fmt.Sprintf("%d hours", hours)
+	}
+	return fmt.Sprintf("%d days and %d hours", days, hours)
+}
+
+// decodeWarnings converts sent warnings from change streams and updated fields
+func decodeWarnings(v interface{}) (map[string]int64, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if warnings, ok := v.(map[string]int64); ok {
+		return warnings, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var warnings map[string]int64
+	err = bson.Unmarshal(b, &warnings)
+	return warnings, err
+}
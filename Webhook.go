@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// events only sent to webhooks, the others are notifications
+const (
+	eventPeerCreated         = "peer.created"
+	eventPeerDeleted         = "peer.deleted"
+	eventGroupQuotaExhausted = "group.quota_exhausted"
+	eventGroupExpired        = "group.expired"
+	eventGroupEnabled        = "group.enabled"
+)
+
+// events webhooks can subscribe to
+var webhookEvents = []string{
+	eventPeerCreated, eventPeerDisabled, eventPeerEnabled, eventPeerDeleted, eventUsageWarning, eventExpiryWarning,
+	eventGroupQuotaExhausted, eventGroupExpired, eventGroupEnabled,
+}
+
+// statuses of deliveries
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookBackoff is the wait before each retry of a failed delivery, the delivery fails after the last one
+var webhookBackoff = []time.Duration{time.Second * 30, time.Minute * 2, time.Minute * 10, time.Minute * 30, time.Hour, time.Hour * 3, time.Hour * 6}
+
+// days deliveries are kept in the delivery log
+const webhookDeliveryRetention = 30
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+type Webhook struct {
+	ID        primitive.ObjectID `json:"ID" bson:"_id"`
+	URL       string             `json:"URL" bson:"url"`
+	Events    []string           `json:"Events" bson:"events"` // empty means every event
+	Secret    string             `json:"-" bson:"secret"`      // key of the hmac signature, only shown when it is set
+	Disabled  bool               `json:"Disabled" bson:"disabled"`
+	CreatedAt int64              `json:"CreatedAt" bson:"createdAt"`
+}
+
+// Subscribes checks if events of type event are sent to webhook
+func (w *Webhook) Subscribes(event string) bool {
+	return !w.Disabled && (len(w.Events) == 0 || slices.Contains(w.Events, event))
+}
+
+// WebhookDelivery is one event sent to one webhook with the result of its last attempt
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `json:"ID" bson:"_id"`
+	WebhookID     primitive.ObjectID `json:"WebhookID" bson:"webhookID"`
+	Event         string             `json:"Event" bson:"event"`
+	Payload       string             `json:"Payload" bson:"payload"`
+	Server        string             `json:"Server" bson:"server"` // server that sends and retries the delivery
+	Status        string             `json:"Status" bson:"status"`
+	Attempts      int                `json:"Attempts" bson:"attempts"`
+	NextAttemptAt int64              `json:"NextAttemptAt" bson:"nextAttemptAt"` // time a pending delivery is retried
+	LastAttemptAt int64              `json:"LastAttemptAt" bson:"lastAttemptAt"`
+	ResponseCode  int                `json:"ResponseCode" bson:"responseCode"`
+	Error         string             `json:"Error" bson:"error"`
+	CreatedAt     int64              `json:"CreatedAt" bson:"createdAt"`
+}
+
+// WebhookEvent is the body of a delivery
+type WebhookEvent struct {
+	ID        string        `json:"ID"` // same in every delivery of the event
+	Event     string        `json:"Event"`
+	Time      int64         `json:"Time"`
+	Message   string        `json:"Message,omitempty"`
+	Threshold int           `json:"Threshold,omitempty"`
+	Peer      *WebhookPeer  `json:"Peer,omitempty"`
+	Group     *WebhookGroup `json:"Group,omitempty"`
+}
+
+// WebhookPeer is the part of a peer sent to webhooks, keys are left out
+type WebhookPeer struct {
+	ID           string `json:"ID"`
+	Name         string `json:"Name"`
+	Role         string `json:"Role"`
+	OwnerID      string `json:"OwnerID"`
+	GroupID      string `json:"GroupID,omitempty"`
+	Disabled     bool   `json:"Disabled"`
+	AllowedUsage int64  `json:"AllowedUsage"`
+	ExpiresAt    int64  `json:"ExpiresAt"`
+	TotalTX      int64  `json:"TotalTX"`
+	TotalRX      int64  `json:"TotalRX"`
+}
+
+type WebhookGroup struct {
+	ID           string   `json:"ID"`
+	Name         string   `json:"Name"`
+	OwnerID      string   `json:"OwnerID"`
+	PeerIDs      []string `json:"PeerIDs"`
+	Disabled     bool     `json:"Disabled"`
+	AllowedUsage int64    `json:"AllowedUsage"`
+	ExpiresAt    int64    `json:"ExpiresAt"`
+	TotalTX      int64    `json:"TotalTX"`
+	TotalRX      int64    `json:"TotalRX"`
+}
+
+// webhookPeer copies p for an event, peers.mu must be held if p is in the local map
+func webhookPeer(p *Peer) *WebhookPeer {
+	wp := &WebhookPeer{
+		ID: p.ID, Name: p.Name, Role: p.Role, OwnerID: p.OwnerID, Disabled: p.Disabled,
+		AllowedUsage: p.AllowedUsage, ExpiresAt: p.ExpiresAt, TotalTX: p.TotalTX, TotalRX: p.TotalRX,
+	}
+	if !p.GroupID.IsZero() {
+		wp.GroupID = p.GroupID.Hex()
+	}
+	return wp
+}
+
+func webhookGroup(g *Group) *WebhookGroup {
+	return &WebhookGroup{
+		ID: g.ID.Hex(), Name: g.Name, OwnerID: g.OwnerID, PeerIDs: g.PeerIDs, Disabled: g.Disabled,
+		AllowedUsage: g.AllowedUsage, ExpiresAt: g.ExpiresAt, TotalTX: g.TotalTX, TotalRX: g.TotalRX,
+	}
+}
+
+// publishEvent sends ev to every webhook subscribed to it without blocking the caller
+func publishEvent(ev *WebhookEvent) {
+	ev.ID = primitive.NewObjectID().Hex()
+	if ev.Time == 0 {
+		ev.Time = time.Now().UnixMilli()
+	}
+	go func() {
+		webhooks, err := store.GetWebhooks()
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		for _, w := range webhooks {
+			if !w.Subscribes(ev.Event) {
+				continue
+			}
+
+			// the retry worker only picks the delivery up if the first attempt does not finish it
+			now := time.Now()
+			d := &WebhookDelivery{
+				ID: primitive.NewObjectID(), WebhookID: w.ID, Event: ev.Event, Payload: string(payload), Server: config.PublicAddress,
+				Status: deliveryPending, NextAttemptAt: now.Add(webhookBackoff[0]).UnixMilli(), CreatedAt: now.UnixMilli(),
+			}
+			if err = store.InsertDelivery(d); err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			deliver(w, d)
+		}
+	}()
+}
+
+// signWebhook returns the signature header of payload sent at t, receivers compute the same hmac over "<t>.<payload>" with their secret
+func signWebhook(secret string, t int64, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", t, payload)
+	return fmt.Sprintf("t=%d,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// deliver makes one attempt to send d to w and records its result
+func deliver(w *Webhook, d *WebhookDelivery) {
+	now := time.Now()
+	d.Attempts++
+	d.LastAttemptAt = now.UnixMilli()
+	d.ResponseCode = 0
+	d.Error = ""
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, strings.NewReader(d.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "wgui-webhook")
+		req.Header.Set("X-Wgui-Event", d.Event)
+		req.Header.Set("X-Wgui-Delivery", d.ID.Hex())
+		req.Header.Set("X-Wgui-Signature", signWebhook(w.Secret, now.Unix(), d.Payload))
+		var res *http.Response
+		res, err = webhookClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			d.ResponseCode = res.StatusCode
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				err = errors.New(res.Status)
+			}
+		}
+	}
+
+	if err == nil {
+		d.Status = deliveryDelivered
+	} else if d.Attempts > len(webhookBackoff) {
+		d.Status = deliveryFailed
+		d.Error = err.Error()
+	} else {
+		d.Status = deliveryPending
+		d.Error = err.Error()
+		d.NextAttemptAt = now.Add(webhookBackoff[d.Attempts-1]).UnixMilli()
+	}
+
+	err = store.UpdateDelivery(d.ID, map[string]interface{}{
+		"status": d.Status, "attempts": d.Attempts, "nextAttemptAt": d.NextAttemptAt, "lastAttemptAt": d.LastAttemptAt,
+		"responseCode": d.ResponseCode, "error": d.Error, "server": d.Server,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	if d.Status == deliveryFailed {
+		logger.Warn("Webhook delivery to "+w.URL+" failed after "+fmt.Sprint(d.Attempts)+" attempts: "+d.Error, slog.String("event", d.Event))
+	}
+}
+
+// retryDeliveries retries pending deliveries of this server when they are due and removes old deliveries
+func retryDeliveries() {
+	for {
+		now := time.Now()
+		deliveries, err := store.GetPendingDeliveries(config.PublicAddress, now.UnixMilli())
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		for _, d := range deliveries {
+			w, err := store.GetWebhook(d.WebhookID)
+			if err != nil {
+				// the webhook was deleted since
+				if errors.Is(err, ErrNotFound) {
+					store.UpdateDelivery(d.ID, map[string]interface{}{"status": deliveryFailed, "error": "webhook deleted"})
+				} else {
+					logger.Error(err.Error())
+				}
+				continue
+			}
+			deliver(w, d)
+		}
+
+		err = store.DeleteDeliveries(now.Add(-time.Hour * 24 * webhookDeliveryRetention).UnixMilli())
+		if err != nil {
+			logger.Error(err.Error())
+		}
+
+		time.Sleep(time.Second * 10)
+	}
+}
+
+// webhookNotifier sends notifications to webhooks subscribed to them
+type webhookNotifier struct{}
+
+func (webhookNotifier) Notify(n *Notification) error {
+	ev := &WebhookEvent{Event: n.Event, Time: n.Time, Message: n.Message, Threshold: n.Threshold}
+	peers.mu.RLock()
+	if p, ok := peers.peers[n.PeerID]; ok {
+		ev.Peer = webhookPeer(p)
+	}
+	peers.mu.RUnlock()
+	publishEvent(ev)
+	return nil
+}
+
+// validWebhookURL checks that u is an absolute http or https url
+func validWebhookURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// newWebhookSecret returns a random secret for webhooks created without one
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func GetWebhooks(ctx echo.Context) error {
+	webhooks, err := store.GetWebhooks()
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+	return ctx.JSON(200, webhooks)
+}
+
+func PostWebhooks(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// get webhook info from request body
+	var data struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	err := json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	if !validWebhookURL(data.URL) {
+		return ctx.String(400, "url must be an http or https url")
+	}
+	for _, event := range data.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return ctx.String(400, "unknown event "+event)
+		}
+	}
+	if data.Secret == "" {
+		if data.Secret, err = newWebhookSecret(); err != nil {
+			return ctx.String(500, err.Error())
+		}
+	}
+
+	w := Webhook{ID: primitive.NewObjectID(), URL: data.URL, Events: data.Events, Secret: data.Secret, CreatedAt: time.Now().UnixMilli()}
+	err = store.InsertWebhook(&w)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Webhook "+w.URL+" created", slog.String("peer", peer.Name))
+	audit(ctx, "webhook.create", "webhook", w.ID.Hex(), w.URL, auditChanges(nil, map[string]interface{}{"url": w.URL, "events": w.Events}))
+
+	// the secret is only shown when it is set
+	return ctx.JSON(201, map[string]interface{}{"id": w.ID.Hex(), "secret": w.Secret})
+}
+
+func PatchWebhook(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if webhook exists
+	w, err := store.GetWebhook(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	var data struct {
+		URL      *string   `json:"url"`
+		Events   *[]string `json:"events"`
+		Secret   *string   `json:"secret"`
+		Disabled *bool     `json:"disabled"`
+	}
+	err = json.NewDecoder(ctx.Request().Body).Decode(&data)
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	set := map[string]interface{}{}
+	old := map[string]interface{}{"url": w.URL, "events": w.Events, "disabled": w.Disabled}
+	changed := map[string]interface{}{}
+	if data.URL != nil {
+		if !validWebhookURL(*data.URL) {
+			return ctx.String(400, "url must be an http or https url")
+		}
+		set["url"], changed["url"] = *data.URL, *data.URL
+	}
+	if data.Events != nil {
+		for _, event := range *data.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return ctx.String(400, "unknown event "+event)
+			}
+		}
+		set["events"], changed["events"] = *data.Events, *data.Events
+	}
+	if data.Disabled != nil {
+		set["disabled"], changed["disabled"] = *data.Disabled, *data.Disabled
+	}
+	if data.Secret != nil {
+		if *data.Secret == "" {
+			return ctx.String(400, "secret can not be empty")
+		}
+		set["secret"] = *data.Secret
+	}
+	if len(set) == 0 {
+		return ctx.NoContent(200)
+	}
+
+	err = store.UpdateWebhook(w.ID, set)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Webhook "+w.URL+" updated", slog.String("peer", peer.Name))
+	changes := auditChanges(old, changed)
+	if data.Secret != nil {
+		// only record that the secret changed
+		changes["secret"] = AuditChange{Before: "redacted", After: "redacted"}
+	}
+	audit(ctx, "webhook.update", "webhook", w.ID.Hex(), w.URL, changes)
+
+	return ctx.NoContent(200)
+}
+
+func DeleteWebhook(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if webhook exists
+	w, err := store.GetWebhook(objectID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+
+	err = store.DeleteWebhook(w.ID)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+
+	logger.Info("Webhook "+w.URL+" deleted", slog.String("peer", peer.Name))
+	audit(ctx, "webhook.delete", "webhook", w.ID.Hex(), w.URL, nil)
+
+	return ctx.NoContent(200)
+}
+
+func GetDeliveries(ctx echo.Context) error {
+	// parse id
+	objectID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if webhook exists
+	if _, err = store.GetWebhook(objectID); err != nil {
+		return ctx.NoContent(404)
+	}
+
+	deliveries, err := store.GetDeliveries(objectID)
+	if err != nil {
+		return ctx.String(500, err.Error())
+	}
+	return ctx.JSON(200, deliveries)
+}
+
+func PostRedelivery(ctx echo.Context) error {
+	peer := ctx.Get("peer").(*Peer)
+
+	// parse ids
+	webhookID, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+	deliveryID, err := primitive.ObjectIDFromHex(ctx.Param("deliveryID"))
+	if err != nil {
+		return ctx.NoContent(400)
+	}
+
+	// check if webhook and delivery exist
+	w, err := store.GetWebhook(webhookID)
+	if err != nil {
+		return ctx.NoContent(404)
+	}
+	d, err := store.GetDelivery(deliveryID)
+	if err != nil || d.WebhookID != w.ID {
+		return ctx.NoContent(404)
+	}
+
+	// start a new round of attempts from this server, the retry worker waits for this attempt
+	d.Server = config.PublicAddress
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now().Add(webhookBackoff[0]).UnixMilli()
+	err = store.UpdateDelivery(d.ID, map[string]interface{}{"status": deliveryPending, "server": d.Server, "nextAttemptAt": d.NextAttemptAt})
+	if err != nil {
+		logger.Error(err.Error(), slog.String("peer", peer.Name))
+		return ctx.String(500, err.Error())
+	}
+	deliver(w, d)
+
+	logger.Info("Webhook delivery "+d.ID.Hex()+" to "+w.URL+" redelivered", slog.String("peer", peer.Name))
+	audit(ctx, "webhook.redeliver", "webhook", w.ID.Hex(), w.URL, nil)
+
+	return ctx.JSON(200, d)
+}
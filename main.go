@@ -1,13 +1,14 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"slices"
@@ -17,25 +18,45 @@ import (
 	goSystemd "github.com/alirezasn3/go-systemd"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type Config struct {
-	MongoURI             string   `json:"mongoURI"`
-	DBName               string   `json:"dbName"`
-	InterfaceName        string   `json:"interfaceName"`
-	InterfaceAddress     string   `json:"interfaceAddress"`
-	InterfaceAddressCIDR string   `json:"interfaceAddressCIDR"`
-	PublicAddress        string   `json:"publicAddress"`
-	Endpoints            []string `json:"endpoints"`
-	TelegramBotID        string   `json:"telegramBotID"`
-	IsMainServer         bool     `json:"isMainServer"`
-	BypassKey            string   `json:"bypassKey"`
+	MongoURI               string              `json:"mongoURI"`
+	DBName                 string              `json:"dbName"`
+	InterfaceName          string              `json:"interfaceName"`
+	InterfaceAddress       string              `json:"interfaceAddress"`
+	InterfaceAddressCIDR   string              `json:"interfaceAddressCIDR"`
+	InterfaceAddressV6     string              `json:"interfaceAddressV6"`     // ipv6 address of the interface, optional
+	InterfaceAddressV6CIDR string              `json:"interfaceAddressV6CIDR"` // ipv6 (ula) prefix peers get a second address from, optional
+	PublicAddress          string              `json:"publicAddress"`
+	Endpoints              []string            `json:"endpoints"`
+	TelegramBotID          string              `json:"telegramBotID"`
+	TelegramBotToken       string              `json:"telegramBotToken"` // token of the bot, the bot only runs on the main server and only if this is set
+	TelegramAPIURL         string              `json:"telegramAPIURL"`   // bot api the bot talks to, defaults to https://api.telegram.org
+	IsMainServer           bool                `json:"isMainServer"`
+	Storage                string              `json:"storage"`              // mongo(default) or bolt
+	BoltPath               string              `json:"boltPath"`             // defaults to wgui.db next to config.json
+	SyncMode               string              `json:"syncMode"`             // auto(default), changeStream or poll
+	PollInterval           int                 `json:"pollInterval"`         // seconds between polls, defaults to 5
+	ReconcileInterval      int                 `json:"reconcileInterval"`    // seconds between reconciliations, defaults to 300
+	ReconcileDryRun        bool                `json:"reconcileDryRun"`      // only report drift without fixing it
+	JWTSecret              string              `json:"jwtSecret"`            // used to sign session tokens, a random one is used if empty
+	SessionDuration        int                 `json:"sessionDuration"`      // hours until session tokens expire, defaults to 24
+	Roles                  map[string][]string `json:"roles"`                // permissions of each role, merged with the default admin, distributor and user roles
+	AddressPools           []string            `json:"addressPools"`         // prefixes addresses of peers are allocated from, defaults to interfaceAddressCIDR and interfaceAddressV6CIDR
+	ReservedRanges         []string            `json:"reservedRanges"`       // addresses, prefixes or ranges like 10.0.0.2-10.0.0.9 that are only given out as static addresses
+	UsageMinuteRetention   int                 `json:"usageMinuteRetention"` // hours per minute usage history is kept before it is rolled up hourly, defaults to 48
+	UsageHourRetention     int                 `json:"usageHourRetention"`   // days hourly usage history is kept before it is rolled up daily, defaults to 60
+	UsageDayRetention      int                 `json:"usageDayRetention"`    // days daily usage history is kept, kept forever if 0
+	ThrottleRate           int64               `json:"throttleRate"`         // kbit/s peers with the throttle over quota policy are limited to, defaults to 1024
+	UsageWarnings          []int               `json:"usageWarnings"`        // percents of allowed usage peers are warned at, defaults to 80 and 95
+	ExpiryWarnings         []int               `json:"expiryWarnings"`       // days before expiry peers are warned at, defaults to 3 and 1
+	ClientDNS              []string            `json:"clientDNS"`            // dns servers of client configs, defaults to 1.1.1.1 and 8.8.8.8
+	ClientMTU              int                 `json:"clientMTU"`            // mtu of client configs, left out if 0
+	ClientKeepalive        int                 `json:"clientKeepalive"`      // seconds between keepalives of client configs, left out if 0
 }
 
 type Peers struct {
@@ -43,19 +64,18 @@ type Peers struct {
 	mu    sync.RWMutex
 }
 
-var peers Peers                        // used to intract with peers concurrently
-var config Config                      // used to store app configuration
-var wgc *wgctrl.Client                 // used to interact with wireguard interfaces
-var device *wgtypes.Device             // actual wireguard interface
-var peersCollection *mongo.Collection  // peers collection on database
-var groupsCollection *mongo.Collection // groups collection on database
-var ioWriter CustomWriter              // io writer that writes to database and stdout
-var logger *slog.Logger                // custom logger that writes logs to database and stdout
-var deviceCIDR *net.IPNet              // used to check if client is in device subnet
-var mongoClient *mongo.Client
+var peers Peers                // used to intract with peers concurrently
+var config Config              // used to store app configuration
+var wgc *wgctrl.Client         // used to interact with wireguard interfaces
+var device *wgtypes.Device     // actual wireguard interface
+var store Storage              // peers, groups and logs storage backend
+var ioWriter CustomWriter      // io writer that writes to database and stdout
+var logger *slog.Logger        // custom logger that writes logs to database and stdout
+var deviceCIDRs []netip.Prefix // used to check if client is in device subnets
 var path string
 
-func init() {
+// setup loads config, connects to device and storage and brings device in line with storage
+func setup() {
 	// check for install and uninstall commands
 	if slices.Contains(os.Args, "--install") {
 		execPath, err := os.Executable()
@@ -102,19 +122,22 @@ func init() {
 	}
 	log.Println("Loaded config from " + filepath.Join(path, "config.json"))
 
+	// load role definitions
+	err = loadRoles()
+	if err != nil {
+		panic(err)
+	}
+
 	// check for arguments
 	if slices.Contains(os.Args, "reset-ssis") {
 		// connect to database
-		mongoClient, err = mongo.Connect(context.TODO(), options.Client().ApplyURI(config.MongoURI).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)))
+		store, err = NewStorage(&config)
 		if err != nil {
 			panic(err)
 		}
 		log.Println("Connected to database")
 
-		// load mongodb peers collectoin
-		peersCollection = mongoClient.Database(config.DBName).Collection("peers")
-
-		_, err = peersCollection.UpdateMany(context.Background(), bson.M{}, bson.M{"$set": bson.M{"serverSpecificInfo": []ServerSpecificInfo{}}})
+		err = store.ResetServerSpecificInfo()
 		if err != nil {
 			panic(err)
 		}
@@ -122,7 +145,19 @@ func init() {
 		os.Exit(0)
 	}
 
-	_, deviceCIDR, err = net.ParseCIDR(config.InterfaceAddressCIDR)
+	for _, s := range []string{config.InterfaceAddressCIDR, config.InterfaceAddressV6CIDR} {
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			panic(err)
+		}
+		deviceCIDRs = append(deviceCIDRs, prefix.Masked())
+	}
+
+	// create address pools
+	ipam, err = NewIPAM(&config)
 	if err != nil {
 		panic(err)
 	}
@@ -140,48 +175,14 @@ func init() {
 	}
 
 	// connect to database
-	mongoClient, err = mongo.Connect(context.TODO(), options.Client().ApplyURI(config.MongoURI).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)))
+	store, err = NewStorage(&config)
 	if err != nil {
 		panic(err)
 	}
 	log.Println("Connected to database")
 
-	// load mongodb peers collectoin
-	peersCollection = mongoClient.Database(config.DBName).Collection("peers")
-
-	// load mongodb groups collectoin
-	groupsCollection = mongoClient.Database(config.DBName).Collection("groups")
-
-	// create unique index for allowedIPs
-	_, err = peersCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: bson.M{"allowedIPs": 1}, Options: options.Index().SetUnique(true)})
-	if err != nil {
-		panic(err)
-	}
-
-	// create unique index for peer names
-	_, err = peersCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: bson.M{"name": 1}, Options: options.Index().SetUnique(true)})
-	if err != nil {
-		panic(err)
-	}
-
-	// create unique index for group names
-	_, err = groupsCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: bson.M{"name": 1}, Options: options.Index().SetUnique(true)})
-	if err != nil {
-		panic(err)
-	}
-
-	// create ttl index for logs
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{Key: "expireAt", Value: 1}},
-		Options: options.Index().SetExpireAfterSeconds(0),
-	}
-	_, err = mongoClient.Database(config.DBName).Collection("logs").Indexes().CreateOne(context.TODO(), indexModel)
-	if err != nil {
-		panic(err)
-	}
-
 	// setup logger
-	ioWriter = CustomWriter{W: os.Stdout, LogsCollection: mongoClient.Database(config.DBName).Collection("logs")}
+	ioWriter = CustomWriter{W: os.Stdout, Store: store}
 	logger = slog.New(slog.NewJSONHandler(ioWriter, &slog.HandlerOptions{AddSource: true, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 		if a.Key == "time" {
 			return slog.Int64("time", time.Now().UnixMilli())
@@ -190,19 +191,38 @@ func init() {
 		}
 	}})).With(slog.String("publicAddress", config.PublicAddress))
 
+	// setup session token secret
+	if config.JWTSecret != "" {
+		jwtSecret = []byte(config.JWTSecret)
+	} else {
+		jwtSecret = make([]byte, 32)
+		_, err = rand.Read(jwtSecret)
+		if err != nil {
+			panic(err)
+		}
+		logger.Warn("jwtSecret is not set, session tokens will not survive restarts or work on other servers")
+	}
+
 	// get peers from db
-	var tempPeers []*Peer
-	cursor, err := peersCollection.Find(context.TODO(), bson.D{})
+	peersLoadedAt = time.Now()
+	tempPeers, err := store.GetPeers()
 	if err != nil {
 		panic(err)
 	}
-	if err = cursor.All(context.TODO(), &tempPeers); err != nil {
-		panic(err)
-	}
 	for _, p := range tempPeers {
 		peers.peers[p.PublicKey] = p
 	}
 
+	// give peers created before ownership existed an owner
+	if config.IsMainServer {
+		migratePeerOwners()
+	}
+
+	// give peers created before the ipv6 pool was configured an ipv6 address
+	if config.IsMainServer {
+		backfillV6Addresses()
+	}
+
 	log.Println("Checking for conflicts...")
 
 	// check if any peer exists
@@ -228,45 +248,36 @@ func init() {
 		data.ID = publicKey.String()
 
 		// find unused ip
-		var ip IPAddress
-		err = ip.Parse(config.InterfaceAddress)
+		used, err := usedAddresses()
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", data.Name))
 			panic(err)
 		}
-		ip.Increment()
-
-		// update device
-		device, err = wgc.Device(config.InterfaceName)
+		addr, err := ipam.Allocate(used, false)
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", data.Name))
 			panic(err)
 		}
-
-		for slices.ContainsFunc(device.Peers, func(p wgtypes.Peer) bool {
-			for _, aip := range p.AllowedIPs {
-				if aip.String() == ip.ToString()+"/32" {
-					return true
-				}
+		data.AllowedIPs = addrPrefix(addr)
+		if ipam.HasV6() {
+			addr, err = ipam.Allocate(used, true)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("peer", data.Name))
+				panic(err)
 			}
-			return false
-		}) {
-			ip.Increment()
+			data.AllowedIPsV6 = addrPrefix(addr)
 		}
-
-		_, allowedIPs, err := net.ParseCIDR(ip.ToString() + "/32")
+		allowedIPs, err := data.AllowedIPNets()
 		if err != nil {
-			logger.Error(err.Error(), slog.String("peer", data.Name))
 			panic(err)
 		}
-		data.AllowedIPs = ip.ToString() + "/32"
 
 		var udpAddress *net.UDPAddr = nil
 
 		data.ServerSpecificInfo = []*ServerSpecificInfo{{Address: config.PublicAddress}}
 
 		// add peer to database
-		_, err = peersCollection.InsertOne(context.TODO(), data)
+		err = store.InsertPeer(data)
 		if err != nil {
 			panic(err)
 		}
@@ -274,7 +285,7 @@ func init() {
 		// add peer to device
 		err = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
 			PublicKey:  publicKey,
-			AllowedIPs: []net.IPNet{*allowedIPs},
+			AllowedIPs: allowedIPs,
 			Endpoint:   udpAddress,
 		}}})
 		if err != nil {
@@ -289,7 +300,17 @@ func init() {
 		tempPeers = append(tempPeers, data)
 
 		// save config file
-		err = os.WriteFile(filepath.Join(path, "Admin-0.conf"), []byte(fmt.Sprintf("[Interface]\nPrivateKey=%s\nAddress=%s\nDNS=1.1.1.1,8.8.8.8\n[Peer]\nPublicKey=%s\nAllowedIPs=0.0.0.0/0\nEndpoint=%s:%d\n", data.PrivateKey, data.AllowedIPs, device.PublicKey.String(), config.PublicAddress, device.ListenPort)), 0666)
+		settings, err := clientSettings(data)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", data.Name))
+			panic(err)
+		}
+		conf, err := renderClientConfig(data, settings)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("peer", data.Name))
+			panic(err)
+		}
+		err = os.WriteFile(filepath.Join(path, "Admin-0.conf"), []byte(conf), 0666)
 		if err != nil {
 			logger.Error(err.Error(), slog.String("peer", data.Name))
 			panic(err)
@@ -308,7 +329,7 @@ func init() {
 	}
 
 	// ssi udpates
-	var peersUpdates []mongo.WriteModel
+	var peersUpdates []PeerUpdate
 
 	// add peers from database to device
 	for _, pdb := range peers.peers {
@@ -322,7 +343,7 @@ func init() {
 		if err != nil {
 			panic(err)
 		}
-		_, ipNet, err := net.ParseCIDR(pdb.AllowedIPs)
+		allowedIPs, err := pdb.AllowedIPNets()
 		if err != nil {
 			panic(err)
 		}
@@ -336,55 +357,83 @@ func init() {
 		}
 
 		newPeerConfigurations = append(newPeerConfigurations, wgtypes.PeerConfig{
-			PublicKey:    privateKey.PublicKey(),
-			AllowedIPs:   []net.IPNet{*ipNet},
-			PresharedKey: &presharedKey,
+			PublicKey:         privateKey.PublicKey(),
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowedIPs,
+			PresharedKey:      &presharedKey,
 		})
 
 		// check if this server has server specific entry on database
 		ssi := pdb.FindSSIByAddress(config.PublicAddress)
 		if ssi == nil {
 			// add server specific info entry to database
-			update := mongo.NewUpdateOneModel()
-			update.SetFilter(bson.M{"_id": pdb.ID})
-			update.SetUpdate(bson.M{
-				"$push": bson.M{"serverSpecificInfo": ServerSpecificInfo{Address: config.PublicAddress}},
-			})
-			peersUpdates = append(peersUpdates, update)
+			peersUpdates = append(peersUpdates, PeerUpdate{ID: pdb.ID, SSI: &ServerSpecificInfo{Address: config.PublicAddress}})
 		}
 	}
 
 	// write ssi peersUpdates to database
 	if len(peersUpdates) > 0 {
-		if _, err := peersCollection.BulkWrite(context.TODO(), peersUpdates, &options.BulkWriteOptions{}); err != nil {
+		if err := store.UpdatePeers(peersUpdates); err != nil {
 			logger.Error(err.Error())
 			panic(err)
 		}
 	}
 
+	// remove peers that are not on database, existing peers are updated instead of replaced so their counters are kept
+	for _, dp := range device.Peers {
+		if _, ok := peers.peers[dp.PublicKey.String()]; !ok {
+			newPeerConfigurations = append(newPeerConfigurations, wgtypes.PeerConfig{PublicKey: dp.PublicKey, Remove: true})
+		}
+	}
+
 	// create missing peers
-	err = wgc.ConfigureDevice(device.Name, wgtypes.Config{Peers: newPeerConfigurations, ReplacePeers: true})
+	err = wgc.ConfigureDevice(device.Name, wgtypes.Config{Peers: newPeerConfigurations})
 	if err != nil {
 		logger.Error(err.Error())
 		panic(err)
 	}
 
+	// continue counting usage from where this server stopped
+	restoreCounterBaselines()
+
+	// limit rates of peers with traffic control, peers are disabled instead of throttled without it
+	nlh, err := netlink.NewHandle()
+	if err == nil {
+		shaper, err = NewShaper(nlh, config.InterfaceName)
+	}
+	if err != nil {
+		logger.Error("Traffic shaping is not available: " + err.Error())
+	} else {
+		shapePeers()
+	}
+
+	// connect side effects of state changes
+	subscribe()
+
+	// answer peers and send them notifications on telegram
+	if config.IsMainServer && config.TelegramBotToken != "" {
+		telegram = NewTelegramBot(config.TelegramAPIURL, config.TelegramBotToken)
+		notifiers = append(notifiers, telegram)
+	}
+
 	// log the start of application
 	logger.Info("Server started")
 }
 
 func main() {
+	setup()
+
 	// peers loop
 	go func() {
 		var e error
 		var startTime time.Time
 		var publicKey string
-		var peersUpdates []mongo.WriteModel
-		var groupsUpdates []mongo.WriteModel
+		var peersUpdates []PeerUpdate
+		var groupsUpdates []GroupUpdate
 		var peer *Peer
-		var presharedKey wgtypes.Key
 		var p wgtypes.Peer
 		var ok bool
+		var usage []PeerUsage
 		for {
 			// set starting time of this iteration
 			startTime = time.Now()
@@ -396,6 +445,9 @@ func main() {
 				continue
 			}
 
+			// counters of a recreated interface start from zero
+			checkInterfaceReset()
+
 			// update peers' info
 			for _, p = range device.Peers {
 				// get peer public key
@@ -407,41 +459,20 @@ func main() {
 					continue
 				}
 
-				// check to see if peer should be disabled
-				if startTime.UnixMilli() > peer.ExpiresAt || peer.TotalRX+peer.TotalTX > peer.AllowedUsage {
+				// check to see if peer should be disabled, peers over quota are throttled instead if their policy says so
+				overQuota := peer.TotalRX+peer.TotalTX > peer.AllowedUsage
+				if startTime.UnixMilli() > peer.ExpiresAt || (overQuota && !peer.throttles()) {
 					if !peer.Disabled {
-
-						// create preshared key to invalidate peer
-						presharedKey, e = wgtypes.GenerateKey()
-						if e != nil {
-							logger.Error(e.Error(), slog.String("peer", peer.Name))
-							continue
-						}
-
-						// set peer's preshared key
-						e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{
-							Peers: []wgtypes.PeerConfig{
-								{
-									PublicKey:    p.PublicKey,
-									UpdateOnly:   true,
-									PresharedKey: &presharedKey,
-								},
-							},
-						})
-						if e != nil {
-							logger.Error(e.Error(), slog.String("peer", peer.Name))
-							continue
-						}
-
-						// update peer on database
-						peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": publicKey}).SetUpdate(bson.M{"$set": bson.M{"disabled": true}}))
+						// update peer on database, a subscriber invalidates it on device with a random preshared key
+						peersUpdates = append(peersUpdates, PeerUpdate{ID: publicKey, Set: map[string]interface{}{"disabled": true}})
 
 						// disable peer in local map
 						peers.mu.Lock()
 						peer.Disabled = true
+						disabled := PeerDisabled{Peer: *peer, Expired: startTime.UnixMilli() > peer.ExpiresAt}
 						peers.mu.Unlock()
 
-						logger.Info("Peer Disabled", slog.String("peer", peer.Name))
+						bus.Publish(disabled)
 						continue
 					} else {
 						continue
@@ -449,41 +480,40 @@ func main() {
 				}
 
 				// check to see if peer should be enabled
-				if (startTime.UnixMilli() < peer.ExpiresAt && peer.TotalRX+peer.TotalTX < peer.AllowedUsage) && peer.Disabled {
-					// remove peer's preshared key to enable it
-					e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{
-						Peers: []wgtypes.PeerConfig{
-							{
-								PublicKey:    p.PublicKey,
-								UpdateOnly:   true,
-								PresharedKey: &wgtypes.Key{},
-							},
-						},
-					})
-					if e != nil {
-						logger.Error(e.Error())
-						continue
-					}
-
-					// update peer on database
-					peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": publicKey}).SetUpdate(bson.M{"$set": bson.M{"disabled": false}}))
+				if (startTime.UnixMilli() < peer.ExpiresAt && (peer.TotalRX+peer.TotalTX < peer.AllowedUsage || peer.throttles())) && peer.Disabled {
+					// update peer on database, a subscriber removes its preshared key on device to enable it
+					peersUpdates = append(peersUpdates, PeerUpdate{ID: publicKey, Set: map[string]interface{}{"disabled": false}})
 
 					// update peer on local map
 					peers.mu.Lock()
 					peer.Disabled = false
+					enabled := PeerEnabled{Peer: *peer}
 					peers.mu.Unlock()
 
-					logger.Info("Peer Enabled", slog.String("peer", peer.Name))
+					bus.Publish(enabled)
 					continue
 				}
 
+				// slow down peers over quota and lift it when quota is restored
+				if throttled := overQuota && peer.throttles(); throttled != peer.Throttled {
+					setThrottled(peer, throttled)
+				}
+
+				// warn peer and its owner before it is cut off
+				if update := checkWarnings(peer, startTime); update != nil {
+					peersUpdates = append(peersUpdates, *update)
+				}
+
 				peers.mu.Lock()
 
-				// calculate and update current tx and rx
-				peer.CurrentTX = p.TransmitBytes - peer.TempTX
-				peer.CurrentRX = p.ReceiveBytes - peer.TempRX
+				// calculate and update current tx and rx, counters that went back were reset
+				peer.CurrentTX = counterDelta(p.TransmitBytes, peer.TempTX)
+				peer.CurrentRX = counterDelta(p.ReceiveBytes, peer.TempRX)
 				peer.TempTX = p.TransmitBytes
 				peer.TempRX = p.ReceiveBytes
+				if peer.CurrentTX > 0 || peer.CurrentRX > 0 {
+					usage = append(usage, PeerUsage{ID: peer.ID, Name: peer.Name, OwnerID: peer.OwnerID, GroupID: peer.GroupID, TX: peer.CurrentTX, RX: peer.CurrentRX})
+				}
 
 				// update  current endpoint
 				peer.Endpoint = p.Endpoint.String()
@@ -505,6 +535,9 @@ func main() {
 					Endpoint:          peer.Endpoint,
 					CurrentTX:         peer.CurrentTX,
 					CurrentRX:         peer.CurrentRX,
+					BaselineTX:        peer.TempTX,
+					BaselineRX:        peer.TempRX,
+					InterfaceIndex:    interfaceIndex,
 				}
 
 				peers.mu.Lock()
@@ -519,38 +552,34 @@ func main() {
 
 				peers.mu.Unlock()
 
-				// update ssi on database
-				peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": publicKey, "serverSpecificInfo.address": config.PublicAddress}).SetUpdate(
-					bson.M{"$set": bson.M{"serverSpecificInfo.$": ssi}},
-				))
-
-				// update total tx and rx on database
-				peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": publicKey}).SetUpdate(
-					bson.M{"$inc": bson.M{"totalTX": peer.CurrentTX, "totalRX": peer.CurrentRX}},
-				))
+				// update ssi and total tx and rx on database
+				peersUpdates = append(peersUpdates, PeerUpdate{
+					ID:  publicKey,
+					Inc: map[string]int64{"totalTX": peer.CurrentTX, "totalRX": peer.CurrentRX},
+					SSI: &ssi,
+				})
 
 				if !peer.GroupID.IsZero() {
-					groupsUpdates = append(groupsUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": peer.GroupID}).SetUpdate(
-						bson.M{"$inc": bson.M{"totalTX": peer.CurrentTX, "totalRX": peer.CurrentRX}},
-					))
+					groupsUpdates = append(groupsUpdates, GroupUpdate{
+						ID:  peer.GroupID,
+						Inc: map[string]int64{"totalTX": peer.CurrentTX, "totalRX": peer.CurrentRX},
+					})
 				}
 			}
 
 			// update peers collection
 			if len(peersUpdates) > 0 {
-				_, err := peersCollection.BulkWrite(context.TODO(), peersUpdates, &options.BulkWriteOptions{})
+				err := store.UpdatePeers(peersUpdates)
 				if err != nil {
 					logger.Error(err.Error())
-					panic(err)
 				}
 			}
 
 			// update groups collection
 			if len(groupsUpdates) > 0 {
-				_, err := groupsCollection.BulkWrite(context.TODO(), groupsUpdates, &options.BulkWriteOptions{})
+				err := store.UpdateGroups(groupsUpdates)
 				if err != nil {
 					logger.Error(err.Error())
-					panic(err)
 				}
 			}
 
@@ -560,6 +589,10 @@ func main() {
 			// empty groupsUpdates slice
 			groupsUpdates = nil
 
+			// record usage history and update live feeds
+			bus.Publish(UsageTick{Time: startTime, Usage: usage})
+			usage = nil
+
 			// sleep if a second has not passed
 			time.Sleep(time.Duration(1000-(time.Now().UnixMilli()-startTime.UnixMilli())) * time.Millisecond)
 		}
@@ -572,61 +605,50 @@ func main() {
 		}
 		var e error
 		var startTime int64
-		var peersUpdates []mongo.WriteModel
-		var groupsUpdates []mongo.WriteModel
-		var cursor *mongo.Cursor
+		var peersUpdates []PeerUpdate
+		var groupsUpdates []GroupUpdate
+		var groups []*Group
 		var g *Group
 		var peerID string
 		for {
 			// set starting time of this iteration
 			startTime = time.Now().UnixMilli()
 
-			// get peers from db
-			var groups []*Group
-			cursor, e = groupsCollection.Find(context.TODO(), bson.D{})
+			// get groups from db
+			groups, e = store.GetGroups()
 			if e != nil {
-				panic(e)
-			}
-			if e = cursor.All(context.TODO(), &groups); e != nil {
-				panic(e)
+				logger.Error(e.Error())
+				groups = nil
 			}
 			for _, g = range groups {
 				if g.Disabled && g.TotalRX+g.TotalTX < g.AllowedUsage && startTime < g.ExpiresAt {
-					groupsUpdates = append(groupsUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": g.ID}).SetUpdate(
-						bson.M{"$set": bson.M{"disabled": false}},
-					))
+					groupsUpdates = append(groupsUpdates, GroupUpdate{ID: g.ID, Set: map[string]interface{}{"disabled": false}})
 					for _, peerID = range g.PeerIDs {
-						peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": peerID}).SetUpdate(
-							bson.M{"$set": bson.M{"allowedUsage": g.AllowedUsage}},
-						))
+						peersUpdates = append(peersUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"allowedUsage": g.AllowedUsage}})
 					}
+					bus.Publish(GroupEnabled{Group: *g})
 				} else if !g.Disabled && (g.TotalRX+g.TotalTX > g.AllowedUsage || startTime > g.ExpiresAt) {
-					groupsUpdates = append(groupsUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": g.ID}).SetUpdate(
-						bson.M{"$set": bson.M{"disabled": true}},
-					))
+					groupsUpdates = append(groupsUpdates, GroupUpdate{ID: g.ID, Set: map[string]interface{}{"disabled": true}})
 					for _, peerID = range g.PeerIDs {
-						peersUpdates = append(peersUpdates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": peerID}).SetUpdate(
-							bson.M{"$set": bson.M{"allowedUsage": int64(0)}},
-						))
+						peersUpdates = append(peersUpdates, PeerUpdate{ID: peerID, Set: map[string]interface{}{"allowedUsage": int64(0)}})
 					}
+					bus.Publish(GroupExceeded{Group: *g, Expired: startTime > g.ExpiresAt})
 				}
 			}
 
 			// update peers collection
 			if len(peersUpdates) > 0 {
-				_, err := peersCollection.BulkWrite(context.TODO(), peersUpdates, &options.BulkWriteOptions{})
+				err := store.UpdatePeers(peersUpdates)
 				if err != nil {
 					logger.Error(err.Error())
-					panic(err)
 				}
 			}
 
 			// update groups collection
 			if len(groupsUpdates) > 0 {
-				_, err := groupsCollection.BulkWrite(context.TODO(), groupsUpdates, &options.BulkWriteOptions{})
+				err := store.UpdateGroups(groupsUpdates)
 				if err != nil {
 					logger.Error(err.Error())
-					panic(err)
 				}
 			}
 
@@ -641,258 +663,25 @@ func main() {
 		}
 	}()
 
-	// listen for delete events from database
-	go func() {
-		// create change stream
-		changeStream, e := peersCollection.Watch(context.TODO(), mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "delete"}}}}})
-		if e != nil {
-			logger.Error(e.Error())
-			panic(e)
-		}
-		defer changeStream.Close(context.TODO())
+	// listen for changes made to peers by any server
+	go watchPeers()
 
-		var p *Peer
-		var ok bool
-		var publicKey wgtypes.Key
-
-		// loop over changes
-		for changeStream.Next(context.TODO()) {
-			// parse change
-			var data struct {
-				DocumentKey struct {
-					ID string `bson:"_id"`
-				} `bson:"documentKey"`
-			}
-			if e = changeStream.Decode(&data); e != nil {
-				logger.Error(e.Error())
-				panic(e)
-			}
-
-			// check if peer exists
-			p, ok = peers.peers[data.DocumentKey.ID]
-			if !ok {
-				continue
-			}
-
-			// parse peer public key
-			publicKey, e = wgtypes.ParseKey(p.PublicKey)
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", p.Name))
-				continue
-			}
-
-			// remove peer from device
-			e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, Remove: true}}})
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", p.Name))
-				panic(e)
-			}
-
-			// delete peer from local map
-			peers.mu.Lock()
-			delete(peers.peers, p.PublicKey)
-			peers.mu.Unlock()
-
-			logger.Info("Peer removed", slog.String("peer", p.Name))
-		}
-	}()
-
-	// listen for insert events from database
-	go func() {
-		// create change stream
-		changeStream, e := peersCollection.Watch(context.TODO(), mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}})
-		if e != nil {
-			logger.Error(e.Error())
-			panic(e)
-		}
-		defer changeStream.Close(context.TODO())
-
-		var publicKey wgtypes.Key
-		var allowedIPs *net.IPNet
-
-		// loop over changes
-		for changeStream.Next(context.TODO()) {
-			// parse change
-			var data struct {
-				FullDocument Peer `bson:"fullDocument"`
-			}
-			if e = changeStream.Decode(&data); e != nil {
-				logger.Error(e.Error())
-				panic(e)
-			}
-
-			// check if peer already exists
-			_, ok := peers.peers[data.FullDocument.ID]
-			if ok {
-				continue
-			}
-
-			// parse public key
-			publicKey, e = wgtypes.ParseKey(data.FullDocument.PublicKey)
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", data.FullDocument.Name))
-				continue
-			}
-
-			// parse allowedIPs
-			_, allowedIPs, e = net.ParseCIDR(data.FullDocument.AllowedIPs)
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", data.FullDocument.Name))
-				continue
-			}
-
-			// add peer to device
-			e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, AllowedIPs: []net.IPNet{*allowedIPs}}}})
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", data.FullDocument.Name))
-				panic(e)
-			}
-
-			// add peer to local map
-			peers.mu.Lock()
-			peers.peers[data.FullDocument.PublicKey] = &data.FullDocument
-			peers.mu.Unlock()
-
-			logger.Info("Peer created", slog.String("peer", data.FullDocument.Name))
-
-			// add server specific info entry to database
-			_, e = peersCollection.UpdateByID(context.TODO(), data.FullDocument.ID, bson.M{"$push": bson.M{"serverSpecificInfo": ServerSpecificInfo{Address: config.PublicAddress}}})
-			if e != nil {
-				logger.Error(e.Error(), slog.String("peer", data.FullDocument.Name))
-				panic(e)
-			}
-		}
-	}()
+	// fix drift between database, device and local map
+	go reconcilePeers()
 
-	// listen for update events from database
-	go func() {
-		changeStream, e := peersCollection.Watch(context.TODO(), mongo.Pipeline{bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "update"}}}}})
-		if e != nil {
-			logger.Error(e.Error())
-			panic(e)
-		}
-		var data *struct {
-			DocumentKey struct {
-				ID string `bson:"_id"`
-			} `bson:"documentKey"`
-			UpdateDescription struct {
-				UpdatedFields map[string]interface{} `bson:"updatedFields"`
-			} `bson:"updateDescription"`
-		}
-
-		var ok bool
-		var ssi *ServerSpecificInfo
-		var p *Peer
-		var m map[string]interface{}
+	// roll up and expire usage history of this server
+	go compactUsage()
 
-		for changeStream.Next(context.Background()) {
-			data = nil
-
-			// parse update
-			if e = changeStream.Decode(&data); e != nil {
-				logger.Error(e.Error())
-				panic(e)
-			}
+	// renew allowed usage of peers and groups whose period ended
+	go rollPeriods()
 
-			p, ok = peers.peers[data.DocumentKey.ID]
-			if !ok {
-				logger.Error("Recieved update for a peer that does not exist in local map", slog.String("peer", data.DocumentKey.ID))
-				continue
-			}
+	// retry failed webhook deliveries of this server
+	go retryDeliveries()
 
-			// check all the updated fields
-			for k, v := range data.UpdateDescription.UpdatedFields {
-				if k == "groupID" {
-					peers.mu.Lock()
-					p.GroupID = v.(primitive.ObjectID)
-					peers.mu.Unlock()
-				} else if k == "TelegramChatID" {
-					peers.mu.Lock()
-					p.TelegramChatID = v.(int64)
-					peers.mu.Unlock()
-				} else if k == "totalTX" {
-					peers.mu.Lock()
-					p.TotalTX = v.(int64)
-					peers.mu.Unlock()
-				} else if k == "totalRX" {
-					peers.mu.Lock()
-					p.TotalRX = v.(int64)
-					peers.mu.Unlock()
-				} else if k == "allowedUsage" {
-					peers.mu.Lock()
-					p.AllowedUsage = v.(int64)
-					peers.mu.Unlock()
-				} else if k == "expiresAt" {
-					peers.mu.Lock()
-					p.ExpiresAt = v.(int64)
-					peers.mu.Unlock()
-				} else if k == "disabled" {
-					// do nothing
-				} else if k == "name" {
-					peers.mu.Lock()
-					p.Name = v.(string)
-					peers.mu.Unlock()
-				} else if k == "role" {
-					peers.mu.Lock()
-					p.Role = v.(string)
-					peers.mu.Unlock()
-				} else if k == "preferredEndpoint" {
-					// parse peer public key
-					pk, e := wgtypes.ParseKey(p.PublicKey)
-					if e != nil {
-						logger.Error(e.Error(), slog.String("peer", p.Name))
-						continue
-					}
-
-					p.PreferredEndpoint = v.(string)
-					if v.(string) == "" {
-						e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, Endpoint: nil, UpdateOnly: true}}})
-						if e != nil {
-							logger.Error(e.Error(), slog.String("peer", p.Name))
-							panic(e)
-						}
-					} else {
-						udpAddress, e := net.ResolveUDPAddr("udp4", v.(string))
-						if e != nil {
-							logger.Error(e.Error(), slog.String("peer", p.Name))
-							continue
-						}
-						e = wgc.ConfigureDevice(config.InterfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: pk, Endpoint: udpAddress, UpdateOnly: true}}})
-						if e != nil {
-							logger.Error(e.Error(), slog.String("peer", p.Name))
-							panic(e)
-						}
-					}
-					peers.mu.Lock()
-					p.PreferredEndpoint = v.(string)
-					peers.mu.Unlock()
-				} else if m, ok = v.(map[string]interface{}); ok {
-					if _, ok = m["address"]; ok && m["address"].(string) != config.PublicAddress {
-						ssi = p.FindSSIByAddress(m["address"].(string))
-						if ssi == nil {
-							peers.mu.Lock()
-							p.ServerSpecificInfo = append(p.ServerSpecificInfo, &ServerSpecificInfo{
-								Address:           m["address"].(string),
-								Endpoint:          m["endpoint"].(string),
-								LastHandshakeTime: m["lastHandshakeTime"].(string),
-								CurrentTX:         m["currentTX"].(int64),
-								CurrentRX:         m["currentRX"].(int64),
-							})
-							peers.mu.Unlock()
-						} else {
-							peers.mu.Lock()
-							ssi.Address = m["address"].(string)
-							ssi.Endpoint = m["endpoint"].(string)
-							ssi.LastHandshakeTime = m["lastHandshakeTime"].(string)
-							ssi.CurrentTX = m["currentTX"].(int64)
-							ssi.CurrentRX = m["currentRX"].(int64)
-							peers.mu.Unlock()
-						}
-					}
-				}
-			}
-		}
-	}()
+	// answer telegram messages of peers
+	if telegram != nil {
+		go telegram.Run()
+	}
 
 	// create echo instance
 	e := echo.New()
@@ -906,23 +695,62 @@ func main() {
 	// check if request is from a peer
 	e.Use(Auth)
 
-	e.GET("/api/peers", GetPeers)
-	e.GET("/api/groups", GetGroups)
-	e.GET("/api/peers/:id", GetPeer)
-	e.GET("/api/groups/:id", GetGroup)
-	e.POST("/api/peers", PostPeers)
-	e.POST("/api/groups", PostGroups)
-	e.DELETE("/api/peers/:id", DeletePeers)
-	e.DELETE("/api/groups/:id", DeleteGroup)
-	e.DELETE("/api/groups/:groupID/:peerID", DeletePeerFromGroup)
-	e.PATCH("/api/peers/:id", PatchPeers)
-	e.PATCH("/api/groups/:id", PatchGroups)
-	e.PUT("/api/peers/:id", PutPeers)
-	e.PUT("/api/groups/:id", PutGroups)
-	e.PUT("/api/groups/:groupID/:peerID", PutPeerToGroup)
+	// limit login attempts per ip
+	e.POST("/api/login", PostLogin, middleware.RateLimiter(middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{Rate: 1, Burst: 5, ExpiresIn: time.Minute * 3})))
+	e.PUT("/api/me/password", PutPassword, RequireScope("account:write"), RequirePermission(PermLogin))
+	e.DELETE("/api/peers/:id/sessions", DeleteSessions, RequireScope("account:write"))
+	e.GET("/api/keys", GetAPIKeys, RequireScope("keys:read"))
+	e.POST("/api/keys", PostAPIKeys, RequireScope("keys:write"))
+	e.DELETE("/api/keys/:id", DeleteAPIKey, RequireScope("keys:write"))
+
+	e.GET("/api/budgets", GetBudgets, RequireScope("peers:read"), RequirePermission(PermManageBudgets))
+	e.PUT("/api/peers/:id/budget", PutBudget, RequireScope("peers:write"), RequirePermission(PermManageBudgets))
+	e.DELETE("/api/peers/:id/budget", DeleteBudget, RequireScope("peers:write"), RequirePermission(PermManageBudgets))
+	e.GET("/api/peers/:id/periods", GetPeerPeriods, RequireScope("peers:read"))
+	e.PUT("/api/peers/:id/period", PutPeerPeriod, RequireScope("peers:write"), RequirePermission(PermChangeUsage))
+	e.DELETE("/api/peers/:id/period", DeletePeerPeriod, RequireScope("peers:write"), RequirePermission(PermChangeUsage))
+	e.GET("/api/groups/:id/periods", GetGroupPeriods, RequireScope("groups:read"))
+	e.PUT("/api/groups/:id/period", PutGroupPeriod, RequireScope("groups:write"), RequirePermission(PermManageGroups, PermChangeUsage))
+	e.DELETE("/api/groups/:id/period", DeleteGroupPeriod, RequireScope("groups:write"), RequirePermission(PermManageGroups, PermChangeUsage))
+	e.PUT("/api/peers/:id/routes", PutRoutes, RequireScope("peers:write"), RequirePermission(PermManageRoutes))
+	e.POST("/api/peers/:id/telegram", PostTelegramLink, RequireScope("peers:write"))
+
+	e.GET("/api/peers", GetPeers, RequireScope("peers:read"))
+	e.GET("/api/groups", GetGroups, RequireScope("groups:read"))
+	e.GET("/api/peers/:id", GetPeer, RequireScope("peers:read"))
+	e.GET("/api/groups/:id", GetGroup, RequireScope("groups:read"))
+	e.POST("/api/peers", PostPeers, RequireScope("peers:write"), RequirePermission(PermCreatePeer))
+	e.POST("/api/groups", PostGroups, RequireScope("groups:write"), RequirePermission(PermManageGroups))
+	e.DELETE("/api/peers/:id", DeletePeers, RequireScope("peers:write"), RequirePermission(PermDeletePeer))
+	e.DELETE("/api/groups/:id", DeleteGroup, RequireScope("groups:write"), RequirePermission(PermManageGroups))
+	e.DELETE("/api/groups/:groupID/:peerID", DeletePeerFromGroup, RequireScope("groups:write"), RequirePermission(PermManageGroups))
+	e.PATCH("/api/peers/:id", PatchPeers, RequireScope("peers:write"), RequirePermission(PermUpdatePeer))
+	e.PATCH("/api/groups/:id", PatchGroups, RequireScope("groups:write"), RequirePermission(PermManageGroups))
+	e.PUT("/api/peers/:id", PutPeers, RequireScope("peers:write"), RequirePermission(PermResetUsage))
+	e.PUT("/api/groups/:id", PutGroups, RequireScope("groups:write"), RequirePermission(PermManageGroups, PermResetUsage))
+	e.PUT("/api/groups/:groupID/:peerID", PutPeerToGroup, RequireScope("groups:write"), RequirePermission(PermManageGroups, PermChangeUsage, PermChangeExpiry))
 	e.GET("/api/config", GetConfig)
 	e.GET("/api/me", GetMe)
-	e.GET("/api/logs", GetLogs)
+	e.GET("/api/roles", GetRoles)
+	e.GET("/api/logs", GetLogs, RequireScope("logs:read"), RequirePermission(PermViewLogs))
+	e.GET("/api/audit", GetAudit, RequireScope("audit:read"), RequirePermission(PermViewAudit))
+	e.GET("/api/peers/:id/config", GetPeerConfig, RequireScope("peers:read"))
+	e.GET("/api/peers/:id/usage", GetPeerUsage, RequireScope("peers:read"))
+	e.GET("/api/groups/:id/usage", GetGroupUsage, RequireScope("groups:read"))
+	e.GET("/api/servers/:address/usage", GetServerUsage, RequireScope("peers:read"), RequirePermission(PermAllPeers))
+	e.GET("/api/ipam", GetIPAM, RequireScope("peers:read"), RequirePermission(PermAllPeers))
+	e.GET("/api/reconcile", GetReconcile, RequireScope("logs:read"), RequirePermission(PermViewLogs))
+	e.GET("/api/events", GetEvents, RequireScope("peers:read"))
+	e.GET("/api/webhooks", GetWebhooks, RequireScope("webhooks:read"), RequirePermission(PermManageWebhooks))
+	e.POST("/api/webhooks", PostWebhooks, RequireScope("webhooks:write"), RequirePermission(PermManageWebhooks))
+	e.PATCH("/api/webhooks/:id", PatchWebhook, RequireScope("webhooks:write"), RequirePermission(PermManageWebhooks))
+	e.DELETE("/api/webhooks/:id", DeleteWebhook, RequireScope("webhooks:write"), RequirePermission(PermManageWebhooks))
+	e.GET("/api/webhooks/:id/deliveries", GetDeliveries, RequireScope("webhooks:read"), RequirePermission(PermManageWebhooks))
+	e.POST("/api/webhooks/:id/deliveries/:deliveryID/redeliver", PostRedelivery, RequireScope("webhooks:write"), RequirePermission(PermManageWebhooks))
+	e.GET("/api/profiles", GetProfiles, RequireScope("profiles:read"))
+	e.POST("/api/profiles", PostProfiles, RequireScope("profiles:write"), RequirePermission(PermManageProfiles))
+	e.PATCH("/api/profiles/:id", PatchProfile, RequireScope("profiles:write"), RequirePermission(PermManageProfiles))
+	e.DELETE("/api/profiles/:id", DeleteProfile, RequireScope("profiles:write"), RequirePermission(PermManageProfiles))
 
 	e.Logger.Fatal(e.StartTLS("0.0.0.0:443", filepath.Join(path, "certs", "server.pem"), filepath.Join(path, "certs", "server.key")))
 }
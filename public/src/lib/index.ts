@@ -14,6 +14,8 @@ export interface Peer {
 	Name: string
 	PreferredEndpoint: string
 	AllowedIPs: string
+	AllowedIPsV6?: string
+	Routes?: string[]
 	PublicKey: string
 	PrivateKey: string
 	Disabled: boolean